@@ -0,0 +1,26 @@
+import axios from 'axios';
+
+const API_BASE = 'http://localhost:8080';
+
+const authHeaders = () => ({ Authorization: `Bearer ${localStorage.getItem('chat_access_token')}` });
+
+export const attachmentsApi = {
+  // uploads one file, send the returned id in the attachmentIds of a message
+  async upload(file) {
+    const form = new FormData();
+    form.append('file', file);
+    const res = await axios.post(`${API_BASE}/attachments`, form, { headers: authHeaders() });
+    return res.data;
+  },
+
+  // signed download URLs, they expire after a few minutes so fetch them when showing the file
+  async getUrls(attachmentId) {
+    const res = await axios.get(`${API_BASE}/attachments/${attachmentId}`, { headers: authHeaders() });
+    const { url, thumbnailUrl, expiresAt } = res.data.response;
+    return {
+      url: `${API_BASE}${url}`,
+      thumbnailUrl: thumbnailUrl ? `${API_BASE}${thumbnailUrl}` : null,
+      expiresAt
+    };
+  }
+};
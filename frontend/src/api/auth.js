@@ -15,8 +15,20 @@ export const authApi = {
     const res = await axios.post(`${API_BASE}/registration`, { username, password });
     return res.data;
   },
+  async refresh(refreshToken) {
+    const res = await axios.post(`${API_BASE}/refreshToken`, { refreshToken });
+    return res.data;
+  },
+  async logout() {
+    const res = await axios.post(`${API_BASE}/logout`, null, {
+      headers: { Authorization: `Bearer ${localStorage.getItem('chat_access_token')}` }
+    });
+    return res.data;
+  },
   async checkSession(userId) {
-    const res = await axios.get(`${API_BASE}/UserSessionCheck/${userId}`);
+    const res = await axios.get(`${API_BASE}/UserSessionCheck/${userId}`, {
+      headers: { Authorization: `Bearer ${localStorage.getItem('chat_access_token')}` }
+    });
     return res.data;
   }
 };
\ No newline at end of file
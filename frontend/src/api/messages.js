@@ -3,8 +3,29 @@ import axios from 'axios';
 const API_BASE = 'http://localhost:8080';
 
 export const messagesApi = {
-  async getConversation(toUserId, fromUserId, page = 1) {
-    const res = await axios.get(`${API_BASE}/getConversation/${toUserId}/${fromUserId}?page=${page}`);
+  // pass the nextCursor of the previous response as before to load older messages
+  async getConversation(toUserId, fromUserId, before) {
+    const res = await axios.get(`${API_BASE}/getConversation/${toUserId}/${fromUserId}`, {
+      params: before ? { before } : {},
+      headers: { Authorization: `Bearer ${localStorage.getItem('chat_access_token')}` }
+    });
+    return res.data;
+  },
+
+  // every conversation of the user, most recent first, with its last message and unread count
+  async getConversations() {
+    const res = await axios.get(`${API_BASE}/conversations`, {
+      headers: { Authorization: `Bearer ${localStorage.getItem('chat_access_token')}` }
+    });
+    return res.data;
+  },
+
+  // params: q and optionally with, from, since, until, before and limit
+  async searchMessages(params) {
+    const res = await axios.get(`${API_BASE}/messages/search`, {
+      params,
+      headers: { Authorization: `Bearer ${localStorage.getItem('chat_access_token')}` }
+    });
     return res.data;
   }
 };
\ No newline at end of file
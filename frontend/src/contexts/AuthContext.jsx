@@ -9,13 +9,24 @@ export function AuthProvider({ children }) {
   const [loading, setLoading] = useState(true);
   const navigate = useNavigate();
 
-  const logout = useCallback(() => {
+  const clearSession = useCallback(() => {
     localStorage.removeItem('chat_user_id');
     localStorage.removeItem('chat_username');
+    localStorage.removeItem('chat_access_token');
+    localStorage.removeItem('chat_refresh_token');
     setUser(null);
     navigate('/login');
   }, [navigate]);
 
+  const logout = useCallback(async () => {
+    try {
+      await authApi.logout();
+    } catch (error) {
+      console.error('Logout failed:', error);
+    }
+    clearSession();
+  }, [clearSession]);
+
   useEffect(() => {
     const validateSession = async () => {
       try {
@@ -23,24 +34,33 @@ export function AuthProvider({ children }) {
         const username = localStorage.getItem('chat_username');
         
         if (userId && username) {
-          const response = await authApi.checkSession(userId);
+          let response;
+          try {
+            response = await authApi.checkSession(userId);
+          } catch (error) {
+            // the access token expired, trade the refresh token for a new one
+            const refreshed = await authApi.refresh(localStorage.getItem('chat_refresh_token'));
+            localStorage.setItem('chat_access_token', refreshed.response.accessToken);
+            localStorage.setItem('chat_refresh_token', refreshed.response.refreshToken);
+            response = await authApi.checkSession(userId);
+          }
           // Check lowercase 'response' key
           if (response.response === true) {
             setUser({ id: userId, username });
           } else {
-            logout();
+            clearSession();
           }
         }
       } catch (error) {
         console.error('Session validation failed:', error);
-        logout();
+        clearSession();
       } finally {
         setLoading(false);
       }
     };
 
     validateSession();
-  }, [logout]);
+  }, [clearSession]);
 
   const login = async (credentials) => {
     try {
@@ -55,6 +75,8 @@ export function AuthProvider({ children }) {
         if (userID && username) {
           localStorage.setItem('chat_user_id', userID);
           localStorage.setItem('chat_username', username);
+          localStorage.setItem('chat_access_token', response.response.accessToken);
+          localStorage.setItem('chat_refresh_token', response.response.refreshToken);
           
           setUser({ id: userID, username });
           navigate('/chat');
@@ -84,6 +106,8 @@ export function AuthProvider({ children }) {
         if (userID && username) {
           localStorage.setItem('chat_user_id', userID);
           localStorage.setItem('chat_username', username);
+          localStorage.setItem('chat_access_token', response.response.accessToken);
+          localStorage.setItem('chat_refresh_token', response.response.refreshToken);
           
           setUser({ id: userID, username });
           navigate('/chat');
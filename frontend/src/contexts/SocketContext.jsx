@@ -3,6 +3,19 @@ import { useAuth } from './AuthContext';
 
 const SocketContext = createContext();
 
+// version of the socket envelope the server speaks
+const PROTOCOL_VERSION = 1;
+
+let nextRequestId = 0;
+
+// wraps an event in the versioned envelope, the requestId comes back on errors
+const sendEvent = (ws, type, payload) => {
+  nextRequestId += 1;
+  const requestId = String(nextRequestId);
+  ws.send(JSON.stringify({ version: PROTOCOL_VERSION, type, requestId, payload }));
+  return requestId;
+};
+
 export function SocketProvider({ children }) {
   const { user } = useAuth();
   const [onlineUsers, setOnlineUsers] = useState([]);
@@ -13,23 +26,57 @@ export function SocketProvider({ children }) {
     if (!user) return;
 
     // Create WebSocket connection
-    const ws = new WebSocket(`ws://localhost:8080/ws/${user.id}`);
+    const token = localStorage.getItem('chat_access_token');
+    const ws = new WebSocket(`ws://localhost:8080/ws?token=${encodeURIComponent(token)}`);
     wsRef.current = ws;
 
     ws.onopen = () => {
       console.log('WebSocket connected');
       // Send join event
-      ws.send(JSON.stringify({
-        eventname: "join",
-        eventpayload: user.id
-      }));
+      sendEvent(ws, 'join');
+      // Ask for everything that arrived while we were away
+      sendEvent(ws, 'resume', { lastSeq: Number(localStorage.getItem('chat_last_seq') || 0) });
     };
 
     ws.onmessage = (event) => {
-      const payload = JSON.parse(event.data);
-      
-      if (payload.eventname === 'chatlist-response') {
-        const data = payload.eventpayload;
+      const envelope = JSON.parse(event.data);
+
+      if (envelope.type === 'error') {
+        console.warn(`Request ${envelope.requestId || '-'} failed:`, envelope.payload);
+      } else if (envelope.type === 'ack' || envelope.type === 'nack') {
+        // the server stored the message, or refused it with a reason
+        const { clientMessageId } = envelope.payload;
+        if (envelope.type === 'nack') {
+          console.warn(`Message ${clientMessageId} was not sent:`, envelope.payload.reason);
+        }
+        setMessages(prev => {
+          const next = {};
+          Object.keys(prev).forEach(conversationId => {
+            next[conversationId] = prev[conversationId].map(m => m.id !== clientMessageId ? m : {
+              ...m,
+              id: envelope.type === 'ack' ? envelope.payload.messageId : m.id,
+              timestamp: envelope.type === 'ack' ? envelope.payload.createdAt : m.timestamp,
+              pending: false,
+              failed: envelope.type === 'nack'
+            });
+          });
+          return next;
+        });
+      } else if (envelope.type === 'message-updated') {
+        // an edit or a delete by the sender, deleted messages keep their place without text
+        const msg = envelope.payload;
+        const conversationId = [msg.fromUserID, msg.toUserID].sort().join('_');
+        setMessages(prev => ({
+          ...prev,
+          [conversationId]: (prev[conversationId] || []).map(m => m.id !== msg.id ? m : {
+            ...m,
+            text: msg.message,
+            edited: msg.edited,
+            deleted: msg.deleted
+          })
+        }));
+      } else if (envelope.type === 'chatlist-response') {
+        const data = envelope.payload;
         
         if (data.type === 'my-chatlist') {
           setOnlineUsers(data.chatlist || []);
@@ -42,8 +89,18 @@ export function SocketProvider({ children }) {
         } else if (data.type === 'user-disconnected') {
           setOnlineUsers(prev => prev.filter(u => u.userID !== data.chatlist.userID));
         }
-      } else if (payload.eventname === 'message-response') {
-        const msg = payload.eventpayload;
+      } else if (envelope.type === 'thread-reply') {
+        // replies in threads aren't shown yet, but they count towards the inbox sequence
+        const msg = envelope.payload;
+        const lastSeq = Number(localStorage.getItem('chat_last_seq') || 0);
+        if (msg.seq > lastSeq) localStorage.setItem('chat_last_seq', String(msg.seq));
+      } else if (envelope.type === 'message-response') {
+        const msg = envelope.payload;
+        if (msg.seq) {
+          const lastSeq = Number(localStorage.getItem('chat_last_seq') || 0);
+          if (msg.seq <= lastSeq) return;
+          localStorage.setItem('chat_last_seq', String(msg.seq));
+        }
         const conversationId = [msg.fromUserID, msg.toUserID].sort().join('_');
         
         setMessages(prev => ({
@@ -51,7 +108,7 @@ export function SocketProvider({ children }) {
           [conversationId]: [
             ...(prev[conversationId] || []),
             {
-              id: Date.now().toString() + Math.random(),
+              id: msg.id,
               text: msg.message,
               senderId: msg.fromUserID,
               timestamp: new Date().toISOString()
@@ -71,10 +128,7 @@ export function SocketProvider({ children }) {
 
     return () => {
       if (ws.readyState === WebSocket.OPEN) {
-        ws.send(JSON.stringify({
-          eventname: "disconnect",
-          eventpayload: user.id
-        }));
+        sendEvent(ws, 'disconnect');
         ws.close();
       }
     };
@@ -83,16 +137,9 @@ export function SocketProvider({ children }) {
   const sendMessage = (toUserId, message) => {
     if (!wsRef.current || wsRef.current.readyState !== WebSocket.OPEN || !user) return;
     
-    const payload = {
-      eventname: 'message',
-      eventpayload: {
-        message,
-        toUserID: toUserId,
-        fromUserID: user.id
-      }
-    };
-    
-    wsRef.current.send(JSON.stringify(payload));
+    // a retry with the same clientMessageId is stored only once
+    const clientMessageId = crypto.randomUUID();
+    sendEvent(wsRef.current, 'message', { clientMessageId, message, toUserID: toUserId });
     
     // Optimistic update
     const conversationId = [user.id, toUserId].sort().join('_');
@@ -101,10 +148,11 @@ export function SocketProvider({ children }) {
       [conversationId]: [
         ...(prev[conversationId] || []),
         {
-          id: Date.now().toString() + Math.random(),
+          id: clientMessageId,
           text: message,
           senderId: user.id,
-          timestamp: new Date().toISOString()
+          timestamp: new Date().toISOString(),
+          pending: true
         }
       ]
     }));
@@ -4,7 +4,7 @@ import (
 	"context"
 	"os"
 	"time"
-	"log"
+	"log/slog"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -12,29 +12,27 @@ import (
 
 var Client *mongo.Client
 
-func ConnectDatabase(){
-	log.Println("Connecting to database...")
+func ConnectDatabase(dbURI string){
+	slog.Info("Connecting to database")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	dbURI := os.Getenv("DB_URL")
-	if dbURI == ""{
-		dbURI = "mongodb://localhost:27017"
-	}
-	options := options.Client().ApplyURI(dbURI)
+	options := options.Client().ApplyURI(dbURI).SetMonitor(mongoTraceMonitor())
 
 	client, err := mongo.Connect(ctx, options)
 	if err != nil{
-		log.Fatal("Error connecting to mongodb", err)
+		slog.Error("Error connecting to mongodb", "error", err)
+		os.Exit(1)
 	}
 
 	if err = client.Ping(ctx, nil); err != nil{
-		log.Fatal("Can't ping the client", err)
+		slog.Error("Can't ping the client", "error", err)
+		os.Exit(1)
 	}
 
 	Client = client
-	log.Println("Connected to database")
+	slog.Info("Connected to database")
 }
 
 func DisConnectDB(){
@@ -43,9 +41,9 @@ func DisConnectDB(){
 		defer cancel()
 
 		if err := Client.Disconnect(ctx); err != nil{
-			log.Println("Error disconnecting MongoDB:", err)
+			slog.Error("Error disconnecting MongoDB", "error", err)
 		}else {
-			log.Println("Database disconnected successfully.")
+			slog.Info("Database disconnected successfully")
 		}
 	}
 }
\ No newline at end of file
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// a leaf of Config, path is its key in the config file and its flag
+type setting struct {
+	path  string
+	field reflect.StructField
+	value reflect.Value
+}
+
+// calls visit with every setting of config, in the order of the struct
+func eachSetting(config *Config, visit func(setting)){
+	var walk func(prefix string, value reflect.Value)
+	walk = func(prefix string, value reflect.Value){
+		for i := 0; i < value.NumField(); i++{
+			field := value.Type().Field(i)
+			path := prefix + field.Tag.Get("yaml")
+
+			if field.Type.Kind() == reflect.Struct{
+				walk(path + ".", value.Field(i))
+				continue
+			}
+			visit(setting{path: path, field: field, value: value.Field(i)})
+		}
+	}
+	walk("", reflect.ValueOf(config).Elem())
+}
+
+// parses text into the setting
+func (setting setting) set(text string) error{
+	return setValue(setting.value, text)
+}
+
+// lists are comma separated
+func setValue(value reflect.Value, text string) error{
+	if unmarshaler, ok := value.Addr().Interface().(encoding.TextUnmarshaler); ok{
+		return unmarshaler.UnmarshalText([]byte(text))
+	}
+
+	switch value.Kind(){
+	case reflect.String:
+		value.SetString(text)
+	case reflect.Int, reflect.Int64:
+		number, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+		if err != nil{
+			return errors.New("not a whole number")
+		}
+		value.SetInt(number)
+	case reflect.Bool:
+		flag, err := strconv.ParseBool(strings.TrimSpace(text))
+		if err != nil{
+			return errors.New("not true or false")
+		}
+		value.SetBool(flag)
+	case reflect.Slice:
+		items := reflect.MakeSlice(value.Type(), 0, 0)
+		for _, item := range strings.Split(text, ","){
+			if item = strings.TrimSpace(item); item == ""{
+				continue
+			}
+			element := reflect.New(value.Type().Elem()).Elem()
+			if err := setValue(element, item); err != nil{
+				return err
+			}
+			items = reflect.Append(items, element)
+		}
+		value.Set(items)
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Type())
+	}
+	return nil
+}
+
+// reads a YAML or TOML file, told apart by its extension, keys the Config doesn't have are an error
+func readFile(path string, config *Config) error{
+	data, err := os.ReadFile(path)
+	if err != nil{
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)){
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		// an empty file has no document at all
+		if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF){
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(config); err != nil{
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("%s: the config file must end in .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// Load builds the configuration from, in increasing precedence: the defaults, the file named by
+// -config or CONFIG_FILE, the environment with the variables of a .env file added, and the flags in args.
+// The result is validated, a missing .env file is fine.
+func Load(args []string) (Config, error){
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist){
+		return Config{}, fmt.Errorf(".env: %w", err)
+	}
+
+	config := Default()
+
+	flags := flag.NewFlagSet("chat-server", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML configuration file, also CONFIG_FILE")
+
+	// flags are applied last, after the file and the environment, in the order they were given
+	type flagValue struct{ setting setting; text string }
+	var flagValues []flagValue
+	eachSetting(&config, func(setting setting){
+		usage := "also " + setting.field.Tag.Get("env")
+		collect := func(text string) error{
+			flagValues = append(flagValues, flagValue{setting, text})
+			return nil
+		}
+		// -cors.devMode works without a value
+		if setting.value.Kind() == reflect.Bool{
+			flags.BoolFunc(setting.path, usage, collect)
+		}else{
+			flags.Func(setting.path, usage, collect)
+		}
+	})
+	if err := flags.Parse(args); err != nil{
+		return Config{}, err
+	}
+
+	if *path != ""{
+		if err := readFile(*path, &config); err != nil{
+			return Config{}, err
+		}
+	}
+
+	var problems []error
+	eachSetting(&config, func(setting setting){
+		name := setting.field.Tag.Get("env")
+		if text, ok := os.LookupEnv(name); ok{
+			if err := setting.set(text); err != nil{
+				problems = append(problems, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	})
+	for _, value := range flagValues{
+		if err := value.setting.set(value.text); err != nil{
+			problems = append(problems, fmt.Errorf("-%s: %w", value.setting.path, err))
+		}
+	}
+	if len(problems) > 0{
+		return Config{}, errors.Join(problems...)
+	}
+
+	return config, config.Validate()
+}
@@ -0,0 +1,15 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+)
+
+// SetupLogging makes slog write JSON lines to stdout at the given level, Validate already checked it
+func SetupLogging(levelName string){
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(levelName)); err != nil{
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// OriginPattern is an origin like "https://chat.example.com", or "https://*.example.com" for
+// any subdomain of example.com but not example.com itself. Scheme, host and port must all match.
+type OriginPattern struct {
+	scheme string
+	// the host with its port, without the "*." of a wildcard
+	host     string
+	wildcard bool
+}
+
+func (pattern *OriginPattern) UnmarshalText(text []byte) error{
+	value := strings.ToLower(strings.TrimSpace(string(text)))
+	if value == "*"{
+		return errors.New("\"*\" would allow every origin, use cors.devMode for that")
+	}
+
+	origin, err := url.Parse(value)
+	if err != nil || (origin.Scheme != "http" && origin.Scheme != "https") || origin.Host == ""{
+		return errors.New(value + " is not an origin like https://chat.example.com")
+	}
+	if origin.User != nil || strings.TrimSuffix(origin.Path, "/") != "" || origin.RawQuery != "" || origin.Fragment != ""{
+		return errors.New(value + " is not an origin, it can only have a scheme, a host and a port")
+	}
+
+	host := origin.Host
+	wildcard := strings.HasPrefix(host, "*.")
+	if wildcard{
+		host = strings.TrimPrefix(host, "*.")
+	}
+	if strings.Contains(host, "*") || strings.HasPrefix(host, ".") || strings.HasPrefix(host, ":"){
+		return errors.New(value + ": a wildcard can only stand for the subdomains, like https://*.example.com")
+	}
+
+	*pattern = OriginPattern{scheme: origin.Scheme, host: host, wildcard: wildcard}
+	return nil
+}
+
+func (pattern OriginPattern) MarshalText() ([]byte, error){
+	return []byte(pattern.String()), nil
+}
+
+func (pattern OriginPattern) String() string{
+	if pattern.wildcard{
+		return pattern.scheme + "://*." + pattern.host
+	}
+	return pattern.scheme + "://" + pattern.host
+}
+
+// Matches reports whether origin, the Origin header of a request, is allowed by the pattern
+func (pattern OriginPattern) Matches(origin string) bool{
+	parsed, err := url.Parse(strings.ToLower(origin))
+	if err != nil || parsed.Scheme != pattern.scheme || parsed.Host == ""{
+		return false
+	}
+	if pattern.wildcard{
+		return strings.HasSuffix(parsed.Host, "." + pattern.host)
+	}
+	return parsed.Host == pattern.host
+}
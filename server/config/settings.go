@@ -0,0 +1,280 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config holds every setting of the server. Each setting has a key in the config file, the dotted
+// path of its yaml tag which is also its command line flag, and the environment variable in its env tag.
+// Settings tagged secret are redacted when the config is logged.
+type Config struct {
+	Server      ServerConfig      `yaml:"server" toml:"server"`
+	Database    DatabaseConfig    `yaml:"database" toml:"database"`
+	Redis       RedisConfig       `yaml:"redis" toml:"redis"`
+	Auth        AuthConfig        `yaml:"auth" toml:"auth"`
+	Socket      SocketConfig      `yaml:"socket" toml:"socket"`
+	Messages    MessagesConfig    `yaml:"messages" toml:"messages"`
+	Attachments AttachmentsConfig `yaml:"attachments" toml:"attachments"`
+	CORS        CORSConfig        `yaml:"cors" toml:"cors"`
+	Logging     LoggingConfig     `yaml:"logging" toml:"logging"`
+	Tracing     TracingConfig     `yaml:"tracing" toml:"tracing"`
+}
+
+type ServerConfig struct {
+	// the host clients reach the server at, it listens on every interface
+	Host string `yaml:"host" toml:"host" env:"HOST"`
+	Port int    `yaml:"port" toml:"port" env:"PORT"`
+	// time between /readyz failing on a shutdown and the listener closing, for the load balancer
+	// to take the instance out of rotation
+	DrainPeriod Duration `yaml:"drainPeriod" toml:"drainPeriod" env:"DRAIN_PERIOD"`
+	// time a shutdown has to close the sockets, flush what's queued for them and disconnect the database
+	ShutdownTimeout Duration `yaml:"shutdownTimeout" toml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type DatabaseConfig struct {
+	// "mongo", or "memory" to run without a database, nothing survives a restart then
+	Storage string `yaml:"storage" toml:"storage" env:"STORAGE"`
+	// messages are stored in transactions, so MongoDB must run as a replica set, a single member one will do
+	URL     string `yaml:"url" toml:"url" env:"DB_URL" secret:"url"`
+	Name    string `yaml:"name" toml:"name" env:"MONGODB_DATABASE"`
+}
+
+type RedisConfig struct {
+	// lets several instances share their sockets and presence, without it the server runs on its own
+	URL string `yaml:"url" toml:"url" env:"REDIS_URL" secret:"url"`
+}
+
+type AuthConfig struct {
+	JWTSecret  string `yaml:"jwtSecret" toml:"jwtSecret" env:"JWT_SECRET" secret:"true"`
+	BcryptCost int    `yaml:"bcryptCost" toml:"bcryptCost" env:"BCRYPT_COST"`
+	// access tokens are short lived, clients renew them with the refresh token
+	AccessTokenTTL Duration `yaml:"accessTokenTTL" toml:"accessTokenTTL" env:"ACCESS_TOKEN_TTL"`
+	// refresh tokens keep a session alive until the user logs out
+	RefreshTokenTTL Duration `yaml:"refreshTokenTTL" toml:"refreshTokenTTL" env:"REFRESH_TOKEN_TTL"`
+}
+
+type SocketConfig struct {
+	// a client that didn't answer a ping for this long is dropped, pings go out at 9/10 of it
+	PongWait Duration `yaml:"pongWait" toml:"pongWait" env:"SOCKET_PONG_WAIT"`
+	// longest a write to a client may take
+	WriteWait Duration `yaml:"writeWait" toml:"writeWait" env:"SOCKET_WRITE_WAIT"`
+	// largest frame a client may send, files go through the upload endpoint
+	MaxMessageSize int64 `yaml:"maxMessageSize" toml:"maxMessageSize" env:"SOCKET_MAX_MESSAGE_SIZE"`
+	// events queued per client before it counts as too slow and is dropped
+	SendBufferSize int `yaml:"sendBufferSize" toml:"sendBufferSize" env:"SOCKET_SEND_BUFFER_SIZE"`
+	// deliveries queued for the Lobby before emitting blocks
+	EmitBufferSize int `yaml:"emitBufferSize" toml:"emitBufferSize" env:"SOCKET_EMIT_BUFFER_SIZE"`
+	// missed messages loaded per query while resuming
+	ResumeBatchSize int64 `yaml:"resumeBatchSize" toml:"resumeBatchSize" env:"SOCKET_RESUME_BATCH_SIZE"`
+	// I/O buffers of a connection in bytes, a larger frame just takes several reads or writes
+	ReadBufferSize  int `yaml:"readBufferSize" toml:"readBufferSize" env:"SOCKET_READ_BUFFER_SIZE"`
+	WriteBufferSize int `yaml:"writeBufferSize" toml:"writeBufferSize" env:"SOCKET_WRITE_BUFFER_SIZE"`
+	// a client that started typing and didn't send anything for this long is considered to have stopped
+	TypingTimeout Duration `yaml:"typingTimeout" toml:"typingTimeout" env:"SOCKET_TYPING_TIMEOUT"`
+}
+
+type MessagesConfig struct {
+	// senders can edit or delete a message for this long
+	EditWindow Duration `yaml:"editWindow" toml:"editWindow" env:"MESSAGE_EDIT_WINDOW"`
+	// messages in a page when the client doesn't ask for a limit, and the largest limit it may ask for
+	PageSize    int64 `yaml:"pageSize" toml:"pageSize" env:"MESSAGE_PAGE_SIZE"`
+	MaxPageSize int64 `yaml:"maxPageSize" toml:"maxPageSize" env:"MESSAGE_MAX_PAGE_SIZE"`
+}
+
+type AttachmentsConfig struct {
+	// "local" keeps the files in Dir, "s3" in an S3 compatible bucket
+	Store   string   `yaml:"store" toml:"store" env:"BLOB_STORE"`
+	Dir     string   `yaml:"dir" toml:"dir" env:"ATTACHMENT_DIR"`
+	MaxSize int64    `yaml:"maxSize" toml:"maxSize" env:"MAX_ATTACHMENT_SIZE"`
+	// download URLs stop working after this long
+	DownloadURLTTL Duration `yaml:"downloadURLTTL" toml:"downloadURLTTL" env:"DOWNLOAD_URL_TTL"`
+	S3      S3Config `yaml:"s3" toml:"s3"`
+}
+
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint" toml:"endpoint" env:"S3_ENDPOINT"`
+	Region          string `yaml:"region" toml:"region" env:"S3_REGION"`
+	Bucket          string `yaml:"bucket" toml:"bucket" env:"S3_BUCKET"`
+	AccessKeyID     string `yaml:"accessKeyId" toml:"accessKeyId" env:"S3_ACCESS_KEY_ID"`
+	SecretAccessKey string `yaml:"secretAccessKey" toml:"secretAccessKey" env:"S3_SECRET_ACCESS_KEY" secret:"true"`
+}
+
+type CORSConfig struct {
+	// origins the browser may call the API and open sockets from, comma separated in the environment and flags
+	AllowedOrigins []OriginPattern `yaml:"allowedOrigins" toml:"allowedOrigins" env:"CORS_ALLOWED_ORIGINS"`
+	// allows every origin and logs the ones the allowlist wouldn't have, never in production
+	DevMode bool `yaml:"devMode" toml:"devMode" env:"CORS_DEV_MODE"`
+}
+
+type LoggingConfig struct {
+	// debug, info, warn or error
+	Level string `yaml:"level" toml:"level" env:"LOG_LEVEL"`
+}
+
+type TracingConfig struct {
+	// OTLP/HTTP endpoint like http://localhost:4318, no spans are recorded without it
+	Endpoint string `yaml:"endpoint" toml:"endpoint" env:"TRACING_ENDPOINT"`
+}
+
+// Duration reads like "15s" or "1h30m" in files, the environment and flags
+type Duration time.Duration
+
+func (duration *Duration) UnmarshalText(text []byte) error{
+	value, err := time.ParseDuration(string(text))
+	if err != nil{
+		return err
+	}
+	*duration = Duration(value)
+	return nil
+}
+
+func (duration Duration) MarshalText() ([]byte, error){
+	return []byte(duration.String()), nil
+}
+
+func (duration Duration) String() string{
+	return time.Duration(duration).String()
+}
+
+// Default returns the settings the server runs with when nothing else is configured
+func Default() Config{
+	return Config{
+		Server: ServerConfig{
+			Host: "localhost",
+			Port: 8080,
+			DrainPeriod: Duration(5 * time.Second),
+			ShutdownTimeout: Duration(15 * time.Second),
+		},
+		Database: DatabaseConfig{
+			Storage: "mongo",
+			URL: "mongodb://localhost:27017",
+		},
+		Auth: AuthConfig{
+			BcryptCost: bcrypt.DefaultCost,
+			AccessTokenTTL: Duration(15 * time.Minute),
+			RefreshTokenTTL: Duration(30 * 24 * time.Hour),
+		},
+		Socket: SocketConfig{
+			PongWait: Duration(60 * time.Second),
+			WriteWait: Duration(10 * time.Second),
+			MaxMessageSize: 4096,
+			SendBufferSize: 256,
+			EmitBufferSize: 1024,
+			ResumeBatchSize: 100,
+			ReadBufferSize: 1024,
+			WriteBufferSize: 1024,
+			TypingTimeout: Duration(6 * time.Second),
+		},
+		Messages: MessagesConfig{
+			EditWindow: Duration(15 * time.Minute),
+			PageSize: 20,
+			MaxPageSize: 100,
+		},
+		Attachments: AttachmentsConfig{
+			Store: "local",
+			Dir: "attachments",
+			MaxSize: 25 << 20,
+			DownloadURLTTL: Duration(15 * time.Minute),
+		},
+		CORS: CORSConfig{
+			// the frontend's development server
+			AllowedOrigins: []OriginPattern{{scheme: "http", host: "localhost:3000"}},
+		},
+		Logging: LoggingConfig{
+			Level: "info",
+		},
+	}
+}
+
+// Validate returns every problem with the settings at once
+func (config Config) Validate() error{
+	var problems []error
+	check := func(ok bool, format string, args ...interface{}){
+		if !ok{
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(config.Server.Port >= 1 && config.Server.Port <= 65535, "server.port must be between 1 and 65535")
+	check(config.Server.DrainPeriod >= 0, "server.drainPeriod can't be negative")
+	check(config.Server.ShutdownTimeout > 0, "server.shutdownTimeout must be positive")
+
+	check(config.Database.Storage == "mongo" || config.Database.Storage == "memory", "database.storage must be mongo or memory")
+	if config.Database.Storage == "mongo"{
+		check(config.Database.URL != "", "database.url is required with mongo storage")
+		check(config.Database.Name != "", "database.name is required with mongo storage")
+	}
+
+	check(config.Auth.JWTSecret != "", "auth.jwtSecret is required")
+	check(config.Auth.BcryptCost >= bcrypt.MinCost && config.Auth.BcryptCost <= bcrypt.MaxCost,
+		"auth.bcryptCost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	check(config.Auth.AccessTokenTTL > 0, "auth.accessTokenTTL must be positive")
+	check(config.Auth.RefreshTokenTTL > config.Auth.AccessTokenTTL, "auth.refreshTokenTTL must be longer than auth.accessTokenTTL")
+
+	// a ping goes out at 9/10 of pongWait, the write of it must fit in before the deadline
+	check(config.Socket.PongWait > 0, "socket.pongWait must be positive")
+	check(config.Socket.WriteWait > 0 && config.Socket.WriteWait < config.Socket.PongWait, "socket.writeWait must be positive and shorter than socket.pongWait")
+	check(config.Socket.MaxMessageSize >= 512, "socket.maxMessageSize must be at least 512")
+	check(config.Socket.SendBufferSize > 0, "socket.sendBufferSize must be positive")
+	check(config.Socket.EmitBufferSize > 0, "socket.emitBufferSize must be positive")
+	check(config.Socket.ResumeBatchSize > 0, "socket.resumeBatchSize must be positive")
+	check(config.Socket.ReadBufferSize > 0, "socket.readBufferSize must be positive")
+	check(config.Socket.WriteBufferSize > 0, "socket.writeBufferSize must be positive")
+	check(config.Socket.TypingTimeout > 0, "socket.typingTimeout must be positive")
+
+	check(config.Messages.EditWindow >= 0, "messages.editWindow can't be negative")
+	check(config.Messages.MaxPageSize > 0, "messages.maxPageSize must be positive")
+	check(config.Messages.PageSize > 0 && config.Messages.PageSize <= config.Messages.MaxPageSize, "messages.pageSize must be between 1 and messages.maxPageSize")
+
+	check(config.Attachments.MaxSize > 0, "attachments.maxSize must be positive")
+	check(config.Attachments.DownloadURLTTL > 0, "attachments.downloadURLTTL must be positive")
+	switch config.Attachments.Store{
+	case "local":
+		check(config.Attachments.Dir != "", "attachments.dir is required with the local store")
+	case "s3":
+		s3 := config.Attachments.S3
+		check(s3.Endpoint != "" && s3.Region != "" && s3.Bucket != "" && s3.AccessKeyID != "" && s3.SecretAccessKey != "",
+			"attachments.s3 needs an endpoint, region, bucket, accessKeyId and secretAccessKey with the s3 store")
+	default:
+		check(false, "attachments.store must be local or s3")
+	}
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(config.Logging.Level)) == nil, "logging.level must be debug, info, warn or error")
+
+	if config.Tracing.Endpoint != ""{
+		endpoint, err := url.Parse(config.Tracing.Endpoint)
+		check(err == nil && endpoint.Scheme != "" && endpoint.Host != "", "tracing.endpoint must be a URL like http://localhost:4318")
+	}
+
+	return errors.Join(problems...)
+}
+
+// LogValue lets the config be logged as it is, secrets are redacted and the passwords in URLs masked
+func (config Config) LogValue() slog.Value{
+	var attributes []slog.Attr
+	eachSetting(&config, func(setting setting){
+		value := setting.value.Interface()
+
+		switch setting.field.Tag.Get("secret"){
+		case "true":
+			if setting.value.String() != ""{
+				value = "[redacted]"
+			}
+		case "url":
+			if parsed, err := url.Parse(setting.value.String()); err != nil{
+				value = "[redacted]"
+			}else{
+				value = parsed.Redacted()
+			}
+		}
+		attributes = append(attributes, slog.Any(setting.path, value))
+	})
+	return slog.GroupValue(attributes...)
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "chat-server"
+
+// SetupTracing exports traces over OTLP/HTTP to endpoint, a URL like http://localhost:4318.
+// Without it no spans are recorded. The returned function flushes the spans still buffered.
+func SetupTracing(endpoint string) (func(context.Context) error, error){
+	if endpoint == ""{
+		return func(context.Context) error{ return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil{
+		return nil, err
+	}
+	provider, err := newTracerProvider(sdktrace.WithBatcher(exporter))
+	if err != nil{
+		return nil, err
+	}
+	return provider.Shutdown, nil
+}
+
+// UseSpanProcessor hands every span to processor, tests pass one that keeps the spans in memory
+func UseSpanProcessor(processor sdktrace.SpanProcessor) error{
+	_, err := newTracerProvider(sdktrace.WithSpanProcessor(processor))
+	return err
+}
+
+// the sampler can be set with OTEL_TRACES_SAMPLER and the service name with OTEL_SERVICE_NAME
+func newTracerProvider(exporter sdktrace.TracerProviderOption) (*sdktrace.TracerProvider, error){
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil{
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(exporter, sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider, nil
+}
+
+// traces the commands sent to MongoDB, but only those run for a traced operation, the
+// store passes the context of the message it stores
+func mongoTraceMonitor() *event.CommandMonitor{
+	tracer := otel.Tracer("chat-app/config")
+	var spans sync.Map
+
+	finish := func(requestID int64, err string){
+		value, ok := spans.LoadAndDelete(requestID)
+		if !ok{
+			return
+		}
+		span := value.(trace.Span)
+		if err != ""{
+			span.SetStatus(codes.Error, err)
+		}
+		span.End()
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, started *event.CommandStartedEvent){
+			if !trace.SpanContextFromContext(ctx).IsValid(){
+				return
+			}
+
+			attributes := []attribute.KeyValue{
+				attribute.String("db.system", "mongodb"),
+				attribute.String("db.namespace", started.DatabaseName),
+				attribute.String("db.operation.name", started.CommandName),
+			}
+			// most commands name their collection first
+			if first, err := started.Command.IndexErr(0); err == nil{
+				if collection, ok := first.Value().StringValueOK(); ok{
+					attributes = append(attributes, attribute.String("db.collection.name", collection))
+				}
+			}
+
+			_, span := tracer.Start(ctx, "mongodb " + started.CommandName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+			spans.Store(started.RequestID, span)
+		},
+		Succeeded: func(_ context.Context, succeeded *event.CommandSucceededEvent){
+			finish(succeeded.RequestID, "")
+		},
+		Failed: func(_ context.Context, failed *event.CommandFailedEvent){
+			finish(failed.RequestID, failed.Failure)
+		},
+	}
+}
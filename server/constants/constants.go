@@ -13,9 +13,63 @@ const(
 	YouAreNotLoggedIN              = "You are not logged in."
 	YouAreLoggedIN                 = "You are logged in."
 	UserIsNotRegisteredWithUs      = "This account does not exist in our system."
+	AccessTokenIsInvalid           = "Your access token is invalid or has expired."
+	YouAreNotAllowed               = "You are not allowed to access this resource."
+	RefreshTokenIsInvalid          = "Your refresh token is invalid or has expired."
+	UserLogoutCompleted            = "You are logged out."
+	UserLogoutAllCompleted         = "You are logged out from all devices."
+	SessionRefreshCompleted        = "Your session is refreshed."
+	RoomNameCantBeEmpty            = "Room name can't be empty."
+	RoomDoesNotExist               = "This room does not exist."
+	RoomCreated                    = "Room created."
+	AttachmentUploaded             = "File uploaded."
+	RoomMemberInvited              = "User added to the room."
+	RoomLeft                       = "You left the room."
+	YouAreNotARoomMember           = "You are not a member of this room."
+	YouAreNotARoomOwner            = "Only the room owners can do this."
+	MessageDoesNotExist            = "This message does not exist."
+	ConversationDoesNotExist       = "This conversation does not exist."
+	CursorIsInvalid                = "The cursor is invalid."
+	CursorsAreExclusive            = "Use either before or after, not both."
+	LimitIsInvalid                 = "Limit must be a number from 1 to 100."
+	SearchTextIsInvalid            = "q must be 1 to 200 characters."
+	SearchDateIsInvalid            = "since and until must be RFC 3339 dates."
+	AttachmentIsMissing            = "Upload the file in the file field of a multipart form."
+	AttachmentIsTooLarge           = "This file is larger than the upload limit."
+	AttachmentDoesNotExist         = "This attachment does not exist."
+	AttachmentCantBeUsed           = "An attachment does not exist or was sent with another message."
+	TooManyAttachments             = "A message can have at most 10 attachments."
+	DownloadLinkIsInvalid          = "This download link is invalid or has expired."
+	EmojiIsInvalid                 = "emoji must be a single emoji."
+	TooManyReactions               = "You can't add more reactions to this message."
+	ThreadNeedsParent              = "A thread reply needs a parentId."
+	ParentIsInAnotherConversation  = "The parent message is in another conversation."
+	SocketEventIsMalformed         = "The event must be a JSON envelope with a type."
+	ProtocolVersionIsNotSupported  = "This protocol version is not supported."
+	SocketEventIsUnknown           = "This event type does not exist."
+	PayloadIsMissing               = "This event needs a payload."
+	MessageCantBeEmpty             = "Message can't be empty."
+	MessageNeedsTextOrAttachments  = "A message needs text or attachments."
+	MessageIsDuplicate             = "This message was sent before."
+	MessageIDCantBeEmpty           = "messageId can't be empty."
+	YouAreNotTheSender             = "Only the sender can change this message."
+	MessageEditWindowHasPassed     = "This message is too old to be changed."
+	MessageIsDeleted               = "This message was deleted."
+	MessageCantBeChanged           = "This message can't be changed anymore."
+	MessageEdited                  = "Message edited."
+	MessageDeleted                 = "Message deleted."
+	ClientMessageIDIsInvalid       = "clientMessageId can't be empty or longer than 64 characters."
+	TargetIsInvalid                = "Set either toUserID or roomId."
+	PresenceStatusIsInvalid        = "Status must be online or away."
+	LastSeqIsInvalid               = "lastSeq can't be negative."
+	ReadRequestIsInvalid           = "Set fromUserID and upToMessageId, or roomId."
 
 	// Application response messages
 	SuccessfulResponse   = "Request completed successfully"
 	ServerFailedResponse = "Request failed to complete, we are working on it"
 	APIWelcomeMessage = "Welcome to gopher chat"
+	ServerIsHealthy      = "The server is running."
+	ServerIsReady        = "The server is ready."
+	ServerIsNotReady     = "The server is not ready."
+	ServerIsShuttingDown = "The server is shutting down, try again shortly."
 )
\ No newline at end of file
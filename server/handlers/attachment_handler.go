@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"chat-app/constants"
+	"chat-app/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	maxAttachmentsPerMessage = 10
+	// room for the multipart boundaries and headers around the file
+	multipartOverhead = 64 << 10
+	// longest file name kept, in characters
+	maxAttachmentNameLength = 255
+
+	thumbnailVariant = "thumbnail"
+)
+
+// the original is stored under the attachment id, its thumbnail next to it
+func attachmentBlobKey(attachmentID, variant string) string{
+	if variant == thumbnailVariant{
+		return attachmentID + ".thumbnail"
+	}
+	return attachmentID
+}
+
+// keeps the base name of the uploaded file without control characters
+func attachmentName(filename string) string{
+	name := strings.Map(func(r rune) rune{
+		if unicode.IsControl(r){
+			return -1
+		}
+		return r
+	}, filepath.Base(strings.ReplaceAll(filename, `\`, "/")))
+
+	if runes := []rune(name); len(runes) > maxAttachmentNameLength{
+		name = string(runes[:maxAttachmentNameLength])
+	}
+	if name == "" || name == "." || name == "/"{
+		return "file"
+	}
+	return name
+}
+
+// claims the attachments of a message for its sender, the message keeps a copy without the bookkeeping
+func claimAttachments(store AttachmentStore, fromUserID string, message *SendMessageRequest) ([]Attachment, *SocketError){
+	if len(message.AttachmentIDs) == 0{
+		return nil, nil
+	}
+
+	claimed, err := store.ClaimAttachments(message.AttachmentIDs, fromUserID, message.ClientMessageID)
+	if err != nil{
+		if err.Error() == constants.AttachmentCantBeUsed{
+			return nil, newSocketError(ErrCodeInvalidPayload, err.Error())
+		}
+		return nil, newSocketError(ErrCodeInternal, constants.ServerFailedResponse)
+	}
+
+	for i := range claimed{
+		claimed[i].OwnerID = ""
+		claimed[i].ClaimedBy = ""
+		claimed[i].MessageID = ""
+	}
+	return claimed, nil
+}
+
+var errAttachmentIsTooLarge = errors.New("attachment is too large")
+
+// counts the bytes of an upload and fails it once there are more than limit
+type limitedUpload struct{
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (upload *limitedUpload) Read(p []byte) (int, error){
+	n, err := upload.reader.Read(p)
+	upload.read += int64(n)
+	if upload.read > upload.limit{
+		return n, errAttachmentIsTooLarge
+	}
+	return n, err
+}
+
+type thumbnailResult struct{
+	thumbnail     []byte
+	width, height int
+	err           error
+}
+
+// streams the upload into the blob store, never holding more of it than the store buffers. The content
+// type is sniffed from the first bytes and images are decoded for a thumbnail while they're stored.
+func storeAttachmentBlobs(ctx context.Context, blobs BlobStore, file io.Reader, maxSize int64, attachment *Attachment) error{
+	upload := &limitedUpload{reader: file, limit: maxSize}
+	body := bufio.NewReaderSize(upload, 512)
+	head, err := body.Peek(512)
+	if err != nil && err != io.EOF{
+		return err
+	}
+	attachment.ContentType = http.DetectContentType(head)
+	key := attachmentBlobKey(attachment.ID, "")
+
+	if !thumbnailContentTypes[attachment.ContentType]{
+		if err := blobs.Put(ctx, key, attachment.ContentType, body, -1); err != nil{
+			return err
+		}
+		attachment.Size = upload.read
+		return nil
+	}
+
+	// the decoder reads a copy of what's stored, and the rest once it's done so the upload goes on
+	decoded, copied := io.Pipe()
+	made := make(chan thumbnailResult, 1)
+	go func(){
+		var result thumbnailResult
+		result.thumbnail, result.width, result.height, result.err = makeThumbnail(decoded)
+		io.Copy(io.Discard, decoded)
+		made <- result
+	}()
+
+	err = blobs.Put(ctx, key, attachment.ContentType, io.TeeReader(body, copied), -1)
+	copied.CloseWithError(err)
+	result := <-made
+	if err != nil{
+		return err
+	}
+	attachment.Size = upload.read
+
+	// a file that only looks like an image is still accepted, just without a thumbnail
+	attachment.Width, attachment.Height = result.width, result.height
+	if result.err != nil{
+		slog.Info("No thumbnail for attachment", "attachmentId", attachment.ID, "error", result.err)
+		return nil
+	}
+
+	err = blobs.Put(ctx, attachmentBlobKey(attachment.ID, thumbnailVariant), "image/jpeg", bytes.NewReader(result.thumbnail), int64(len(result.thumbnail)))
+	if err != nil{
+		return err
+	}
+	attachment.HasThumbnail = true
+	return nil
+}
+
+func deleteAttachmentBlobs(ctx context.Context, blobs BlobStore, attachmentID string){
+	for _, variant := range []string{"", thumbnailVariant}{
+		if err := blobs.Delete(ctx, attachmentBlobKey(attachmentID, variant)); err != nil{
+			slog.Error("Failed to delete the blob of attachment", "attachmentId", attachmentID, "variant", variant, "error", err)
+		}
+	}
+}
+
+// the owner can see an attachment that wasn't sent yet, afterwards everyone who can see its message
+func canAccessAttachment(store Store, attachment Attachment, userID string) bool{
+	if attachment.MessageID == ""{
+		return attachment.OwnerID == userID
+	}
+
+	message := store.GetMessageByID(attachment.MessageID)
+	if message.ID == "" || message.Deleted{
+		return false
+	}
+	return isParticipant(store, message, userID)
+}
+
+func downloadURL(attachmentID, variant string, expiresAt time.Time) (string, error){
+	signature, err := utils.SignDownload(attachmentID, variant, expiresAt)
+	if err != nil{
+		return "", err
+	}
+
+	url := "/attachments/" + attachmentID + "/download?expires=" + strconv.FormatInt(expiresAt.Unix(), 10) + "&signature=" + signature
+	if variant != ""{
+		url += "&variant=" + variant
+	}
+	return url, nil
+}
+
+func UploadAttachment(store Store, blobs BlobStore) gin.HandlerFunc{
+	return func(c *gin.Context){
+		maxSize := utils.MaxAttachmentSize()
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+multipartOverhead)
+
+		tooLarge := func(){
+			c.JSON(http.StatusRequestEntityTooLarge, APIResponse{
+				Code:     http.StatusRequestEntityTooLarge,
+				Status:   http.StatusText(http.StatusRequestEntityTooLarge),
+				Message:  constants.AttachmentIsTooLarge,
+				Response: nil,
+			})
+		}
+
+		if c.Request.ContentLength > maxSize+multipartOverhead{
+			tooLarge()
+			return
+		}
+
+		// the parts are read straight from the body rather than spooled to a temporary file first
+		reader, err := c.Request.MultipartReader()
+		var file *multipart.Part
+		for err == nil{
+			if file, err = reader.NextPart(); err == nil && file.FormName() == "file" && file.FileName() != ""{
+				break
+			}
+		}
+		if err != nil{
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr){
+				tooLarge()
+				return
+			}
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code:     http.StatusBadRequest,
+				Status:   http.StatusText(http.StatusBadRequest),
+				Message:  constants.AttachmentIsMissing,
+				Response: nil,
+			})
+			return
+		}
+		defer file.Close()
+
+		attachment := Attachment{
+			ID: primitive.NewObjectID().Hex(),
+			OwnerID: AuthUserID(c),
+			Name: attachmentName(file.FileName()),
+			CreatedAt: time.Now(),
+		}
+
+		err = storeAttachmentBlobs(c.Request.Context(), blobs, file, maxSize, &attachment)
+		if err == nil{
+			err = store.CreateAttachment(attachment)
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(err, errAttachmentIsTooLarge) || errors.As(err, &maxBytesErr){
+			deleteAttachmentBlobs(context.Background(), blobs, attachment.ID)
+			tooLarge()
+			return
+		}
+		if err != nil{
+			RequestLogger(c).Error("Failed to store attachment", "attachmentId", attachment.ID, "error", err)
+			deleteAttachmentBlobs(context.Background(), blobs, attachment.ID)
+
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code:     http.StatusInternalServerError,
+				Status:   http.StatusText(http.StatusInternalServerError),
+				Message:  constants.ServerFailedResponse,
+				Response: nil,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.AttachmentUploaded,
+			Response: attachment,
+		})
+	}
+}
+
+// GetAttachmentURLs signs download URLs for whoever can see the attachment, to anyone else it doesn't exist
+func GetAttachmentURLs(store Store) gin.HandlerFunc{
+	return func(c *gin.Context){
+		attachment := store.GetAttachment(c.Param("attachmentID"))
+		if attachment.ID == "" || !canAccessAttachment(store, attachment, AuthUserID(c)){
+			c.JSON(http.StatusNotFound, APIResponse{
+				Code:     http.StatusNotFound,
+				Status:   http.StatusText(http.StatusNotFound),
+				Message:  constants.AttachmentDoesNotExist,
+				Response: nil,
+			})
+			return
+		}
+
+		urls := AttachmentURLs{ExpiresAt: time.Now().Add(utils.DownloadURLTTL()).Truncate(time.Second)}
+		url, err := downloadURL(attachment.ID, "", urls.ExpiresAt)
+		if err == nil && attachment.HasThumbnail{
+			urls.ThumbnailURL, err = downloadURL(attachment.ID, thumbnailVariant, urls.ExpiresAt)
+		}
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code:     http.StatusInternalServerError,
+				Status:   http.StatusText(http.StatusInternalServerError),
+				Message:  constants.ServerFailedResponse,
+				Response: nil,
+			})
+			return
+		}
+		urls.URL = url
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: urls,
+		})
+	}
+}
+
+// DownloadAttachment serves the file of a signed URL, it needs no access token so it works in img tags
+func DownloadAttachment(store Store, blobs BlobStore) gin.HandlerFunc{
+	return func(c *gin.Context){
+		attachmentID, variant := c.Param("attachmentID"), c.Query("variant")
+
+		notFound := func(message string){
+			c.JSON(http.StatusNotFound, APIResponse{
+				Code:     http.StatusNotFound,
+				Status:   http.StatusText(http.StatusNotFound),
+				Message:  message,
+				Response: nil,
+			})
+		}
+
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		if err != nil || !utils.VerifyDownload(attachmentID, variant, expires, c.Query("signature")){
+			notFound(constants.DownloadLinkIsInvalid)
+			return
+		}
+
+		// the message may have been deleted since the URL was signed
+		attachment := store.GetAttachment(attachmentID)
+		if attachment.ID == "" || (attachment.MessageID != "" && store.GetMessageByID(attachment.MessageID).Deleted){
+			notFound(constants.AttachmentDoesNotExist)
+			return
+		}
+
+		contentType, size := attachment.ContentType, attachment.Size
+		if variant == thumbnailVariant{
+			contentType, size = "image/jpeg", -1
+		}
+
+		blob, err := blobs.Get(c.Request.Context(), attachmentBlobKey(attachment.ID, variant))
+		if errors.Is(err, ErrBlobNotFound){
+			notFound(constants.AttachmentDoesNotExist)
+			return
+		}
+		if err != nil{
+			RequestLogger(c).Error("Failed to read the blob of attachment", "attachmentId", attachment.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code:     http.StatusInternalServerError,
+				Status:   http.StatusText(http.StatusInternalServerError),
+				Message:  constants.ServerFailedResponse,
+				Response: nil,
+			})
+			return
+		}
+		defer blob.Close()
+
+		// only images are shown inline, anything else is downloaded and never sniffed by the browser
+		disposition := "attachment"
+		if strings.HasPrefix(contentType, "image/"){
+			disposition = "inline"
+		}
+
+		c.DataFromReader(http.StatusOK, size, contentType, blob, map[string]string{
+			"Content-Disposition": mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}),
+			"X-Content-Type-Options": "nosniff",
+			"Cache-Control": "private, max-age=" + strconv.FormatInt(max(0, expires-time.Now().Unix()), 10),
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"chat-app/config"
+	"chat-app/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// a multipart form with one file, its length is unknown like a chunked upload when chunked is set
+func uploadRequest(t *testing.T, field, filename string, content []byte, chunked bool) *http.Request{
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile(field, filename)
+	if err != nil{
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	part.Write(content)
+	form.Close()
+
+	var reader io.Reader = &body
+	if chunked{
+		reader = io.MultiReader(&body)
+	}
+	request := httptest.NewRequest(http.MethodPost, "/attachments", reader)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	return request
+}
+
+func upload(t *testing.T, store Store, blobs BlobStore, request *http.Request) (*httptest.ResponseRecorder, Attachment){
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/attachments", func(c *gin.Context){ c.Set(authUserIDKey, "owner") }, UploadAttachment(store, blobs))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	var response struct{
+		Response Attachment `json:"response"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder, response.Response
+}
+
+func newTestBlobStore(t *testing.T) (*LocalBlobStore, string){
+	t.Helper()
+	dir := t.TempDir()
+	blobs, err := NewLocalBlobStore(dir)
+	if err != nil{
+		t.Fatalf("NewLocalBlobStore: %v", err)
+	}
+	return blobs, dir
+}
+
+func readBlob(t *testing.T, blobs BlobStore, key string) []byte{
+	t.Helper()
+	blob, err := blobs.Get(context.Background(), key)
+	if err != nil{
+		t.Fatalf("Get(%s): %v", key, err)
+	}
+	defer blob.Close()
+	content, _ := io.ReadAll(blob)
+	return content
+}
+
+func TestUploadAttachmentStoresTheFileAndAThumbnail(t *testing.T){
+	store := NewMemoryStore()
+	blobs, _ := newTestBlobStore(t)
+	content := encodePNG(t, image.NewNRGBA(image.Rect(0, 0, 640, 480)))
+
+	recorder, attachment := upload(t, store, blobs, uploadRequest(t, "file", "photo.png", content, true))
+	if recorder.Code != http.StatusOK{
+		t.Fatalf("got %d %s", recorder.Code, recorder.Body)
+	}
+	if attachment.Name != "photo.png" || attachment.ContentType != "image/png" || attachment.Size != int64(len(content)) ||
+		attachment.Width != 640 || attachment.Height != 480 || !attachment.HasThumbnail{
+		t.Errorf("got %+v", attachment)
+	}
+	if stored := store.GetAttachment(attachment.ID); stored.OwnerID != "owner" || stored.Size != attachment.Size{
+		t.Errorf("stored %+v", stored)
+	}
+
+	if !bytes.Equal(readBlob(t, blobs, attachmentBlobKey(attachment.ID, "")), content){
+		t.Errorf("the stored file differs from the upload")
+	}
+	if _, _, err := image.Decode(bytes.NewReader(readBlob(t, blobs, attachmentBlobKey(attachment.ID, thumbnailVariant)))); err != nil{
+		t.Errorf("the thumbnail isn't an image: %v", err)
+	}
+}
+
+func TestUploadAttachmentRejectsLargeFiles(t *testing.T){
+	settings := config.Default()
+	settings.Attachments.MaxSize = 1000
+	utils.Configure(settings)
+	t.Cleanup(func(){ utils.Configure(config.Default()) })
+
+	// within the room left for the multipart headers, only the size of the file itself stops it
+	for name, chunked := range map[string]bool{"with a length": false, "chunked": true}{
+		store := NewMemoryStore()
+		blobs, dir := newTestBlobStore(t)
+
+		recorder, _ := upload(t, store, blobs, uploadRequest(t, "file", "large.bin", make([]byte, 1001), chunked))
+		if recorder.Code != http.StatusRequestEntityTooLarge{
+			t.Errorf("%s: got %d %s", name, recorder.Code, recorder.Body)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0{
+			t.Errorf("%s: %d files were left behind", name, len(entries))
+		}
+	}
+}
+
+func TestUploadAttachmentNeedsAFile(t *testing.T){
+	blobs, _ := newTestBlobStore(t)
+	recorder, _ := upload(t, NewMemoryStore(), blobs, uploadRequest(t, "other", "note.txt", []byte("hi"), false))
+	if recorder.Code != http.StatusBadRequest{
+		t.Errorf("got %d %s", recorder.Code, recorder.Body)
+	}
+}
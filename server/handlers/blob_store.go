@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Get for a key that was never stored or was deleted
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps the uploaded files by key, the handlers only use keys made by attachmentBlobKey
+type BlobStore interface {
+	// Put streams size bytes of body into the blob at key, replacing it if it exists. With a size
+	// of -1 the whole body is stored, an error reading it fails the Put.
+	Put(ctx context.Context, key, contentType string, body io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds when the blob doesn't exist
+	Delete(ctx context.Context, key string) error
+}
+
+// keys never contain a path separator, so they can't leave the store's directory or bucket
+var blobKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var errBlobKeyIsInvalid = errors.New("blob key is invalid")
+
+// LocalBlobStore keeps every blob as a file in one directory
+type LocalBlobStore struct{
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error){
+	if err := os.MkdirAll(dir, 0o750); err != nil{
+		return nil, err
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+func (blobs *LocalBlobStore) path(key string) (string, error){
+	if !blobKeyPattern.MatchString(key){
+		return "", errBlobKeyIsInvalid
+	}
+	return filepath.Join(blobs.dir, key), nil
+}
+
+// writes to a temporary file first so a failed upload never leaves half a blob behind
+func (blobs *LocalBlobStore) Put(ctx context.Context, key, contentType string, body io.Reader, size int64) error{
+	path, err := blobs.path(key)
+	if err != nil{
+		return err
+	}
+
+	file, err := os.CreateTemp(blobs.dir, ".upload-*")
+	if err != nil{
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if size >= 0{
+		body = io.LimitReader(body, size)
+	}
+	written, err := io.Copy(file, body)
+	if closeErr := file.Close(); err == nil{
+		err = closeErr
+	}
+	if err != nil{
+		return err
+	}
+	if size >= 0 && written != size{
+		return io.ErrUnexpectedEOF
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (blobs *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error){
+	path, err := blobs.path(key)
+	if err != nil{
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist){
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (blobs *LocalBlobStore) Delete(ctx context.Context, key string) error{
+	path, err := blobs.path(key)
+	if err != nil{
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist){
+		return err
+	}
+	return nil
+}
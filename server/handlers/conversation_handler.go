@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"unicode/utf8"
+
+	"chat-app/constants"
+
+	"github.com/gin-gonic/gin"
+)
+
+// longest text kept in a conversation's last message preview, in characters
+const previewLength = 100
+
+func directConversationID(peerID string) string{
+	return "user:" + peerID
+}
+
+func roomConversationID(roomID string) string{
+	return "room:" + roomID
+}
+
+// the conversation of userID that the message belongs to, and the peer of a direct one
+func conversationOf(message Message, userID string) (string, string){
+	if message.RoomID != ""{
+		return roomConversationID(message.RoomID), ""
+	}
+
+	peerID := message.ToUserID
+	if userID == message.ToUserID{
+		peerID = message.FromUserID
+	}
+	return directConversationID(peerID), peerID
+}
+
+func newMessagePreview(message Message) *MessagePreview{
+	text := message.Message
+	if utf8.RuneCountInString(text) > previewLength{
+		text = string([]rune(text)[:previewLength])
+	}
+
+	return &MessagePreview{
+		ID: message.ID,
+		FromUserID: message.FromUserID,
+		Message: text,
+		CreatedAt: message.CreatedAt,
+		Edited: message.Edited,
+		Deleted: message.Deleted,
+		AttachmentCount: len(message.Attachments),
+	}
+}
+
+// ConversationsQueryHandler returns the user's conversations with the peer or room name filled in,
+// the peers and rooms of the whole list are loaded with one query each
+func ConversationsQueryHandler(store Store, userID string) []Conversation{
+	conversations := store.GetConversations(userID)
+
+	var peerIDs, roomIDs []string
+	for _, conversation := range conversations{
+		if conversation.RoomID != ""{
+			roomIDs = append(roomIDs, conversation.RoomID)
+		}else{
+			peerIDs = append(peerIDs, conversation.PeerID)
+		}
+	}
+	peers := store.GetUsersByIDs(peerIDs)
+	rooms := store.GetRoomsByIDs(roomIDs)
+
+	for i := range conversations{
+		conversation := &conversations[i]
+		if conversation.RoomID != ""{
+			conversation.RoomName = rooms[conversation.RoomID].Name
+			continue
+		}
+
+		peer := peers[conversation.PeerID]
+		conversation.Peer = &UserResponse{
+			Username: peer.Username,
+			UserID: conversation.PeerID,
+			Online: peer.Online,
+			Presence: peer.Presence,
+			LastSeen: peer.LastSeen,
+		}
+	}
+	return conversations
+}
+
+func GetConversations(store Store) gin.HandlerFunc{
+	return func(c *gin.Context){
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: ConversationsQueryHandler(store, AuthUserID(c)),
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetConversationsNamesPeersAndRooms(t *testing.T){
+	api := newTestAPI(t)
+	alice, bob := api.register("alice"), api.register("bob")
+	room, err := api.store.CreateRoom("the room", alice.UserID, []string{bob.UserID})
+	if err != nil{
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	storeTestMessage(t, api.store, MessagePayload{FromUserID: bob.UserID, ToUserID: alice.UserID, Message: "direct"}, alice.UserID, bob.UserID)
+	storeTestMessage(t, api.store, MessagePayload{FromUserID: bob.UserID, RoomID: room.ID, Message: "room"}, alice.UserID, bob.UserID)
+
+	status, response := call[[]Conversation](api, http.MethodGet, "/conversations", alice.AccessToken, nil)
+	if status != http.StatusOK || len(response.Response) != 2{
+		t.Fatalf("got %d %+v", status, response)
+	}
+	for _, conversation := range response.Response{
+		switch conversation.ID{
+		case directConversationID(bob.UserID):
+			if conversation.Peer == nil || conversation.Peer.Username != "bob"{
+				t.Errorf("the direct conversation's peer: got %+v", conversation.Peer)
+			}
+		case roomConversationID(room.ID):
+			if conversation.RoomName != "the room"{
+				t.Errorf("the room conversation's name: got %q", conversation.RoomName)
+			}
+		default:
+			t.Errorf("unexpected conversation %s", conversation.ID)
+		}
+	}
+}
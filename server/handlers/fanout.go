@@ -0,0 +1,81 @@
+package handlers
+
+import "sync"
+
+// what a Delivery is addressed to
+const (
+	deliverToUser       = "user"
+	deliverToEveryone   = "everyone"
+	deliverRevoke       = "revoke"
+	// only ever delivered by the instance of the connection, it's never published
+	deliverToConnection = "connection"
+)
+
+// Delivery is a socket event on its way to the connections of every server instance
+type Delivery struct {
+	// the instance that published it, it has already delivered to its own connections
+	Origin string `json:"origin"`
+	Kind   string `json:"kind"`
+
+	// deliverToUser and deliverRevoke go to the connections of one user
+	UserID string `json:"userID,omitempty"`
+	// deliverToUser skips this connection, the sender's own device
+	ExceptClientID string `json:"exceptClientID,omitempty"`
+	// deliverToConnection only goes to this connection of the user
+	ClientID string `json:"clientID,omitempty"`
+	// deliverToEveryone skips every connection of this user
+	ExceptUserID string `json:"exceptUserID,omitempty"`
+	// deliverRevoke closes the sockets of this session, or of every session when empty
+	SessionID string `json:"sessionID,omitempty"`
+
+	Event SocketEvent `json:"event"`
+	// W3C trace context of the event, the other instances continue its trace
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// FanOut carries deliveries between the Lobbies of all server instances
+type FanOut interface {
+	// Publish hands the delivery to every subscribed Lobby
+	Publish(delivery Delivery) error
+	// Subscribe calls handle for every delivery published by any instance, including this one
+	Subscribe(handle func(Delivery)) error
+	Close() error
+}
+
+// InProcessFanOut connects the Lobbies running in one process, with a single Lobby
+// there is nobody to fan out to. Payloads keep their Go types since nothing is serialized.
+type InProcessFanOut struct{
+	mu       sync.RWMutex
+	handlers []func(Delivery)
+}
+
+func NewInProcessFanOut() *InProcessFanOut{
+	return &InProcessFanOut{}
+}
+
+func (fanOut *InProcessFanOut) Publish(delivery Delivery) error{
+	fanOut.mu.RLock()
+	handlers := fanOut.handlers
+	fanOut.mu.RUnlock()
+
+	for _, handle := range handlers{
+		handle(delivery)
+	}
+	return nil
+}
+
+func (fanOut *InProcessFanOut) Subscribe(handle func(Delivery)) error{
+	fanOut.mu.Lock()
+	defer fanOut.mu.Unlock()
+
+	fanOut.handlers = append(fanOut.handlers, handle)
+	return nil
+}
+
+func (fanOut *InProcessFanOut) Close() error{
+	fanOut.mu.Lock()
+	defer fanOut.mu.Unlock()
+
+	fanOut.handlers = nil
+	return nil
+}
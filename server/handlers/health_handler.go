@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"chat-app/constants"
+
+	"github.com/gin-gonic/gin"
+)
+
+// how long a readiness check may take before it counts as failed
+const readinessTimeout = 2 * time.Second
+
+// Healthz answers as long as the process serves requests
+func Healthz() gin.HandlerFunc{
+	return func(c *gin.Context){
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.ServerIsHealthy,
+			Response: nil,
+		})
+	}
+}
+
+// Readyz tells the load balancer whether to send traffic here, it needs the store and a
+// Lobby that isn't stuck or shutting down
+func Readyz(store Store, lobby *Lobby) gin.HandlerFunc{
+	return func(c *gin.Context){
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+		defer cancel()
+
+		report := ReadinessReport{Store: "ok", Lobby: "ok"}
+		if err := store.Ping(ctx); err != nil{
+			RequestLogger(c).Warn("The store is unreachable", "error", err)
+			report.Store = "unreachable"
+		}
+		switch{
+		case lobby.ShuttingDown():
+			report.Lobby = "shutting down"
+		case !lobby.Alive(ctx):
+			report.Lobby = "not responding"
+		}
+
+		if report != (ReadinessReport{Store: "ok", Lobby: "ok"}){
+			c.JSON(http.StatusServiceUnavailable, APIResponse{
+				Code:     http.StatusServiceUnavailable,
+				Status:   http.StatusText(http.StatusServiceUnavailable),
+				Message:  constants.ServerIsNotReady,
+				Response: report,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.ServerIsReady,
+			Response: report,
+		})
+	}
+}
@@ -1,29 +1,302 @@
 package handlers
 
-// Lobby maintains list of active clients and broadcasts messages to client
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Lobby maintains list of active clients and broadcasts messages to client.
+// Only the Run goroutine touches the clients, everybody else goes through the channels.
+// Run never waits for the store, the tracker or the fan-out, presence goes to the presence worker.
 type Lobby struct{
-	// Registered Clients
-	clients map[*Client]bool
-	
+	// Registered Clients, indexed by userID so a delivery only visits the recipient's devices
+	clients map[string]map[*Client]bool
+
 	register chan *Client
 	unregister chan *Client
+
+	// a client switching between online and away
+	presence chan presenceUpdate
+	// presence work for the presence worker, queued by Run without ever blocking on it
+	presenceMu sync.Mutex
+	presenceJobs []presenceJob
+	presenceQueued chan struct{}
+
+	// deliveries for the connections of this instance, from this or another instance
+	emit chan Delivery
+	// direct messages the writePumps wrote to their recipients, for the delivery worker
+	delivered chan deliveryAck
+
+	store Store
+
+	// identifies this server instance on the fan-out
+	instanceID string
+	// carries events to the connections on the other instances
+	fanOut FanOut
+	// presence of every connection in the cluster
+	tracker PresenceTracker
+
+	// asks the Run goroutine to close every connection, it answers with their clients
+	closeAll chan chan []*Client
+	// answers the pings of Alive, a stuck Run goroutine doesn't
+	heartbeat chan chan struct{}
+	// set by Drain or Shutdown, readiness fails and new sockets are refused from then on
+	shuttingDown atomic.Bool
+	// set once Shutdown started closing the sockets
+	closing atomic.Bool
+	// closed once the clients were removed on a shutdown, their writePumps close them
+	stopping chan struct{}
 }
 
-func NewLobby() *Lobby{
-	return &Lobby{
-		clients: make(map[*Client]bool),
+func NewLobby(store Store, fanOut FanOut, tracker PresenceTracker) (*Lobby, error){
+	lobby := &Lobby{
+		clients: make(map[string]map[*Client]bool),
 		register: make(chan *Client),
 		unregister: make(chan *Client),
+		presence: make(chan presenceUpdate),
+		presenceQueued: make(chan struct{}, 1),
+		emit: make(chan Delivery, emitBufferSize),
+		delivered: make(chan deliveryAck, emitBufferSize),
+		store: store,
+		instanceID: primitive.NewObjectID().Hex(),
+		fanOut: fanOut,
+		tracker: tracker,
+		closeAll: make(chan chan []*Client),
+		heartbeat: make(chan chan struct{}),
+		stopping: make(chan struct{}),
+	}
+
+	if err := fanOut.Subscribe(lobby.receive); err != nil{
+		return nil, err
 	}
+	go lobby.presenceWorker()
+	go lobby.deliveryWorker()
+	go lobby.sweepPresence()
+	return lobby, nil
 }
 
 func (lobby *Lobby) Run(){
 	for {
 		select	{
 		case client := <- lobby.register:
+			if lobby.ShuttingDown(){
+				// never registered, its writePump closes it once the Lobby is stopping
+				continue
+			}
 			HandleUserRegisterEvent(lobby, client)
 		case client := <- lobby.unregister:
 			HandleUserDisconnectEvent(lobby, client)
+		case update := <- lobby.presence:
+			HandlePresenceEvent(lobby, update)
+		case delivery := <- lobby.emit:
+			deliverLocally(lobby, delivery)
+		case reply := <- lobby.closeAll:
+			reply <- HandleShutdownEvent(lobby)
+		case reply := <- lobby.heartbeat:
+			close(reply)
+		}
+	}
+}
+
+// Alive reports whether the Run goroutine still answers before ctx is done
+func (lobby *Lobby) Alive(ctx context.Context) bool{
+	reply := make(chan struct{})
+	select {
+	case lobby.heartbeat <- reply:
+	case <-ctx.Done():
+		return false
+	}
+
+	select {
+	case <-reply:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (lobby *Lobby) ShuttingDown() bool{
+	return lobby.shuttingDown.Load()
+}
+
+// Drain starts a shutdown without closing anything yet, /readyz fails and new sockets are
+// refused while the open ones keep working
+func (lobby *Lobby) Drain(){
+	lobby.shuttingDown.Store(true)
+}
+
+// Shutdown refuses new sockets and closes the open ones, each after what's still queued for it,
+// with their users marked offline. It returns once every socket got its close frame, or ctx is done.
+func (lobby *Lobby) Shutdown(ctx context.Context) error{
+	if !lobby.closing.CompareAndSwap(false, true){
+		return nil
+	}
+	lobby.Drain()
+
+	reply := make(chan []*Client, 1)
+	select {
+	case lobby.closeAll <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var clients []*Client
+	select {
+	case clients = <-reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, client := range clients{
+		select {
+		case <-client.done:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
-}
\ No newline at end of file
+
+	// the users of the closed sockets were queued to go offline and the last writes to be
+	// receipted, that's published before the fan-out closes
+	flushed := make(chan struct{})
+	lobby.queuePresence(presenceJob{flushed: flushed})
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	flushed = make(chan struct{})
+	select {
+	case lobby.delivered <- deliveryAck{flushed: flushed}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// the presence of this instance's connections was reset above, the other instances
+	// don't have to wait for it to expire
+	if err := lobby.tracker.Close(); err != nil{
+		return err
+	}
+	return lobby.fanOut.Close()
+}
+
+// clears the presence of the users that were connected to an instance that crashed, the
+// store and everyone else learn that they went offline
+func (lobby *Lobby) sweepPresence(){
+	ticker := time.NewTicker(presenceSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			changes, err := lobby.tracker.Sweep()
+			if err != nil{
+				slog.Error("Failed to sweep the presence of stopped instances", "error", err)
+			}
+			for _, change := range changes{
+				lobby.queuePresence(presenceJob{change: change})
+			}
+		case <-lobby.stopping:
+			return
+		}
+	}
+}
+
+// CloseSessions drops the sockets opened with the given session on every instance,
+// or all of the user's sockets when sessionID is empty
+func (lobby *Lobby) CloseSessions(userID, sessionID string){
+	lobby.publish(Delivery{Kind: deliverRevoke, UserID: userID, SessionID: sessionID})
+}
+
+// queues the delivery for the connections of this instance and publishes it to the others,
+// must not be called from the Run goroutine since it waits for it
+func (lobby *Lobby) publish(delivery Delivery){
+	delivery.Origin = lobby.instanceID
+	lobby.emit <- delivery
+	lobby.publishToOthers(delivery)
+}
+
+// queues the event for one connection of this instance, it's dropped when the connection is gone by then
+func (lobby *Lobby) sendToConnection(client *Client, payload SocketEvent){
+	lobby.emit <- Delivery{Origin: lobby.instanceID, Kind: deliverToConnection, UserID: client.UserID, ClientID: client.ID, Event: payload}
+}
+
+func (lobby *Lobby) publishToOthers(delivery Delivery){
+	if err := lobby.fanOut.Publish(delivery); err != nil{
+		slog.Error("Failed to publish to the other instances", "kind", delivery.Kind, "event", delivery.Event.EventName, "error", err)
+	}
+}
+
+// handles a delivery published by another instance
+func (lobby *Lobby) receive(delivery Delivery){
+	if delivery.Origin == lobby.instanceID{
+		return
+	}
+	lobby.emit <- delivery
+}
+
+func (lobby *Lobby) addClient(client *Client){
+	devices, ok := lobby.clients[client.UserID]
+	if !ok{
+		devices = make(map[*Client]bool)
+		lobby.clients[client.UserID] = devices
+	}
+	devices[client] = true
+}
+
+// returns false when the client wasn't registered
+func (lobby *Lobby) removeClient(client *Client) bool{
+	devices := lobby.clients[client.UserID]
+	if !devices[client]{
+		return false
+	}
+
+	delete(devices, client)
+	if len(devices) == 0{
+		delete(lobby.clients, client.UserID)
+	}
+	return true
+}
+
+func (lobby *Lobby) hasClient(client *Client) bool{
+	return lobby.clients[client.UserID][client]
+}
+
+// runs on the Run goroutine, it owns the clients
+func deliverLocally(lobby *Lobby, delivery Delivery){
+	switch delivery.Kind{
+	case deliverToUser:
+		for client := range lobby.clients[delivery.UserID]{
+			if client.ID != delivery.ExceptClientID{
+				sendToClient(lobby, client, delivery.Event)
+			}
+		}
+	case deliverToEveryone:
+		for userID, devices := range lobby.clients{
+			if delivery.ExceptUserID != "" && userID == delivery.ExceptUserID{
+				continue
+			}
+			for client := range devices{
+				sendToClient(lobby, client, delivery.Event)
+			}
+		}
+	case deliverToConnection:
+		for client := range lobby.clients[delivery.UserID]{
+			if client.ID == delivery.ClientID{
+				sendToClient(lobby, client, delivery.Event)
+			}
+		}
+	case deliverRevoke:
+		HandleSessionRevokeEvent(lobby, delivery.UserID, delivery.SessionID)
+	}
+}
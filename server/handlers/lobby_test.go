@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var benchmarkClientCounts = []int{10_000, 100_000}
+
+// a Lobby with one simulated connection per user, each drained by its own goroutine like
+// a writePump that never blocks on the network. delivered counts the events they received.
+func newBenchmarkLobby(b *testing.B, clients int) (*Lobby, *atomic.Int64){
+	b.Helper()
+
+	lobby, err := NewLobby(NewMemoryStore(), NewInProcessFanOut(), NewMemoryPresenceTracker())
+	if err != nil{
+		b.Fatalf("NewLobby: %v", err)
+	}
+
+	delivered := &atomic.Int64{}
+	for i := 0; i < clients; i++{
+		client := &Client{
+			ID: fmt.Sprintf("client-%d", i),
+			Lobby: lobby,
+			Send: make(chan SocketEvent, sendBufferSize),
+			UserID: fmt.Sprintf("user-%d", i),
+			done: make(chan struct{}),
+		}
+		// added before Run starts, registering through the Lobby would announce every user to all the others
+		lobby.addClient(client)
+
+		go func(){
+			defer close(client.done)
+			for {
+				select {
+				case <-client.Send:
+					delivered.Add(1)
+				case <-lobby.stopping:
+					return
+				}
+			}
+		}()
+	}
+
+	go lobby.Run()
+	b.Cleanup(func(){
+		if err := lobby.Shutdown(context.Background()); err != nil{
+			b.Errorf("Shutdown: %v", err)
+		}
+	})
+	return lobby, delivered
+}
+
+func waitForDeliveries(delivered *atomic.Int64, count int64){
+	for delivered.Load() < count{
+		runtime.Gosched()
+	}
+}
+
+// one direct event per op, each to the next user, until the last one reached its socket
+func BenchmarkEmitToClient(b *testing.B){
+	for _, clients := range benchmarkClientCounts{
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B){
+			lobby, delivered := newBenchmarkLobby(b, clients)
+			payload := SocketEvent{EventName: "message-response", EventPayload: DeliveredMessage{Message: Message{ID: "message"}, Seq: 1}}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++{
+				EmitToClient(lobby, payload, fmt.Sprintf("user-%d", i % clients))
+
+				// a full round over the users waits for the previous one, no buffer can overflow
+				if (i + 1) % clients == 0{
+					waitForDeliveries(delivered, int64(i + 1 - clients))
+				}
+			}
+			waitForDeliveries(delivered, int64(b.N))
+		})
+	}
+}
+
+// one event for every connection per op, like a presence change, until all of them got it
+func BenchmarkBroadcastToEveryone(b *testing.B){
+	for _, clients := range benchmarkClientCounts{
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B){
+			lobby, delivered := newBenchmarkLobby(b, clients)
+			payload := SocketEvent{EventName: "presence", EventPayload: PresenceEvent{UserID: "user", Status: PresenceOnline}}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++{
+				BroadcastToEveryone(lobby, payload)
+				waitForDeliveries(delivered, int64(i + 1) * int64(clients))
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds()) / float64(b.N) / float64(clients), "ns/delivery")
+		})
+	}
+}
+
+// a store whose presence writes wait until release is closed
+type stuckPresenceStore struct{
+	*MemoryStore
+	release chan struct{}
+}
+
+func (store stuckPresenceStore) UpdateUserPresence(userID, presence string) error{
+	<-store.release
+	return store.MemoryStore.UpdateUserPresence(userID, presence)
+}
+
+// registering waits for the store on the presence worker, the Run goroutine keeps delivering
+func TestLobbyDeliversWhileTheStoreIsStuck(t *testing.T){
+	store := stuckPresenceStore{MemoryStore: NewMemoryStore(), release: make(chan struct{})}
+	bobID := createTestUser(t, store, "bob")
+	lobby, err := NewLobby(store, NewInProcessFanOut(), NewMemoryPresenceTracker())
+	if err != nil{
+		t.Fatalf("NewLobby: %v", err)
+	}
+	go lobby.Run()
+
+	bob := &Client{
+		ID: "bob",
+		Lobby: lobby,
+		Send: make(chan SocketEvent, sendBufferSize),
+		UserID: bobID,
+		log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		done: make(chan struct{}),
+	}
+	lobby.register <- bob
+	t.Cleanup(func(){
+		close(store.release)
+		// bob has no writePump to close his done on a shutdown
+		lobby.unregister <- bob
+		lobby.Shutdown(context.Background())
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !lobby.Alive(ctx){
+		t.Fatalf("the Lobby stopped answering while bob's presence was stored")
+	}
+
+	EmitToClient(lobby, SocketEvent{EventName: "message-response"}, bobID)
+	select {
+	case payload := <-bob.Send:
+		if payload.EventName != "message-response"{
+			t.Errorf("bob got %s first, want message-response", payload.EventName)
+		}
+	case <-ctx.Done():
+		t.Fatalf("nothing was delivered while bob's presence was stored")
+	}
+}
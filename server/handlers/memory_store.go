@@ -0,0 +1,820 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"chat-app/constants"
+	"chat-app/utils"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore is a Store that keeps everything in memory, for tests and for
+// running the server without a MongoDB. It is safe for concurrent use.
+type MemoryStore struct{
+	mu sync.RWMutex
+
+	users    map[string]UserDetails
+	messages []Message
+	sessions map[string]Session
+	rooms    map[string]Room
+
+	// position of each message in messages
+	messageIndex map[string]int
+	// every user's inbox, the entry with Seq n sits at index n-1
+	inboxes map[string][]InboxEntry
+	// messageID of every sender and clientMessageId, like the unique index in Mongo
+	clientMessages map[string]string
+	// every user's conversations by conversation id
+	conversations map[string]map[string]Conversation
+	attachments   map[string]Attachment
+}
+
+func NewMemoryStore() *MemoryStore{
+	return &MemoryStore{
+		users: make(map[string]UserDetails),
+		sessions: make(map[string]Session),
+		rooms: make(map[string]Room),
+		messageIndex: make(map[string]int),
+		inboxes: make(map[string][]InboxEntry),
+		clientMessages: make(map[string]string),
+		conversations: make(map[string]map[string]Conversation),
+		attachments: make(map[string]Attachment),
+	}
+}
+
+// the memory store is always there
+func (store *MemoryStore) Ping(context.Context) error{
+	return nil
+}
+
+// ids look like Mongo ObjectIDs so both stores accept the same userIDs
+func newMemoryID() string{
+	return primitive.NewObjectID().Hex()
+}
+
+func (store *MemoryStore) GetUserByUserID(userID string) UserDetails{
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.users[userID]
+}
+
+func (store *MemoryStore) GetUsersByIDs(userIDs []string) map[string]UserDetails{
+	users := make(map[string]UserDetails, len(userIDs))
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, userID := range userIDs{
+		if user, ok := store.users[userID]; ok{
+			users[userID] = user
+		}
+	}
+	return users
+}
+
+func (store *MemoryStore) GetUserByUsername(username string) UserDetails{
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, user := range store.users{
+		if user.Username == username{
+			return user
+		}
+	}
+	return UserDetails{}
+}
+
+func (store *MemoryStore) CreateUser(username, passwordHash string) (string, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, user := range store.users{
+		if user.Username == username{
+			return "", errors.New(constants.UsernameIsNotAvailable)
+		}
+	}
+
+	uid := newMemoryID()
+	store.users[uid] = UserDetails{
+		ID: uid,
+		Username: username,
+		Password: passwordHash,
+		Online: "N",
+		Presence: PresenceOffline,
+		CreatedAt: time.Now(),
+	}
+	return uid, nil
+}
+
+func (store *MemoryStore) UpdateUserPresence(userID, presence string) error{
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	user, ok := store.users[userID]
+	if !ok{
+		return errors.New(constants.UserIsNotRegisteredWithUs)
+	}
+	user.Online = onlineFlag(presence)
+	user.Presence = presence
+	user.LastSeen = time.Now()
+	store.users[userID] = user
+	return nil
+}
+
+func (store *MemoryStore) GetAllOnlineUsers(userID string) []UserResponse{
+	var onlineUsers []UserResponse
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, user := range store.users{
+		if user.Online == "Y" && user.ID != userID{
+			onlineUsers = append(onlineUsers, UserResponse{
+				UserID: user.ID,
+				Username: user.Username,
+				Online: user.Online,
+				Presence: user.Presence,
+				LastSeen: user.LastSeen,
+			})
+		}
+	}
+
+	// map order is random, keep the list stable between calls
+	sort.Slice(onlineUsers, func(i, j int) bool{ return onlineUsers[i].UserID < onlineUsers[j].UserID })
+	return onlineUsers
+}
+
+func (store *MemoryStore) StoreNewMessages(_ context.Context, message MessagePayload, recipientIDs []string) (Message, []InboxEntry, error){
+	var entries []InboxEntry
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	clientKey := message.FromUserID + "/" + message.ClientMessageID
+	if message.ClientMessageID != ""{
+		if messageID, ok := store.clientMessages[clientKey]; ok{
+			return store.messages[store.messageIndex[messageID]].copy(), nil, ErrDuplicateMessage
+		}
+	}
+
+	stored := Message{
+		ID: newMemoryID(),
+		ClientMessageID: message.ClientMessageID,
+		Message: message.Message,
+		FromUserID: message.FromUserID,
+		CreatedAt: time.Now(),
+		Attachments: append([]Attachment(nil), message.Attachments...),
+		ReplyTo: message.ReplyTo,
+		ThreadID: message.ThreadID,
+	}
+	if message.RoomID != ""{
+		stored.RoomID = message.RoomID
+	}else{
+		stored.ToUserID = message.ToUserID
+		stored.Status = MessageStatusSent
+	}
+
+	store.messageIndex[stored.ID] = len(store.messages)
+	store.messages = append(store.messages, stored)
+	if message.ClientMessageID != ""{
+		store.clientMessages[clientKey] = stored.ID
+	}
+
+	if index, ok := store.messageIndex[stored.ThreadID]; ok && stored.ThreadID != ""{
+		parent := &store.messages[index]
+		parent.ReplyCount++
+		parent.LastReplyAt = &stored.CreatedAt
+	}
+
+	for _, userID := range recipientIDs{
+		entry := InboxEntry{
+			UserID: userID,
+			Seq: int64(len(store.inboxes[userID])) + 1,
+			MessageID: stored.ID,
+			CreatedAt: stored.CreatedAt,
+		}
+		store.inboxes[userID] = append(store.inboxes[userID], entry)
+		entries = append(entries, entry)
+
+		// a reply stays in its thread, the conversation keeps its preview and unread count
+		if stored.ThreadID != ""{
+			continue
+		}
+		conversationID, peerID := conversationOf(stored, userID)
+		conversation := store.conversation(userID, conversationID)
+		conversation.PeerID = peerID
+		conversation.RoomID = stored.RoomID
+		conversation.LastMessage = newMessagePreview(stored)
+		conversation.UpdatedAt = stored.CreatedAt
+		if userID != stored.FromUserID{
+			conversation.UnreadCount++
+		}
+		store.conversations[userID][conversationID] = conversation
+	}
+	return stored, entries, nil
+}
+
+func (store *MemoryStore) MarkMessageDelivered(messageID, recipientID string) (Message, bool){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	index, ok := store.messageIndex[messageID]
+	if !ok{
+		return Message{}, false
+	}
+
+	message := &store.messages[index]
+	if message.ToUserID != recipientID || message.Status == MessageStatusDelivered || message.Status == MessageStatusRead{
+		return Message{}, false
+	}
+
+	now := time.Now()
+	message.Status = MessageStatusDelivered
+	message.DeliveredAt = &now
+	return message.copy(), true
+}
+
+func (store *MemoryStore) MarkMessagesRead(readerID, fromUserID, upToMessageID string) (int64, error){
+	var changed int64
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	index, ok := store.messageIndex[upToMessageID]
+	if !ok || store.messages[index].ToUserID != readerID || store.messages[index].FromUserID != fromUserID{
+		return 0, errors.New(constants.MessageDoesNotExist)
+	}
+
+	now := time.Now()
+	for i := 0; i <= index; i++{
+		message := &store.messages[i]
+		if message.ToUserID != readerID || message.FromUserID != fromUserID || message.Status == MessageStatusRead{
+			continue
+		}
+		if message.DeliveredAt == nil{
+			message.DeliveredAt = &now
+		}
+		message.Status = MessageStatusRead
+		message.ReadAt = &now
+		changed++
+	}
+
+	if changed > 0{
+		conversationID := directConversationID(fromUserID)
+		conversation := store.conversation(readerID, conversationID)
+		conversation.UnreadCount -= changed
+		if conversation.UnreadCount < 0{
+			conversation.UnreadCount = 0
+		}
+		store.conversations[readerID][conversationID] = conversation
+	}
+	return changed, nil
+}
+
+func (store *MemoryStore) GetMissedMessages(userID string, afterSeq, limit int64) []DeliveredMessage{
+	var missed []DeliveredMessage
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	inbox := store.inboxes[userID]
+	if afterSeq < 0{
+		afterSeq = 0
+	}
+	for i := afterSeq; i < int64(len(inbox)) && int64(len(missed)) < limit; i++{
+		entry := inbox[i]
+		missed = append(missed, DeliveredMessage{
+			Message: store.messages[store.messageIndex[entry.MessageID]].copy(),
+			Seq: entry.Seq,
+		})
+	}
+	return missed
+}
+
+func (store *MemoryStore) GetMessageByID(messageID string) Message{
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	index, ok := store.messageIndex[messageID]
+	if !ok{
+		return Message{}
+	}
+	return store.messages[index].copy()
+}
+
+// finds a message that fromUserID can still change, the caller holds the lock
+func (store *MemoryStore) changeableMessage(messageID, fromUserID string, changeableAfter time.Time) (*Message, error){
+	index, ok := store.messageIndex[messageID]
+	if !ok{
+		return nil, errors.New(constants.MessageDoesNotExist)
+	}
+
+	message := &store.messages[index]
+	if message.FromUserID != fromUserID || message.Deleted || message.CreatedAt.Before(changeableAfter){
+		return nil, errors.New(constants.MessageCantBeChanged)
+	}
+	return message, nil
+}
+
+func (store *MemoryStore) EditMessage(messageID, fromUserID, text string, changeableAfter time.Time) (Message, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	message, err := store.changeableMessage(messageID, fromUserID, changeableAfter)
+	if err != nil{
+		return Message{}, err
+	}
+
+	now := time.Now()
+	message.History = append(message.copy().History, MessageRevision{Message: message.Message, ReplacedAt: now})
+	message.Message = text
+	message.Edited = true
+	message.EditedAt = &now
+	store.refreshPreviews(*message)
+	return message.copy(), nil
+}
+
+func (store *MemoryStore) DeleteMessage(messageID, fromUserID string, changeableAfter time.Time) (Message, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	message, err := store.changeableMessage(messageID, fromUserID, changeableAfter)
+	if err != nil{
+		return Message{}, err
+	}
+
+	now := time.Now()
+	message.Message = ""
+	message.History = nil
+	message.Attachments = nil
+	message.Reactions = nil
+	message.Deleted = true
+	message.DeletedAt = &now
+	store.refreshPreviews(*message)
+
+	if index, ok := store.messageIndex[message.ThreadID]; ok && message.ThreadID != ""{
+		store.messages[index].ReplyCount--
+	}
+	return message.copy(), nil
+}
+
+func (store *MemoryStore) GetConversationBetweenTwoUsers(toUser, fromUser string, query ConversationQuery) ConversationPage{
+	return store.findConversationPage(func(message Message) bool{
+		return message.ThreadID == "" && ((message.ToUserID == toUser && message.FromUserID == fromUser) ||
+			(message.ToUserID == fromUser && message.FromUserID == toUser))
+	}, query)
+}
+
+func (store *MemoryStore) GetRoomConversation(roomID string, query ConversationQuery) ConversationPage{
+	return store.findConversationPage(func(message Message) bool{
+		return message.RoomID == roomID && message.ThreadID == ""
+	}, query)
+}
+
+func (store *MemoryStore) GetThread(threadID string, query ConversationQuery) ConversationPage{
+	return store.findConversationPage(func(message Message) bool{
+		return message.ThreadID == threadID
+	}, query)
+}
+
+func (store *MemoryStore) GetThreadParticipants(threadID string) []string{
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	index, ok := store.messageIndex[threadID]
+	if !ok{
+		return nil
+	}
+
+	var repliers []string
+	for _, message := range store.messages{
+		if message.ThreadID == threadID{
+			repliers = append(repliers, message.FromUserID)
+		}
+	}
+	return uniqueMembers(store.messages[index].FromUserID, repliers)
+}
+
+func (store *MemoryStore) findConversationPage(matches func(Message) bool, query ConversationQuery) ConversationPage{
+	var fetched []Message
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	// messages are appended in order, so walking backwards gives newest first
+	if query.After != nil{
+		for i := 0; i < len(store.messages) && int64(len(fetched)) <= query.Limit; i++{
+			message := store.messages[i]
+			if matches(message) && query.After.olderThan(message){
+				fetched = append(fetched, message.copy())
+			}
+		}
+	}else{
+		for i := len(store.messages)-1; i >= 0 && int64(len(fetched)) <= query.Limit; i--{
+			message := store.messages[i]
+			if matches(message) && (query.Before == nil || query.Before.newerThan(message)){
+				fetched = append(fetched, message.copy())
+			}
+		}
+	}
+
+	return newConversationPage(fetched, query)
+}
+
+// the in-memory search matches the whole text as a substring, ignoring case
+func (store *MemoryStore) SearchMessages(query SearchQuery) []Message{
+	var found []Message
+
+	rooms := make(map[string]bool, len(query.RoomIDs))
+	for _, roomID := range query.RoomIDs{
+		rooms[roomID] = true
+	}
+
+	belongs := func(message Message) bool{
+		if message.RoomID != ""{
+			return rooms[message.RoomID]
+		}
+		if message.FromUserID != query.UserID && message.ToUserID != query.UserID{
+			return false
+		}
+		_, peerID := conversationOf(message, query.UserID)
+		return query.WithUserID == "" || peerID == query.WithUserID
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for i := len(store.messages)-1; i >= 0 && int64(len(found)) <= query.Limit; i--{
+		message := store.messages[i]
+		switch{
+		case message.Deleted || !belongs(message):
+		case query.FromUserID != "" && message.FromUserID != query.FromUserID:
+		case !query.Since.IsZero() && message.CreatedAt.Before(query.Since):
+		case !query.Until.IsZero() && !message.CreatedAt.Before(query.Until):
+		case query.Before != nil && !query.Before.newerThan(message):
+		case containsText(message.Message, query.Text):
+			found = append(found, message.copy())
+		}
+	}
+	return found
+}
+
+// finds a message that can get reactions, the caller holds the lock
+func (store *MemoryStore) reactableMessage(messageID string) (*Message, error){
+	index, ok := store.messageIndex[messageID]
+	if !ok || store.messages[index].Deleted{
+		return nil, errors.New(constants.MessageDoesNotExist)
+	}
+	return &store.messages[index], nil
+}
+
+func (store *MemoryStore) AddReaction(messageID, userID, emoji string) (Message, bool, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	message, err := store.reactableMessage(messageID)
+	if err != nil{
+		return Message{}, false, err
+	}
+
+	var mine int
+	for _, reaction := range message.Reactions{
+		if reaction.UserID != userID{
+			continue
+		}
+		if reaction.Emoji == emoji{
+			return message.copy(), false, nil
+		}
+		mine++
+	}
+	if mine >= maxReactionsPerUser{
+		return Message{}, false, errors.New(constants.TooManyReactions)
+	}
+
+	message.Reactions = append(message.copy().Reactions, Reaction{UserID: userID, Emoji: emoji})
+	return message.copy(), true, nil
+}
+
+func (store *MemoryStore) RemoveReaction(messageID, userID, emoji string) (Message, bool, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	message, err := store.reactableMessage(messageID)
+	if err != nil{
+		return Message{}, false, err
+	}
+
+	for i, reaction := range message.Reactions{
+		if reaction.UserID == userID && reaction.Emoji == emoji{
+			// a new slice, copies handed out earlier keep their own
+			reactions := append([]Reaction(nil), message.Reactions[:i]...)
+			message.Reactions = append(reactions, message.Reactions[i+1:]...)
+			return message.copy(), true, nil
+		}
+	}
+	return message.copy(), false, nil
+}
+
+func (store *MemoryStore) CreateSession(userID, refreshTokenHash string) (string, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	id := newMemoryID()
+	store.sessions[id] = Session{
+		ID: id,
+		UserID: userID,
+		RefreshTokenHash: refreshTokenHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(utils.RefreshTokenTTL()),
+	}
+	return id, nil
+}
+
+func (store *MemoryStore) GetActiveSessionByID(sessionID string) (Session, error){
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	session, ok := store.sessions[sessionID]
+	if !ok || session.Revoked || !session.ExpiresAt.After(time.Now()){
+		return Session{}, errors.New(constants.AccessTokenIsInvalid)
+	}
+	return session, nil
+}
+
+func (store *MemoryStore) RotateRefreshToken(oldHash, newHash string) (Session, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for id, session := range store.sessions{
+		if session.RefreshTokenHash != oldHash{
+			continue
+		}
+		if session.Revoked || !session.ExpiresAt.After(time.Now()){
+			break
+		}
+		session.RefreshTokenHash = newHash
+		store.sessions[id] = session
+		return session, nil
+	}
+	return Session{}, errors.New(constants.RefreshTokenIsInvalid)
+}
+
+func (store *MemoryStore) RevokeSession(sessionID string) error{
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if session, ok := store.sessions[sessionID]; ok{
+		session.Revoked = true
+		session.RevokedAt = time.Now()
+		store.sessions[sessionID] = session
+	}
+	return nil
+}
+
+func (store *MemoryStore) RevokeAllUserSessions(userID string) error{
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	for id, session := range store.sessions{
+		if session.UserID == userID && !session.Revoked{
+			session.Revoked = true
+			session.RevokedAt = now
+			store.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) CreateRoom(name, ownerID string, memberIDs []string) (Room, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	room := Room{
+		ID: newMemoryID(),
+		Name: name,
+		Owners: []string{ownerID},
+		Members: uniqueMembers(ownerID, memberIDs),
+		CreatedAt: time.Now(),
+	}
+	store.rooms[room.ID] = room
+
+	for _, memberID := range room.Members{
+		store.joinRoomConversation(memberID, room.ID)
+	}
+	return room.copy(), nil
+}
+
+func (store *MemoryStore) GetRoomByID(roomID string) Room{
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	room, ok := store.rooms[roomID]
+	if !ok{
+		return Room{}
+	}
+	return room.copy()
+}
+
+func (store *MemoryStore) GetRoomsByIDs(roomIDs []string) map[string]Room{
+	rooms := make(map[string]Room, len(roomIDs))
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, roomID := range roomIDs{
+		if room, ok := store.rooms[roomID]; ok{
+			rooms[roomID] = room.copy()
+		}
+	}
+	return rooms
+}
+
+func (store *MemoryStore) GetRoomsByUserID(userID string) []Room{
+	var rooms []Room
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, room := range store.rooms{
+		if room.HasMember(userID){
+			rooms = append(rooms, room.copy())
+		}
+	}
+
+	sort.Slice(rooms, func(i, j int) bool{ return rooms[i].CreatedAt.Before(rooms[j].CreatedAt) })
+	return rooms
+}
+
+func (store *MemoryStore) AddRoomMember(roomID, userID string) (Room, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	room, ok := store.rooms[roomID]
+	if !ok{
+		return Room{}, errors.New(constants.RoomDoesNotExist)
+	}
+	if !room.HasMember(userID){
+		room.Members = append(room.copy().Members, userID)
+		store.rooms[roomID] = room
+		store.joinRoomConversation(userID, roomID)
+	}
+	return room.copy(), nil
+}
+
+func (store *MemoryStore) RemoveRoomMember(roomID, userID string) (Room, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	room, ok := store.rooms[roomID]
+	if !ok{
+		return Room{}, errors.New(constants.RoomDoesNotExist)
+	}
+
+	room.Members = removeUserID(room.Members, userID)
+	room.Owners = removeUserID(room.Owners, userID)
+
+	// a room always keeps an owner while it has members
+	if len(room.Owners) == 0 && len(room.Members) > 0{
+		room.Owners = []string{room.Members[0]}
+	}
+
+	store.rooms[roomID] = room
+	if len(room.Members) == 0{
+		delete(store.rooms, roomID)
+	}
+	delete(store.conversations[userID], roomConversationID(roomID))
+	return room.copy(), nil
+}
+
+// returns the user's conversation, or a new one, the caller holds the lock and stores it back
+func (store *MemoryStore) conversation(userID, conversationID string) Conversation{
+	if store.conversations[userID] == nil{
+		store.conversations[userID] = make(map[string]Conversation)
+	}
+
+	conversation, ok := store.conversations[userID][conversationID]
+	if !ok{
+		conversation = Conversation{ID: conversationID, UserID: userID}
+	}
+	return conversation
+}
+
+// a new room member gets the room in their list right away, the caller holds the lock
+func (store *MemoryStore) joinRoomConversation(userID, roomID string){
+	conversationID := roomConversationID(roomID)
+	if _, ok := store.conversations[userID][conversationID]; ok{
+		return
+	}
+
+	conversation := store.conversation(userID, conversationID)
+	conversation.RoomID = roomID
+	conversation.UpdatedAt = time.Now()
+	store.conversations[userID][conversationID] = conversation
+}
+
+// updates the previews that show the message after an edit or delete, the caller holds the lock
+func (store *MemoryStore) refreshPreviews(message Message){
+	for i := range store.messages{
+		if replyTo := store.messages[i].ReplyTo; replyTo != nil && replyTo.ID == message.ID{
+			store.messages[i].ReplyTo = newMessagePreview(message)
+		}
+	}
+
+	for userID, conversations := range store.conversations{
+		for conversationID, conversation := range conversations{
+			if conversation.LastMessage != nil && conversation.LastMessage.ID == message.ID{
+				conversation.LastMessage = newMessagePreview(message)
+				store.conversations[userID][conversationID] = conversation
+			}
+		}
+	}
+}
+
+func (store *MemoryStore) GetConversations(userID string) []Conversation{
+	conversations := []Conversation{}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, conversation := range store.conversations[userID]{
+		if conversation.LastMessage != nil{
+			preview := *conversation.LastMessage
+			conversation.LastMessage = &preview
+		}
+		conversations = append(conversations, conversation)
+	}
+
+	sort.Slice(conversations, func(i, j int) bool{ return conversations[i].UpdatedAt.After(conversations[j].UpdatedAt) })
+	return conversations
+}
+
+func (store *MemoryStore) MarkConversationRead(userID, conversationID string) error{
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	conversation, ok := store.conversations[userID][conversationID]
+	if !ok{
+		return errors.New(constants.ConversationDoesNotExist)
+	}
+	conversation.UnreadCount = 0
+	store.conversations[userID][conversationID] = conversation
+	return nil
+}
+
+func (store *MemoryStore) CreateAttachment(attachment Attachment) error{
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.attachments[attachment.ID] = attachment
+	return nil
+}
+
+func (store *MemoryStore) GetAttachment(attachmentID string) Attachment{
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.attachments[attachmentID]
+}
+
+func (store *MemoryStore) ClaimAttachments(attachmentIDs []string, ownerID, clientMessageID string) ([]Attachment, error){
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	claimed := make([]Attachment, 0, len(attachmentIDs))
+	for _, attachmentID := range attachmentIDs{
+		attachment, ok := store.attachments[attachmentID]
+		if !ok || attachment.OwnerID != ownerID || (attachment.ClaimedBy != "" && attachment.ClaimedBy != clientMessageID){
+			return nil, errors.New(constants.AttachmentCantBeUsed)
+		}
+		claimed = append(claimed, attachment)
+	}
+
+	for i := range claimed{
+		claimed[i].ClaimedBy = clientMessageID
+		store.attachments[claimed[i].ID] = claimed[i]
+	}
+	return claimed, nil
+}
+
+func (store *MemoryStore) LinkAttachments(attachmentIDs []string, messageID string) error{
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, attachmentID := range attachmentIDs{
+		attachment, ok := store.attachments[attachmentID]
+		if !ok{
+			return errors.New(constants.AttachmentDoesNotExist)
+		}
+		attachment.MessageID = messageID
+		store.attachments[attachmentID] = attachment
+	}
+	return nil
+}
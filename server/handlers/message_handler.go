@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"chat-app/constants"
+	"chat-app/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// copy returns the message with its own slices, so callers can't change a stored message
+func (message Message) copy() Message{
+	message.History = append([]MessageRevision(nil), message.History...)
+	message.Attachments = append([]Attachment(nil), message.Attachments...)
+	message.Reactions = append([]Reaction(nil), message.Reactions...)
+	return message
+}
+
+func (request EditMessageRequest) Validate() error{
+	if request.MessageID == ""{
+		return errors.New(constants.MessageIDCantBeEmpty)
+	}
+	if request.Message == ""{
+		return errors.New(constants.MessageCantBeEmpty)
+	}
+	return nil
+}
+
+func (request DeleteMessageRequest) Validate() error{
+	if request.MessageID == ""{
+		return errors.New(constants.MessageIDCantBeEmpty)
+	}
+	return nil
+}
+
+// the oldest creation time of a message that can still be changed
+func changeableAfter() time.Time{
+	return time.Now().Add(-utils.MessageEditWindow())
+}
+
+// tells why userID can't change the message, the store checks again while changing it
+func checkMessageChange(store MessageStore, messageID, userID string) *SocketError{
+	message := store.GetMessageByID(messageID)
+	if message.ID == ""{
+		return newSocketError(ErrCodeNotFound, constants.MessageDoesNotExist)
+	}
+	if message.FromUserID != userID{
+		return newSocketError(ErrCodeForbidden, constants.YouAreNotTheSender)
+	}
+	if message.Deleted{
+		return newSocketError(ErrCodeForbidden, constants.MessageIsDeleted)
+	}
+	if message.CreatedAt.Before(changeableAfter()){
+		return newSocketError(ErrCodeForbidden, constants.MessageEditWindowHasPassed)
+	}
+	return nil
+}
+
+// EditMessageQueryHandler lets the sender replace the text of a message within the edit window
+func EditMessageQueryHandler(store MessageStore, userID string, request EditMessageRequest) (Message, *SocketError){
+	if err := checkMessageChange(store, request.MessageID, userID); err != nil{
+		return Message{}, err
+	}
+
+	message, err := store.EditMessage(request.MessageID, userID, request.Message, changeableAfter())
+	if err != nil{
+		return Message{}, newSocketError(ErrCodeForbidden, err.Error())
+	}
+	return message, nil
+}
+
+// DeleteMessageQueryHandler lets the sender delete a message within the edit window
+func DeleteMessageQueryHandler(store MessageStore, userID, messageID string) (Message, *SocketError){
+	if err := checkMessageChange(store, messageID, userID); err != nil{
+		return Message{}, err
+	}
+
+	message, err := store.DeleteMessage(messageID, userID, changeableAfter())
+	if err != nil{
+		return Message{}, newSocketError(ErrCodeForbidden, err.Error())
+	}
+	return message, nil
+}
+
+// true when userID is one of the two users of a direct message or a member of the message's room
+func isParticipant(store RoomStore, message Message, userID string) bool{
+	if message.RoomID != ""{
+		return store.GetRoomByID(message.RoomID).HasMember(userID)
+	}
+	return userID == message.FromUserID || userID == message.ToUserID
+}
+
+// every participant gets the message with the reactions counted for them
+func announceMessageUpdate(lobby *Lobby, message Message, changedBy *Client){
+	emitToParticipants(lobby, message, changedBy, func(userID string) SocketEvent{
+		return SocketEvent{
+			EventName: "message-updated",
+			EventPayload: withReactionCountsFor(message, userID),
+		}
+	})
+}
+
+// sends the event to every participant of the message's conversation, except the
+// connection that made the change since it gets the answer to its request
+func announceToParticipants(lobby *Lobby, message Message, payload SocketEvent, changedBy *Client){
+	emitToParticipants(lobby, message, changedBy, func(string) SocketEvent{
+		return payload
+	})
+}
+
+func emitToParticipants(lobby *Lobby, message Message, changedBy *Client, payloadFor func(userID string) SocketEvent){
+	participants := []string{message.FromUserID, message.ToUserID}
+	if message.RoomID != ""{
+		participants = lobby.store.GetRoomByID(message.RoomID).Members
+	}
+	// a reply only concerns the ones who got it
+	if message.ThreadID != ""{
+		participants = threadRecipients(lobby.store, message.ThreadID, message.FromUserID, participants)
+	}
+
+	emitToUsers(lobby, participants, changedBy, payloadFor)
+}
+
+// like emitToParticipants, for users that don't come from a message
+func emitToUsers(lobby *Lobby, userIDs []string, changedBy *Client, payloadFor func(userID string) SocketEvent){
+	for _, userID := range userIDs{
+		if changedBy != nil && userID == changedBy.UserID{
+			EmitToOtherDevices(lobby, payloadFor(userID), changedBy)
+		}else{
+			EmitToClient(lobby, payloadFor(userID), userID)
+		}
+	}
+}
+
+func handleMessageEditEvent(client *Client, request SocketEnvelope) *SocketError{
+	var edit EditMessageRequest
+	if err := decodePayload(request, &edit); err != nil{
+		return err
+	}
+
+	message, err := EditMessageQueryHandler(client.Lobby.store, client.UserID, edit)
+	if err != nil{
+		return err
+	}
+
+	sendToClient(client.Lobby, client, SocketEvent{EventName: "message-updated", EventPayload: withReactionCountsFor(message, client.UserID), RequestID: request.RequestID})
+	announceMessageUpdate(client.Lobby, message, client)
+	return nil
+}
+
+func handleMessageDeleteEvent(client *Client, request SocketEnvelope) *SocketError{
+	var remove DeleteMessageRequest
+	if err := decodePayload(request, &remove); err != nil{
+		return err
+	}
+
+	message, err := DeleteMessageQueryHandler(client.Lobby.store, client.UserID, remove.MessageID)
+	if err != nil{
+		return err
+	}
+
+	sendToClient(client.Lobby, client, SocketEvent{EventName: "message-updated", EventPayload: withReactionCountsFor(message, client.UserID), RequestID: request.RequestID})
+	announceMessageUpdate(client.Lobby, message, client)
+	if message.ThreadID != ""{
+		announceThreadUpdate(client.Lobby, message.ThreadID)
+	}
+	return nil
+}
+
+// the HTTP status that matches the code of a failed change
+func httpStatusFor(err *SocketError) int{
+	switch err.Code{
+	case ErrCodeInvalidPayload:
+		return http.StatusBadRequest
+	case ErrCodeForbidden:
+		return http.StatusForbidden
+	case ErrCodeNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func EditMessage(store Store, lobby *Lobby) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var requestPayload EditMessageRequest
+
+		if err := c.ShouldBindJSON(&requestPayload); err != nil{
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code:     http.StatusBadRequest,
+				Status:   http.StatusText(http.StatusBadRequest),
+				Message:  err.Error(),
+				Response: nil,
+			})
+			return
+		}
+		requestPayload.MessageID = c.Param("messageID")
+
+		if err := requestPayload.Validate(); err != nil{
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code:     http.StatusBadRequest,
+				Status:   http.StatusText(http.StatusBadRequest),
+				Message:  err.Error(),
+				Response: nil,
+			})
+			return
+		}
+
+		message, err := EditMessageQueryHandler(store, AuthUserID(c), requestPayload)
+		if err != nil{
+			c.JSON(httpStatusFor(err), APIResponse{
+				Code:     httpStatusFor(err),
+				Status:   http.StatusText(httpStatusFor(err)),
+				Message:  err.Message,
+				Response: nil,
+			})
+			return
+		}
+
+		announceMessageUpdate(lobby, message, nil)
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.MessageEdited,
+			Response: withReactionCountsFor(message, AuthUserID(c)),
+		})
+	}
+}
+
+func DeleteMessage(store Store, lobby *Lobby) gin.HandlerFunc{
+	return func(c *gin.Context){
+		message, err := DeleteMessageQueryHandler(store, AuthUserID(c), c.Param("messageID"))
+		if err != nil{
+			c.JSON(httpStatusFor(err), APIResponse{
+				Code:     httpStatusFor(err),
+				Status:   http.StatusText(httpStatusFor(err)),
+				Message:  err.Message,
+				Response: nil,
+			})
+			return
+		}
+
+		announceMessageUpdate(lobby, message, nil)
+		if message.ThreadID != ""{
+			announceThreadUpdate(lobby, message.ThreadID)
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.MessageDeleted,
+			Response: withReactionCountsFor(message, AuthUserID(c)),
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"chat-app/constants"
+)
+
+func TestEditAndDeleteMessage(t *testing.T){
+	api := newTestAPI(t)
+	alice, bob := api.register("alice"), api.register("bob")
+	message, _ := storeTestMessage(t, api.store, MessagePayload{FromUserID: alice.UserID, ToUserID: bob.UserID, Message: "first"}, bob.UserID, alice.UserID)
+	path := "/messages/" + message.ID
+
+	status, response := call[any](api, http.MethodPatch, path, bob.AccessToken, EditMessageRequest{Message: "mine now"})
+	if status != http.StatusForbidden || response.Message != constants.YouAreNotTheSender{
+		t.Errorf("an edit by the recipient: got %d %s", status, response.Message)
+	}
+	if status, _ := call[any](api, http.MethodPatch, path, alice.AccessToken, EditMessageRequest{}); status != http.StatusBadRequest{
+		t.Errorf("an edit without text: got %d, want 400", status)
+	}
+	if status, _ := call[any](api, http.MethodPatch, path, alice.AccessToken, "not an edit"); status != http.StatusBadRequest{
+		t.Errorf("an edit that isn't an object: got %d, want 400", status)
+	}
+	if status, _ := call[any](api, http.MethodPatch, "/messages/"+newMemoryID(), alice.AccessToken, EditMessageRequest{Message: "text"}); status != http.StatusNotFound{
+		t.Errorf("an edit of a missing message: got %d, want 404", status)
+	}
+
+	status, edited := call[Message](api, http.MethodPatch, path, alice.AccessToken, EditMessageRequest{Message: "second"})
+	if status != http.StatusOK || edited.Response.Message != "second" || !edited.Response.Edited{
+		t.Fatalf("an edit by the sender: got %d %+v", status, edited)
+	}
+	if stored := api.store.GetMessageByID(message.ID); stored.Message != "second" || len(stored.History) != 1{
+		t.Errorf("stored %+v", stored)
+	}
+
+	status, deleted := call[Message](api, http.MethodDelete, path, alice.AccessToken, nil)
+	if status != http.StatusOK || !deleted.Response.Deleted || deleted.Response.Message != ""{
+		t.Fatalf("a delete by the sender: got %d %+v", status, deleted)
+	}
+	status, response = call[any](api, http.MethodPatch, path, alice.AccessToken, EditMessageRequest{Message: "third"})
+	if status != http.StatusForbidden || response.Message != constants.MessageIsDeleted{
+		t.Errorf("an edit of a deleted message: got %d %s", status, response.Message)
+	}
+}
+
+func TestEditMessageAfterTheWindow(t *testing.T){
+	api := newTestAPI(t)
+	alice, bob := api.register("alice"), api.register("bob")
+	message, _ := storeTestMessage(t, api.store, MessagePayload{FromUserID: alice.UserID, ToUserID: bob.UserID, Message: "old"}, bob.UserID, alice.UserID)
+
+	// the message was sent before the window started
+	api.store.mu.Lock()
+	api.store.messages[api.store.messageIndex[message.ID]].CreatedAt = time.Now().Add(-time.Hour)
+	api.store.mu.Unlock()
+
+	status, response := call[any](api, http.MethodPatch, "/messages/"+message.ID, alice.AccessToken, EditMessageRequest{Message: "new"})
+	if status != http.StatusForbidden || response.Message != constants.MessageEditWindowHasPassed{
+		t.Errorf("got %d %s", status, response.Message)
+	}
+	if status, _ := call[any](api, http.MethodDelete, "/messages/"+message.ID, alice.AccessToken, nil); status != http.StatusForbidden{
+		t.Errorf("a delete after the window: got %d, want 403", status)
+	}
+}
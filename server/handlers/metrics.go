@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "chat"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name: "http_request_duration_seconds",
+		Help: "Time taken to handle HTTP requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	socketConnectionsOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name: "websocket_connections_open",
+		Help: "WebSocket connections currently open on this instance.",
+	})
+
+	socketConnections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name: "websocket_connections_total",
+		Help: "WebSocket connections opened on this instance.",
+	})
+
+	socketEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name: "socket_events_total",
+		Help: "Socket events received, by type and the error code they failed with.",
+	}, []string{"event", "code"})
+
+	messagesStored = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name: "messages_stored_total",
+		Help: "New messages stored, retried sends aren't counted twice.",
+	})
+
+	storeQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name: "store_query_duration_seconds",
+		Help: "Time taken by the MongoDB store, by store method.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 10},
+	}, []string{"query"})
+
+	sendBufferDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name: "send_buffer_drops_total",
+		Help: "Events dropped because the send buffer of a client was full.",
+	})
+
+	deliveryAckDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name: "delivery_ack_drops_total",
+		Help: "Direct messages left sent instead of delivered because the delivery worker was behind.",
+	})
+
+	pingTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name: "ping_timeouts_total",
+		Help: "Sockets closed because no pong arrived in time or a ping couldn't be written.",
+	})
+)
+
+// records how long a store method took, called as defer observeQuery("Name", time.Now())
+func observeQuery(query string, start time.Time){
+	storeQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// the event label only takes the known event types, anything a client makes up is counted as unknown
+func observeSocketEvent(eventType string, err *SocketError){
+	if _, ok := socketEventHandlers[eventType]; !ok{
+		eventType = "unknown"
+	}
+
+	code := ""
+	if err != nil{
+		code = err.Code
+	}
+	socketEvents.WithLabelValues(eventType, code).Inc()
+}
+
+// MetricsMiddleware counts and times requests by their route pattern, so IDs in the path don't
+// make a series each
+func MetricsMiddleware() gin.HandlerFunc{
+	return func(c *gin.Context){
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == ""{
+			route = "unmatched"
+		}
+
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"chat-app/constants"
+	"chat-app/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// keys under which AuthMiddleware stores the authenticated user and session in the gin context
+const (
+	authUserIDKey    = "authUserID"
+	authSessionIDKey = "authSessionID"
+	requestIDKey     = "requestID"
+	requestLoggerKey = "requestLogger"
+)
+
+// RequestIDHeader carries the request ID in and out, a proxy in front may already have set one
+const RequestIDHeader = "X-Request-ID"
+
+// an incoming request ID is only kept when it can't break the log lines it ends up in
+var isRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`).MatchString
+
+// extracts the access token from the Authorization header, or from the token
+// query parameter for the WebSocket upgrade since browsers can't set headers on it
+func accessTokenFromRequest(c *gin.Context) string{
+	header := c.GetHeader("Authorization")
+	if strings.HasPrefix(header, "Bearer "){
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return c.Query("token")
+}
+
+// AuthMiddleware rejects requests without a valid access token
+func AuthMiddleware(store SessionStore) gin.HandlerFunc{
+	return func(c *gin.Context){
+		token := accessTokenFromRequest(c)
+		if token == ""{
+			c.AbortWithStatusJSON(http.StatusUnauthorized, APIResponse{
+				Code:     http.StatusUnauthorized,
+				Status:   http.StatusText(http.StatusUnauthorized),
+				Message:  constants.YouAreNotLoggedIN,
+				Response: nil,
+			})
+			return
+		}
+
+		claims, err := utils.ParseAccessToken(token)
+		if err != nil{
+			c.AbortWithStatusJSON(http.StatusUnauthorized, APIResponse{
+				Code:     http.StatusUnauthorized,
+				Status:   http.StatusText(http.StatusUnauthorized),
+				Message:  constants.AccessTokenIsInvalid,
+				Response: nil,
+			})
+			return
+		}
+
+		// a logout revokes the session, so the token dies with it even before it expires
+		session, err := store.GetActiveSessionByID(claims.ID)
+		if err != nil || session.UserID != claims.Subject{
+			c.AbortWithStatusJSON(http.StatusUnauthorized, APIResponse{
+				Code:     http.StatusUnauthorized,
+				Status:   http.StatusText(http.StatusUnauthorized),
+				Message:  constants.AccessTokenIsInvalid,
+				Response: nil,
+			})
+			return
+		}
+
+		c.Set(authUserIDKey, claims.Subject)
+		c.Set(authSessionIDKey, claims.ID)
+		c.Next()
+	}
+}
+
+// AuthUserID returns the userID set by AuthMiddleware
+func AuthUserID(c *gin.Context) string{
+	return c.GetString(authUserIDKey)
+}
+
+// AuthSessionID returns the sessionID set by AuthMiddleware
+func AuthSessionID(c *gin.Context) string{
+	return c.GetString(authSessionIDKey)
+}
+
+func abortForbidden(c *gin.Context){
+	c.AbortWithStatusJSON(http.StatusForbidden, APIResponse{
+		Code:     http.StatusForbidden,
+		Status:   http.StatusText(http.StatusForbidden),
+		Message:  constants.YouAreNotAllowed,
+		Response: nil,
+	})
+}
+
+// RequestIDMiddleware tags the request with an ID, echoed in the response, and a logger carrying it
+func RequestIDMiddleware() gin.HandlerFunc{
+	return func(c *gin.Context){
+		requestID := c.GetHeader(RequestIDHeader)
+		if !isRequestID(requestID){
+			requestID = primitive.NewObjectID().Hex()
+		}
+
+		c.Header(RequestIDHeader, requestID)
+		c.Set(requestIDKey, requestID)
+		c.Set(requestLoggerKey, slog.With("requestId", requestID))
+		c.Next()
+	}
+}
+
+// RequestLogger returns the logger set by RequestIDMiddleware, with the user once they're authenticated
+func RequestLogger(c *gin.Context) *slog.Logger{
+	logger, ok := c.Value(requestLoggerKey).(*slog.Logger)
+	if !ok{
+		logger = slog.Default()
+	}
+	if userID := AuthUserID(c); userID != ""{
+		logger = logger.With("userId", userID)
+	}
+	return logger
+}
+
+// AccessLogMiddleware logs every request once it's done. The query string is left out,
+// it carries access tokens and download signatures.
+func AccessLogMiddleware() gin.HandlerFunc{
+	return func(c *gin.Context){
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch{
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+
+		RequestLogger(c).LogAttrs(c.Request.Context(), level, "request",
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("clientIp", c.ClientIP()),
+			slog.Int("size", c.Writer.Size()),
+		)
+	}
+}
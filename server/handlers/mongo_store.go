@@ -0,0 +1,1385 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"chat-app/constants"
+	"chat-app/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// MongoStore is the Store used in production, backed by a MongoDB database
+type MongoStore struct{
+	database *mongo.Database
+}
+
+func NewMongoStore(client *mongo.Client, databaseName string) *MongoStore{
+	return &MongoStore{
+		database: client.Database(databaseName),
+	}
+}
+
+func (store *MongoStore) Ping(ctx context.Context) error{
+	return store.database.Client().Ping(ctx, readpref.Primary())
+}
+
+// RequireTransactions fails unless the deployment supports the transactions StoreNewMessages
+// runs in, a standalone mongod doesn't. A replica set, even one with a single member, or a
+// sharded cluster does.
+func (store *MongoStore) RequireTransactions() error{
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var hello struct{
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := store.database.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil{
+		return err
+	}
+	if hello.SetName == "" && hello.Msg != "isdbgrid"{
+		return errors.New("MongoDB runs standalone, start it as a replica set (mongod --replSet rs0, then rs.initiate())")
+	}
+	return nil
+}
+
+func (store *MongoStore) collection(name string) *mongo.Collection{
+	return store.database.Collection(name)
+}
+
+// creates the indexes the queries below rely on, it's safe to run on every start
+func (store *MongoStore) CreateIndexes() error{
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sessions := store.collection("sessions")
+	_, err := sessions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "refreshTokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userID", Value: 1}}},
+		// mongo drops sessions once their refresh token expired
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil{
+		return err
+	}
+
+	rooms := store.collection("rooms")
+	_, err = rooms.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "members", Value: 1}}})
+	if err != nil{
+		return err
+	}
+
+	messages := store.collection("messages")
+	_, err = messages.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// the cursor pagination of rooms and of direct conversations, in both directions
+		{
+			Keys: bson.D{{Key: "roomId", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetSparse(true),
+		},
+		{Keys: bson.D{{Key: "fromUserID", Value: 1}, {Key: "toUserID", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}},
+		// retried sends can't store a message twice, older messages have no clientMessageId
+		{
+			Keys: bson.D{{Key: "fromUserID", Value: 1}, {Key: "clientMessageId", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"clientMessageId": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil{
+		return err
+	}
+
+	inbox := store.collection("inbox")
+	_, err = inbox.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userID", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil{
+		return err
+	}
+
+	_, err = store.collection("messages").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "threadId", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+		// finds the quotes to refresh after an edit or delete
+		{Keys: bson.D{{Key: "replyTo.id", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	if err != nil{
+		return err
+	}
+
+	// message search, a collection can only have one text index
+	_, err = store.collection("messages").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "message", Value: "text"}},
+	})
+	if err != nil{
+		return err
+	}
+
+	conversations := store.collection("conversations")
+	_, err = conversations.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userID", Value: 1}, {Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userID", Value: 1}, {Key: "updatedAt", Value: -1}}},
+		// finds the previews to refresh after an edit or delete
+		{Keys: bson.D{{Key: "lastMessage.id", Value: 1}}},
+	})
+	return err
+}
+
+func (store *MongoStore) UpdateUserPresence(userId, presence string) error{
+	defer observeQuery("UpdateUserPresence", time.Now())
+	docID, err := primitive.ObjectIDFromHex(userId)
+	if err != nil{
+		return errors.New("unable to extract Id from Hex Id")
+	}
+
+	collection := store.collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = collection.UpdateOne(ctx, 
+	bson.M{"_id": docID},
+	bson.M{"$set": bson.M{
+		"online": onlineFlag(presence),
+		"presence": presence,
+		"lastSeen": time.Now(),
+	}},
+	)
+	
+	if err != nil{
+		return errors.New(constants.ServerFailedResponse)
+	}
+	return nil
+}
+
+func (store *MongoStore) GetUserByUsername(username string) UserDetails{
+	defer observeQuery("GetUserByUsername", time.Now())
+	var userDetails UserDetails
+	collection := store.collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_ = collection.FindOne(ctx, bson.M{"username": username,}).Decode(&userDetails)
+
+	return userDetails
+}
+
+func (store *MongoStore) GetUserByUserID(userID string) UserDetails{
+	defer observeQuery("GetUserByUserID", time.Now())
+	var userDetails UserDetails
+
+	docID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil{
+		return UserDetails{}
+	}
+
+	collection := store.collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	_ = collection.FindOne(ctx, bson.M{
+		"_id": docID,
+	}).Decode(&userDetails)
+	
+	cancel()
+	return	userDetails
+}
+
+func (store *MongoStore) GetUsersByIDs(userIDs []string) map[string]UserDetails{
+	defer observeQuery("GetUsersByIDs", time.Now())
+	users := make(map[string]UserDetails, len(userIDs))
+
+	var docIDs []primitive.ObjectID
+	for _, userID := range userIDs{
+		if docID, err := primitive.ObjectIDFromHex(userID); err == nil{
+			docIDs = append(docIDs, docID)
+		}
+	}
+	if len(docIDs) == 0{
+		return users
+	}
+
+	collection := store.collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": docIDs}})
+	if err != nil{
+		return users
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx){
+		var user UserDetails
+		if err := cursor.Decode(&user); err == nil{
+			users[user.ID] = user
+		}
+	}
+	return users
+}
+
+func (store *MongoStore) CreateUser(username, passwordHash string) (string, error){
+	defer observeQuery("CreateUser", time.Now())
+	collection := store.collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id := primitive.NewObjectID()
+
+	_, registrationErr := collection.InsertOne(ctx, bson.M{
+		"_id": id,
+		"username": username,
+		"password": passwordHash,
+		"online": "N",
+		"presence": PresenceOffline,
+		"createdAt": time.Now(),
+	})
+
+	if registrationErr != nil{
+		return "", errors.New(constants.ServerFailedResponse)
+	}
+	return id.Hex(), nil
+}
+
+func (store *MongoStore) GetAllOnlineUsers(userID string) []UserResponse{
+	defer observeQuery("GetAllOnlineUsers", time.Now())
+	var onlineUsers []UserResponse
+
+	docID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil{
+		return onlineUsers
+	}
+
+	collection := store.collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, queryError:= collection.Find(ctx, bson.M{
+		"online": "Y",
+		"_id": bson.M{
+			"$ne": docID,	// excludes the user itself
+		},
+	})
+	if queryError != nil {
+		return onlineUsers
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var user UserDetails
+		err := cursor.Decode(&user)
+
+		if err == nil{
+			onlineUsers = append(onlineUsers, UserResponse{
+				UserID: user.ID,
+				Username: user.Username,
+				Online: user.Online,
+				Presence: user.Presence,
+				LastSeen: user.LastSeen,
+			})
+		}
+	}
+
+	return onlineUsers
+}
+
+func (store *MongoStore) StoreNewMessages(ctx context.Context, message MessagePayload, recipientIDs []string) (Message, []InboxEntry, error){
+	defer observeQuery("StoreNewMessages", time.Now())
+	collection := store.collection("messages")
+
+	// the caller's context carries the trace of the message, the queries are traced under it
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	id := primitive.NewObjectID()
+	stored := Message{
+		ID: id.Hex(),
+		ClientMessageID: message.ClientMessageID,
+		Message: message.Message,
+		FromUserID: message.FromUserID,
+		CreatedAt: time.Now(),
+	}
+
+	document := bson.M{
+		"_id":        id,
+		"fromUserID": stored.FromUserID,
+		"message":    stored.Message,
+		"createdAt":  stored.CreatedAt,
+	}
+	if message.ClientMessageID != ""{
+		document["clientMessageId"] = message.ClientMessageID
+	}
+	if len(message.Attachments) > 0{
+		stored.Attachments = message.Attachments
+		document["attachments"] = message.Attachments
+	}
+	if message.ReplyTo != nil{
+		stored.ReplyTo = message.ReplyTo
+		document["replyTo"] = message.ReplyTo
+	}
+	if message.ThreadID != ""{
+		stored.ThreadID = message.ThreadID
+		document["threadId"] = message.ThreadID
+	}
+	if message.RoomID != ""{
+		stored.RoomID = message.RoomID
+		document["roomId"] = message.RoomID
+	}else{
+		stored.ToUserID = message.ToUserID
+		stored.Status = MessageStatusSent
+		document["toUserID"] = message.ToUserID
+		document["status"] = MessageStatusSent
+	}
+
+	// the message, its inbox entries and the conversations are stored all together or not at all,
+	// so a retry after a failure either stores it anew or finds it complete
+	var entries []InboxEntry
+	err := store.inTransaction(ctx, func(ctx context.Context) error{
+		if _, err := collection.InsertOne(ctx, document); err != nil{
+			return err
+		}
+
+		if stored.ThreadID != ""{
+			if err := store.countThreadReply(ctx, stored); err != nil{
+				return err
+			}
+		}
+
+		var err error
+		if entries, err = store.appendToInboxes(ctx, stored, recipientIDs); err != nil{
+			return err
+		}
+		// a reply stays in its thread, the conversations keep their preview and unread count
+		if stored.ThreadID != ""{
+			return nil
+		}
+		return store.updateConversations(ctx, stored, recipientIDs)
+	})
+
+	if mongo.IsDuplicateKeyError(err) && message.ClientMessageID != ""{
+		var earlier Message
+		err = collection.FindOne(ctx, bson.M{
+			"fromUserID": message.FromUserID,
+			"clientMessageId": message.ClientMessageID,
+		}).Decode(&earlier)
+		if err == nil{
+			return earlier, nil, ErrDuplicateMessage
+		}
+	}
+	if err != nil{
+		if err.Error() == constants.MessageDoesNotExist{
+			return Message{}, nil, err
+		}
+		return Message{}, nil, errors.New(constants.ServerFailedResponse)
+	}
+	return stored, entries, nil
+}
+
+// runs write in a transaction, or as part of the caller's when ctx already has one. The
+// transactions need MongoDB to run as a replica set, a single member one is enough.
+func (store *MongoStore) inTransaction(ctx context.Context, write func(ctx context.Context) error) error{
+	if mongo.SessionFromContext(ctx) != nil{
+		return write(ctx)
+	}
+
+	session, err := store.database.Client().StartSession()
+	if err != nil{
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	// write runs again when the transaction is retried after a conflict
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error){
+		return nil, write(ctx)
+	})
+	return err
+}
+
+// gives the message the next sequence number of every recipient, the counters only move
+// together with the inbox entries so a failed insert leaves no gap
+func (store *MongoStore) appendToInboxes(ctx context.Context, message Message, recipientIDs []string) ([]InboxEntry, error){
+	var entries []InboxEntry
+
+	err := store.inTransaction(ctx, func(ctx context.Context) error{
+		entries = nil
+		var documents []interface{}
+
+		for _, userID := range recipientIDs{
+			var counter struct{
+				Seq int64 `bson:"seq"`
+			}
+
+			err := store.collection("counters").FindOneAndUpdate(ctx,
+				bson.M{"_id": userID},
+				bson.M{"$inc": bson.M{"seq": 1}},
+				options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+			).Decode(&counter)
+			if err != nil{
+				return err
+			}
+
+			entry := InboxEntry{
+				UserID: userID,
+				Seq: counter.Seq,
+				MessageID: message.ID,
+				CreatedAt: message.CreatedAt,
+			}
+			entries = append(entries, entry)
+			documents = append(documents, entry)
+		}
+
+		if len(documents) == 0{
+			return nil
+		}
+		_, err := store.collection("inbox").InsertMany(ctx, documents)
+		return err
+	})
+	if err != nil{
+		return nil, errors.New(constants.ServerFailedResponse)
+	}
+	return entries, nil
+}
+
+// counts the reply on the message that started its thread
+func (store *MongoStore) countThreadReply(ctx context.Context, reply Message) error{
+	parentID, err := primitive.ObjectIDFromHex(reply.ThreadID)
+	if err != nil{
+		return errors.New(constants.MessageDoesNotExist)
+	}
+
+	_, err = store.collection("messages").UpdateOne(ctx,
+		bson.M{"_id": parentID},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"replyCount": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$replyCount", 0}}, 1}},
+				"lastReplyAt": reply.CreatedAt,
+			}}},
+		},
+	)
+	if err != nil{
+		return errors.New(constants.ServerFailedResponse)
+	}
+	return nil
+}
+
+// moves the message to the top of every recipient's conversation list, it's unread for everyone but the sender
+func (store *MongoStore) updateConversations(ctx context.Context, message Message, recipientIDs []string) error{
+	var updates []mongo.WriteModel
+
+	for _, userID := range recipientIDs{
+		conversationID, peerID := conversationOf(message, userID)
+
+		var unread int64
+		if userID != message.FromUserID{
+			unread = 1
+		}
+
+		set := bson.M{"lastMessage": newMessagePreview(message), "updatedAt": message.CreatedAt}
+		if peerID != ""{
+			set["peerId"] = peerID
+		}else{
+			set["roomId"] = message.RoomID
+		}
+
+		updates = append(updates, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"userID": userID, "key": conversationID}).
+			SetUpdate(bson.M{"$set": set, "$inc": bson.M{"unreadCount": unread}}).
+			SetUpsert(true))
+	}
+
+	if len(updates) == 0{
+		return nil
+	}
+	if _, err := store.collection("conversations").BulkWrite(ctx, updates); err != nil{
+		return errors.New(constants.ServerFailedResponse)
+	}
+	return nil
+}
+
+func (store *MongoStore) MarkMessageDelivered(messageID, recipientID string) (Message, bool){
+	defer observeQuery("MarkMessageDelivered", time.Now())
+	var message Message
+
+	docID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil{
+		return Message{}, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = store.collection("messages").FindOneAndUpdate(ctx,
+		bson.M{
+			"_id": docID,
+			"toUserID": recipientID,
+			"status": bson.M{"$nin": []string{MessageStatusDelivered, MessageStatusRead}},
+		},
+		bson.M{"$set": bson.M{"status": MessageStatusDelivered, "deliveredAt": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&message)
+	if err != nil{
+		return Message{}, false
+	}
+	return message, true
+}
+
+func (store *MongoStore) MarkMessagesRead(readerID, fromUserID, upToMessageID string) (int64, error){
+	defer observeQuery("MarkMessagesRead", time.Now())
+	var upTo Message
+	collection := store.collection("messages")
+
+	docID, err := primitive.ObjectIDFromHex(upToMessageID)
+	if err != nil{
+		return 0, errors.New(constants.MessageDoesNotExist)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = collection.FindOne(ctx, bson.M{
+		"_id": docID,
+		"toUserID": readerID,
+		"fromUserID": fromUserID,
+	}).Decode(&upTo)
+	if err != nil{
+		return 0, errors.New(constants.MessageDoesNotExist)
+	}
+
+	now := time.Now()
+	filter := bson.M{
+		"toUserID": readerID,
+		"fromUserID": fromUserID,
+		"createdAt": bson.M{"$lte": upTo.CreatedAt},
+		"status": bson.M{"$ne": MessageStatusRead},
+	}
+
+	// messages read before their delivery was recorded count as delivered now
+	_, err = collection.UpdateMany(ctx,
+		bson.M{"$and": []bson.M{filter, {"deliveredAt": bson.M{"$exists": false}}}},
+		bson.M{"$set": bson.M{"deliveredAt": now}},
+	)
+	if err != nil{
+		return 0, errors.New(constants.ServerFailedResponse)
+	}
+
+	result, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"status": MessageStatusRead, "readAt": now}})
+	if err != nil{
+		return 0, errors.New(constants.ServerFailedResponse)
+	}
+
+	if result.ModifiedCount > 0{
+		_, err = store.collection("conversations").UpdateOne(ctx,
+			bson.M{"userID": readerID, "key": directConversationID(fromUserID)},
+			mongo.Pipeline{
+				{{Key: "$set", Value: bson.M{
+					"unreadCount": bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{"$unreadCount", result.ModifiedCount}}}},
+				}}},
+			},
+		)
+		if err != nil{
+			return 0, errors.New(constants.ServerFailedResponse)
+		}
+	}
+	return result.ModifiedCount, nil
+}
+
+func (store *MongoStore) GetMissedMessages(userID string, afterSeq, limit int64) []DeliveredMessage{
+	defer observeQuery("GetMissedMessages", time.Now())
+	var missed []DeliveredMessage
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "seq", Value: 1}})
+	findOptions.SetLimit(limit)
+
+	cursor, err := store.collection("inbox").Find(ctx, bson.M{
+		"userID": userID,
+		"seq": bson.M{"$gt": afterSeq},
+	}, findOptions)
+	if err != nil{
+		return missed
+	}
+	defer cursor.Close(ctx)
+
+	var entries []InboxEntry
+	if err := cursor.All(ctx, &entries); err != nil || len(entries) == 0{
+		return missed
+	}
+
+	var messageIDs []primitive.ObjectID
+	for _, entry := range entries{
+		if docID, err := primitive.ObjectIDFromHex(entry.MessageID); err == nil{
+			messageIDs = append(messageIDs, docID)
+		}
+	}
+
+	messageCursor, err := store.collection("messages").Find(ctx, bson.M{"_id": bson.M{"$in": messageIDs}})
+	if err != nil{
+		return missed
+	}
+	defer messageCursor.Close(ctx)
+
+	messages := make(map[string]Message)
+	for messageCursor.Next(ctx){
+		var message Message
+		if err := messageCursor.Decode(&message); err == nil{
+			messages[message.ID] = message
+		}
+	}
+
+	for _, entry := range entries{
+		if message, ok := messages[entry.MessageID]; ok{
+			missed = append(missed, DeliveredMessage{Message: message, Seq: entry.Seq})
+		}
+	}
+	return missed
+}
+
+func (store *MongoStore) GetMessageByID(messageID string) Message{
+	defer observeQuery("GetMessageByID", time.Now())
+	var message Message
+
+	docID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil{
+		return Message{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_ = store.collection("messages").FindOne(ctx, bson.M{"_id": docID}).Decode(&message)
+	return message
+}
+
+// updates a message that fromUserID can still change and returns the result
+func (store *MongoStore) changeMessage(messageID, fromUserID string, changeableAfter time.Time, update interface{}) (Message, error){
+	var message Message
+
+	docID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil{
+		return Message{}, errors.New(constants.MessageDoesNotExist)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = store.collection("messages").FindOneAndUpdate(ctx,
+		bson.M{
+			"_id": docID,
+			"fromUserID": fromUserID,
+			"deleted": bson.M{"$ne": true},
+			"createdAt": bson.M{"$gte": changeableAfter},
+		},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&message)
+	if err == mongo.ErrNoDocuments{
+		return Message{}, errors.New(constants.MessageCantBeChanged)
+	}
+	if err != nil{
+		return Message{}, errors.New(constants.ServerFailedResponse)
+	}
+
+	// the conversation lists that show this message as the latest one
+	_, err = store.collection("conversations").UpdateMany(ctx,
+		bson.M{"lastMessage.id": message.ID},
+		bson.M{"$set": bson.M{"lastMessage": newMessagePreview(message)}},
+	)
+	if err != nil{
+		return Message{}, errors.New(constants.ServerFailedResponse)
+	}
+
+	// and the messages quoting it
+	_, err = store.collection("messages").UpdateMany(ctx,
+		bson.M{"replyTo.id": message.ID},
+		bson.M{"$set": bson.M{"replyTo": newMessagePreview(message)}},
+	)
+	if err != nil{
+		return Message{}, errors.New(constants.ServerFailedResponse)
+	}
+	return message, nil
+}
+
+func (store *MongoStore) EditMessage(messageID, fromUserID, text string, changeableAfter time.Time) (Message, error){
+	defer observeQuery("EditMessage", time.Now())
+	now := time.Now()
+
+	// a pipeline update, "$message" still refers to the text being replaced
+	return store.changeMessage(messageID, fromUserID, changeableAfter, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"history": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$history", bson.A{}}},
+				bson.A{bson.M{"message": "$message", "replacedAt": now}},
+			}},
+			"message": bson.M{"$literal": text},
+			"edited": true,
+			"editedAt": now,
+		}}},
+	})
+}
+
+func (store *MongoStore) DeleteMessage(messageID, fromUserID string, changeableAfter time.Time) (Message, error){
+	defer observeQuery("DeleteMessage", time.Now())
+	message, err := store.changeMessage(messageID, fromUserID, changeableAfter, bson.M{
+		"$set": bson.M{"message": "", "deleted": true, "deletedAt": time.Now()},
+		"$unset": bson.M{"history": "", "attachments": "", "reactions": ""},
+	})
+	if err != nil || message.ThreadID == ""{
+		return message, err
+	}
+
+	// only the delete that turned the reply into a tombstone gets here, it's uncounted once
+	parentID, err := primitive.ObjectIDFromHex(message.ThreadID)
+	if err != nil{
+		return message, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = store.collection("messages").UpdateOne(ctx,
+		bson.M{"_id": parentID, "replyCount": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"replyCount": -1}},
+	)
+	if err != nil{
+		return Message{}, errors.New(constants.ServerFailedResponse)
+	}
+	return message, nil
+}
+
+func (store *MongoStore) GetConversationBetweenTwoUsers(toUser, fromUser string, query ConversationQuery) ConversationPage{
+	defer observeQuery("GetConversationBetweenTwoUsers", time.Now())
+	return store.findConversationPage(bson.M{
+		"$or": []bson.M{
+			{
+				"toUserID": toUser,
+				"fromUserID": fromUser,
+			},
+			{
+				"fromUserID": toUser,
+				"toUserID": fromUser,
+			},
+		},
+		"threadId": bson.M{"$exists": false},
+	}, query)
+}
+
+func (store *MongoStore) AddReaction(messageID, userID, emoji string) (Message, bool, error){
+	defer observeQuery("AddReaction", time.Now())
+	docID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil{
+		return Message{}, false, errors.New(constants.MessageDoesNotExist)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the user's other reactions must leave room for this one
+	mine := bson.M{"$size": bson.M{"$filter": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$reactions", bson.A{}}},
+		"cond": bson.M{"$eq": bson.A{"$$this.userID", userID}},
+	}}}
+
+	result, err := store.collection("messages").UpdateOne(ctx,
+		bson.M{
+			"_id": docID,
+			"deleted": bson.M{"$ne": true},
+			"$expr": bson.M{"$lt": bson.A{mine, maxReactionsPerUser}},
+		},
+		bson.M{"$addToSet": bson.M{"reactions": Reaction{UserID: userID, Emoji: emoji}}},
+	)
+	if err != nil{
+		return Message{}, false, errors.New(constants.ServerFailedResponse)
+	}
+
+	message := store.GetMessageByID(messageID)
+	if message.ID == "" || message.Deleted{
+		return Message{}, false, errors.New(constants.MessageDoesNotExist)
+	}
+	if result.MatchedCount == 0{
+		// at the limit, unless this reaction is one of them already
+		for _, reaction := range message.Reactions{
+			if reaction.UserID == userID && reaction.Emoji == emoji{
+				return message, false, nil
+			}
+		}
+		return Message{}, false, errors.New(constants.TooManyReactions)
+	}
+	return message, result.ModifiedCount > 0, nil
+}
+
+func (store *MongoStore) RemoveReaction(messageID, userID, emoji string) (Message, bool, error){
+	defer observeQuery("RemoveReaction", time.Now())
+	docID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil{
+		return Message{}, false, errors.New(constants.MessageDoesNotExist)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := store.collection("messages").UpdateOne(ctx,
+		bson.M{"_id": docID, "deleted": bson.M{"$ne": true}},
+		bson.M{"$pull": bson.M{"reactions": bson.M{"userID": userID, "emoji": emoji}}},
+	)
+	if err != nil{
+		return Message{}, false, errors.New(constants.ServerFailedResponse)
+	}
+	if result.MatchedCount == 0{
+		return Message{}, false, errors.New(constants.MessageDoesNotExist)
+	}
+	return store.GetMessageByID(messageID), result.ModifiedCount > 0, nil
+}
+
+func (store *MongoStore) CreateSession(userID, refreshTokenHash string) (string, error){
+	defer observeQuery("CreateSession", time.Now())
+	collection := store.collection("sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id := primitive.NewObjectID()
+	now := time.Now()
+
+	_, err := collection.InsertOne(ctx, bson.M{
+		"_id": id.Hex(),
+		"userID": userID,
+		"refreshTokenHash": refreshTokenHash,
+		"revoked": false,
+		"createdAt": now,
+		"expiresAt": now.Add(utils.RefreshTokenTTL()),
+	})
+	if err != nil{
+		return "", errors.New(constants.ServerFailedResponse)
+	}
+	return id.Hex(), nil
+}
+
+// returns the session if it exists, isn't revoked and hasn't expired
+func (store *MongoStore) GetActiveSessionByID(sessionID string) (Session, error){
+	defer observeQuery("GetActiveSessionByID", time.Now())
+	var session Session
+	collection := store.collection("sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := collection.FindOne(ctx, bson.M{
+		"_id": sessionID,
+		"revoked": false,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&session)
+	if err != nil{
+		return Session{}, errors.New(constants.AccessTokenIsInvalid)
+	}
+	return session, nil
+}
+
+// swaps the refresh token hash of an active session, a token can only be used once
+func (store *MongoStore) RotateRefreshToken(oldHash, newHash string) (Session, error){
+	defer observeQuery("RotateRefreshToken", time.Now())
+	var session Session
+	collection := store.collection("sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{
+			"refreshTokenHash": oldHash,
+			"revoked": false,
+			"expiresAt": bson.M{"$gt": time.Now()},
+		},
+		bson.M{"$set": bson.M{"refreshTokenHash": newHash}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	if err != nil{
+		return Session{}, errors.New(constants.RefreshTokenIsInvalid)
+	}
+	return session, nil
+}
+
+func (store *MongoStore) RevokeSession(sessionID string) error{
+	defer observeQuery("RevokeSession", time.Now())
+	collection := store.collection("sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{"$set": bson.M{"revoked": true, "revokedAt": time.Now()}},
+	)
+	if err != nil{
+		return errors.New(constants.ServerFailedResponse)
+	}
+	return nil
+}
+
+func (store *MongoStore) RevokeAllUserSessions(userID string) error{
+	defer observeQuery("RevokeAllUserSessions", time.Now())
+	collection := store.collection("sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"userID": userID, "revoked": false},
+		bson.M{"$set": bson.M{"revoked": true, "revokedAt": time.Now()}},
+	)
+	if err != nil{
+		return errors.New(constants.ServerFailedResponse)
+	}
+	return nil
+}
+
+// pages through messages matching the filter the same way for direct and room conversations
+func (store *MongoStore) findConversationPage(filter bson.M, query ConversationQuery) ConversationPage{
+	var fetched []Message
+	collection := store.collection("messages")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// newest first, or oldest first when paging forward, with one extra to tell if there's more
+	direction := -1
+	if query.After != nil{
+		direction = 1
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "createdAt", Value: direction}, {Key: "_id", Value: direction}})
+	findOptions.SetLimit(query.Limit + 1)
+
+	conditions := []bson.M{filter}
+	if query.Before != nil{
+		conditions = append(conditions, cursorCondition(*query.Before, "$lt"))
+	}
+	if query.After != nil{
+		conditions = append(conditions, cursorCondition(*query.After, "$gt"))
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{"$and": conditions}, findOptions)
+	if err != nil{
+		return newConversationPage(nil, query)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx){
+		var message Message
+		if err := cursor.Decode(&message); err == nil{
+			fetched = append(fetched, message)
+		}
+	}
+
+	return newConversationPage(fetched, query)
+}
+
+// the text index matches words rather than substrings, with stemming, and any of the words is enough
+func (store *MongoStore) SearchMessages(query SearchQuery) []Message{
+	defer observeQuery("SearchMessages", time.Now())
+	var found []Message
+	collection := store.collection("messages")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	direct := bson.M{
+		"roomId": bson.M{"$exists": false},
+		"$or": []bson.M{{"fromUserID": query.UserID}, {"toUserID": query.UserID}},
+	}
+	if query.WithUserID != ""{
+		direct["$or"] = []bson.M{
+			{"fromUserID": query.UserID, "toUserID": query.WithUserID},
+			{"fromUserID": query.WithUserID, "toUserID": query.UserID},
+		}
+	}
+
+	belongs := bson.M{"$or": []bson.M{direct, {"roomId": bson.M{"$in": query.RoomIDs}}}}
+	if len(query.RoomIDs) == 0{
+		belongs = direct
+	}
+
+	conditions := []bson.M{
+		{"$text": bson.M{"$search": query.Text}},
+		belongs,
+		{"deleted": bson.M{"$ne": true}},
+	}
+	if query.FromUserID != ""{
+		conditions = append(conditions, bson.M{"fromUserID": query.FromUserID})
+	}
+	if !query.Since.IsZero(){
+		conditions = append(conditions, bson.M{"createdAt": bson.M{"$gte": query.Since}})
+	}
+	if !query.Until.IsZero(){
+		conditions = append(conditions, bson.M{"createdAt": bson.M{"$lt": query.Until}})
+	}
+	if query.Before != nil{
+		conditions = append(conditions, cursorCondition(*query.Before, "$lt"))
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}})
+	findOptions.SetLimit(query.Limit + 1)
+
+	cursor, err := collection.Find(ctx, bson.M{"$and": conditions}, findOptions)
+	if err != nil{
+		return found
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx){
+		var message Message
+		if err := cursor.Decode(&message); err == nil{
+			found = append(found, message)
+		}
+	}
+	return found
+}
+
+// matches the messages before ($lt) or after ($gt) the cursor in (createdAt, _id) order
+func cursorCondition(cursor MessageCursor, operator string) bson.M{
+	var id interface{} = cursor.ID
+	if docID, err := primitive.ObjectIDFromHex(cursor.ID); err == nil{
+		id = docID
+	}
+
+	// $lt becomes $lte, the message the cursor points at is on the page too
+	idOperator := operator
+	if cursor.Inclusive{
+		idOperator += "e"
+	}
+
+	return bson.M{"$or": []bson.M{
+		{"createdAt": bson.M{operator: cursor.CreatedAt}},
+		{"createdAt": cursor.CreatedAt, "_id": bson.M{idOperator: id}},
+	}}
+}
+
+func (store *MongoStore) GetRoomConversation(roomID string, query ConversationQuery) ConversationPage{
+	defer observeQuery("GetRoomConversation", time.Now())
+	return store.findConversationPage(bson.M{"roomId": roomID, "threadId": bson.M{"$exists": false}}, query)
+}
+
+func (store *MongoStore) GetThread(threadID string, query ConversationQuery) ConversationPage{
+	defer observeQuery("GetThread", time.Now())
+	return store.findConversationPage(bson.M{"threadId": threadID}, query)
+}
+
+func (store *MongoStore) GetThreadParticipants(threadID string) []string{
+	defer observeQuery("GetThreadParticipants", time.Now())
+	parent := store.GetMessageByID(threadID)
+	if parent.ID == ""{
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// without the repliers only the parent's sender is left
+	var repliers []string
+	values, _ := store.collection("messages").Distinct(ctx, "fromUserID", bson.M{"threadId": threadID})
+	for _, value := range values{
+		if userID, ok := value.(string); ok{
+			repliers = append(repliers, userID)
+		}
+	}
+	return uniqueMembers(parent.FromUserID, repliers)
+}
+
+func (store *MongoStore) CreateRoom(name, ownerID string, memberIDs []string) (Room, error){
+	defer observeQuery("CreateRoom", time.Now())
+	collection := store.collection("rooms")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	room := Room{
+		ID: primitive.NewObjectID().Hex(),
+		Name: name,
+		Owners: []string{ownerID},
+		Members: uniqueMembers(ownerID, memberIDs),
+		CreatedAt: time.Now(),
+	}
+
+	_, err := collection.InsertOne(ctx, room)
+	if err != nil{
+		return Room{}, errors.New(constants.ServerFailedResponse)
+	}
+
+	if err := store.joinRoomConversations(ctx, room.ID, room.Members); err != nil{
+		return Room{}, err
+	}
+	return room, nil
+}
+
+func (store *MongoStore) GetRoomByID(roomID string) Room{
+	defer observeQuery("GetRoomByID", time.Now())
+	var room Room
+	collection := store.collection("rooms")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_ = collection.FindOne(ctx, bson.M{"_id": roomID}).Decode(&room)
+	return room
+}
+
+func (store *MongoStore) GetRoomsByIDs(roomIDs []string) map[string]Room{
+	defer observeQuery("GetRoomsByIDs", time.Now())
+	rooms := make(map[string]Room, len(roomIDs))
+	if len(roomIDs) == 0{
+		return rooms
+	}
+
+	collection := store.collection("rooms")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": roomIDs}})
+	if err != nil{
+		return rooms
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx){
+		var room Room
+		if err := cursor.Decode(&room); err == nil{
+			rooms[room.ID] = room
+		}
+	}
+	return rooms
+}
+
+func (store *MongoStore) GetRoomsByUserID(userID string) []Room{
+	defer observeQuery("GetRoomsByUserID", time.Now())
+	var rooms []Room
+	collection := store.collection("rooms")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"members": userID}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil{
+		return rooms
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx){
+		var room Room
+		if err := cursor.Decode(&room); err == nil{
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+func (store *MongoStore) AddRoomMember(roomID, userID string) (Room, error){
+	defer observeQuery("AddRoomMember", time.Now())
+	var room Room
+	collection := store.collection("rooms")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": roomID},
+		bson.M{"$addToSet": bson.M{"members": userID}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&room)
+	if err != nil{
+		return Room{}, errors.New(constants.RoomDoesNotExist)
+	}
+
+	if err := store.joinRoomConversations(ctx, roomID, []string{userID}); err != nil{
+		return Room{}, err
+	}
+	return room, nil
+}
+
+func (store *MongoStore) RemoveRoomMember(roomID, userID string) (Room, error){
+	defer observeQuery("RemoveRoomMember", time.Now())
+	var room Room
+	collection := store.collection("rooms")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": roomID},
+		bson.M{"$pull": bson.M{"members": userID, "owners": userID}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&room)
+	if err != nil{
+		return Room{}, errors.New(constants.RoomDoesNotExist)
+	}
+
+	_, err = store.collection("conversations").DeleteOne(ctx, bson.M{"userID": userID, "key": roomConversationID(roomID)})
+	if err != nil{
+		return Room{}, errors.New(constants.ServerFailedResponse)
+	}
+
+	// nobody is left to see the room, someone joining at the same time keeps it
+	if len(room.Members) == 0{
+		if _, err = collection.DeleteOne(ctx, bson.M{"_id": roomID, "members": bson.M{"$size": 0}}); err != nil{
+			return Room{}, errors.New(constants.ServerFailedResponse)
+		}
+		return room, nil
+	}
+
+	// a room always keeps an owner while it has members
+	if len(room.Owners) == 0{
+		room.Owners = []string{room.Members[0]}
+		_, err = collection.UpdateOne(ctx,
+			bson.M{"_id": roomID, "owners": bson.M{"$size": 0}},
+			bson.M{"$set": bson.M{"owners": room.Owners}},
+		)
+		if err != nil{
+			return Room{}, errors.New(constants.ServerFailedResponse)
+		}
+	}
+	return room, nil
+}
+
+// new room members get the room in their list right away
+func (store *MongoStore) joinRoomConversations(ctx context.Context, roomID string, userIDs []string) error{
+	var updates []mongo.WriteModel
+	now := time.Now()
+
+	for _, userID := range userIDs{
+		updates = append(updates, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"userID": userID, "key": roomConversationID(roomID)}).
+			SetUpdate(bson.M{"$setOnInsert": bson.M{"roomId": roomID, "updatedAt": now, "unreadCount": 0}}).
+			SetUpsert(true))
+	}
+
+	if len(updates) == 0{
+		return nil
+	}
+	if _, err := store.collection("conversations").BulkWrite(ctx, updates); err != nil{
+		return errors.New(constants.ServerFailedResponse)
+	}
+	return nil
+}
+
+func (store *MongoStore) GetConversations(userID string) []Conversation{
+	defer observeQuery("GetConversations", time.Now())
+	conversations := []Conversation{}
+	collection := store.collection("conversations")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"userID": userID}, options.Find().SetSort(bson.D{{Key: "updatedAt", Value: -1}}))
+	if err != nil{
+		return conversations
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx){
+		var conversation Conversation
+		if err := cursor.Decode(&conversation); err == nil{
+			conversations = append(conversations, conversation)
+		}
+	}
+	return conversations
+}
+
+func (store *MongoStore) MarkConversationRead(userID, conversationID string) error{
+	defer observeQuery("MarkConversationRead", time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := store.collection("conversations").UpdateOne(ctx,
+		bson.M{"userID": userID, "key": conversationID},
+		bson.M{"$set": bson.M{"unreadCount": 0}},
+	)
+	if err != nil{
+		return errors.New(constants.ServerFailedResponse)
+	}
+	if result.MatchedCount == 0{
+		return errors.New(constants.ConversationDoesNotExist)
+	}
+	return nil
+}
+
+func (store *MongoStore) CreateAttachment(attachment Attachment) error{
+	defer observeQuery("CreateAttachment", time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := store.collection("attachments").InsertOne(ctx, attachment); err != nil{
+		return errors.New(constants.ServerFailedResponse)
+	}
+	return nil
+}
+
+func (store *MongoStore) GetAttachment(attachmentID string) Attachment{
+	defer observeQuery("GetAttachment", time.Now())
+	var attachment Attachment
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_ = store.collection("attachments").FindOne(ctx, bson.M{"_id": attachmentID}).Decode(&attachment)
+	return attachment
+}
+
+func (store *MongoStore) ClaimAttachments(attachmentIDs []string, ownerID, clientMessageID string) ([]Attachment, error){
+	defer observeQuery("ClaimAttachments", time.Now())
+	collection := store.collection("attachments")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"_id": bson.M{"$in": attachmentIDs},
+		"ownerID": ownerID,
+		"$or": []bson.M{
+			{"claimedBy": bson.M{"$exists": false}},
+			{"claimedBy": clientMessageID},
+		},
+	}
+
+	// a concurrent claim by another message can win some of them, so count what this claim matched
+	result, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"claimedBy": clientMessageID}})
+	if err != nil{
+		return nil, errors.New(constants.ServerFailedResponse)
+	}
+	if result.MatchedCount != int64(len(attachmentIDs)){
+		return nil, errors.New(constants.AttachmentCantBeUsed)
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": attachmentIDs}, "claimedBy": clientMessageID, "ownerID": ownerID})
+	if err != nil{
+		return nil, errors.New(constants.ServerFailedResponse)
+	}
+	defer cursor.Close(ctx)
+
+	byID := make(map[string]Attachment, len(attachmentIDs))
+	for cursor.Next(ctx){
+		var attachment Attachment
+		if err := cursor.Decode(&attachment); err == nil{
+			byID[attachment.ID] = attachment
+		}
+	}
+
+	claimed := make([]Attachment, 0, len(attachmentIDs))
+	for _, attachmentID := range attachmentIDs{
+		attachment, ok := byID[attachmentID]
+		if !ok{
+			return nil, errors.New(constants.AttachmentCantBeUsed)
+		}
+		claimed = append(claimed, attachment)
+	}
+	return claimed, nil
+}
+
+func (store *MongoStore) LinkAttachments(attachmentIDs []string, messageID string) error{
+	defer observeQuery("LinkAttachments", time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := store.collection("attachments").UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": attachmentIDs}},
+		bson.M{"$set": bson.M{"messageId": messageID}},
+	)
+	if err != nil{
+		return errors.New(constants.ServerFailedResponse)
+	}
+	return nil
+}
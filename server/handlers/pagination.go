@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-app/constants"
+
+	"github.com/gin-gonic/gin"
+)
+
+// page sizes, Configure sets them from the messages settings of the config
+var (
+	defaultConversationLimit int64
+	maxConversationLimit     int64
+)
+
+// MessageCursor points at a message by (createdAt, _id), the id orders messages with the same createdAt
+type MessageCursor struct {
+	CreatedAt time.Time
+	ID        string
+	// the page before or after the cursor starts with the message it points at
+	Inclusive bool
+}
+
+// ConversationQuery selects a page of a conversation. Before and After leave out the message
+// they point at unless they're inclusive, at most one of them is set and without either the
+// page holds the newest messages.
+type ConversationQuery struct {
+	Before *MessageCursor
+	After  *MessageCursor
+	Limit  int64
+}
+
+// ConversationPage holds messages oldest first, NextCursor continues in the direction of the
+// query (older messages for before, newer ones for after) and is empty at the end
+type ConversationPage struct {
+	Messages   []Message
+	NextCursor string
+}
+
+// marks a cursor that includes the message it points at
+const inclusiveCursorSuffix = "_incl"
+
+// EncodeCursor returns the opaque cursor clients pass back as before or after
+func EncodeCursor(message Message) string{
+	raw := strconv.FormatInt(message.CreatedAt.UnixNano(), 10) + "_" + message.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// EncodeInclusiveCursor returns a cursor whose page before or after it includes the message,
+// it links to where the message is in its conversation
+func EncodeInclusiveCursor(message Message) string{
+	raw := strconv.FormatInt(message.CreatedAt.UnixNano(), 10) + "_" + message.ID + inclusiveCursorSuffix
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(cursor string) (*MessageCursor, error){
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil{
+		return nil, errors.New(constants.CursorIsInvalid)
+	}
+
+	id, inclusive := strings.CutSuffix(string(raw), inclusiveCursorSuffix)
+	nanos, id, found := strings.Cut(id, "_")
+	createdAt, err := strconv.ParseInt(nanos, 10, 64)
+	if !found || err != nil || id == "" || strings.Contains(id, "_"){
+		return nil, errors.New(constants.CursorIsInvalid)
+	}
+	return &MessageCursor{CreatedAt: time.Unix(0, createdAt), ID: id, Inclusive: inclusive}, nil
+}
+
+// true when the message is on the page before the cursor, in (createdAt, _id) order
+func (cursor MessageCursor) newerThan(message Message) bool{
+	if !message.CreatedAt.Equal(cursor.CreatedAt){
+		return message.CreatedAt.Before(cursor.CreatedAt)
+	}
+	return message.ID < cursor.ID || (cursor.Inclusive && message.ID == cursor.ID)
+}
+
+// true when the message is on the page after the cursor, in (createdAt, _id) order
+func (cursor MessageCursor) olderThan(message Message) bool{
+	if !message.CreatedAt.Equal(cursor.CreatedAt){
+		return message.CreatedAt.After(cursor.CreatedAt)
+	}
+	return message.ID > cursor.ID || (cursor.Inclusive && message.ID == cursor.ID)
+}
+
+// builds the page from up to Limit+1 messages in query order, newest first unless the query
+// goes forward with After, the extra message only tells that there is more
+func newConversationPage(fetched []Message, query ConversationQuery) ConversationPage{
+	var page ConversationPage
+
+	if int64(len(fetched)) > query.Limit{
+		fetched = fetched[:query.Limit]
+		page.NextCursor = EncodeCursor(fetched[len(fetched)-1])
+	}
+
+	// Reverse to display oldest-to-newest in UI
+	if query.After == nil{
+		for i, j := 0, len(fetched)-1; i < j; i, j = i+1, j-1 {
+			fetched[i], fetched[j] = fetched[j], fetched[i]
+		}
+	}
+
+	page.Messages = fetched
+	if page.Messages == nil{
+		page.Messages = []Message{}
+	}
+	return page
+}
+
+// reads before, after and limit from the query string, it aborts the request when they're invalid
+func conversationQueryFromRequest(c *gin.Context) (ConversationQuery, bool){
+	query := ConversationQuery{Limit: defaultConversationLimit}
+
+	badRequest := func(message string) (ConversationQuery, bool){
+		c.AbortWithStatusJSON(http.StatusBadRequest, APIResponse{
+			Code:     http.StatusBadRequest,
+			Status:   http.StatusText(http.StatusBadRequest),
+			Message:  message,
+			Response: nil,
+		})
+		return ConversationQuery{}, false
+	}
+
+	if limit := c.Query("limit"); limit != ""{
+		value, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || value < 1 || value > maxConversationLimit{
+			return badRequest(constants.LimitIsInvalid)
+		}
+		query.Limit = value
+	}
+
+	before, after := c.Query("before"), c.Query("after")
+	if before != "" && after != ""{
+		return badRequest(constants.CursorsAreExclusive)
+	}
+
+	var err error
+	if before != ""{
+		if query.Before, err = DecodeCursor(before); err != nil{
+			return badRequest(err.Error())
+		}
+	}
+	if after != ""{
+		if query.After, err = DecodeCursor(after); err != nil{
+			return badRequest(err.Error())
+		}
+	}
+	return query, true
+}
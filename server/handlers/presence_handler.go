@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"chat-app/constants"
+)
+
+// a presence change of one connection, applied by the Lobby goroutine
+type presenceUpdate struct{
+	client *Client
+	status string
+}
+
+// presence work the Run goroutine hands to the presence worker, which does it in order
+type presenceJob struct{
+	client *Client
+	status string
+	// the connection just registered, it gets the chatlist once it's announced
+	join bool
+	// a change the tracker found on its own, without a client
+	change PresenceChange
+	// closed once every job queued before it is done
+	flushed chan struct{}
+}
+
+// queues the job without waiting, so the Run goroutine can call it
+func (lobby *Lobby) queuePresence(job presenceJob){
+	lobby.presenceMu.Lock()
+	lobby.presenceJobs = append(lobby.presenceJobs, job)
+	lobby.presenceMu.Unlock()
+
+	select {
+	case lobby.presenceQueued <- struct{}{}:
+	default:
+	}
+}
+
+// tracks, stores and announces presence away from the Run goroutine, the results go back
+// to the connections through the emit channel
+func (lobby *Lobby) presenceWorker(){
+	for range lobby.presenceQueued{
+		lobby.presenceMu.Lock()
+		jobs := lobby.presenceJobs
+		lobby.presenceJobs = nil
+		lobby.presenceMu.Unlock()
+
+		for _, job := range jobs{
+			runPresenceJob(lobby, job)
+		}
+	}
+}
+
+func runPresenceJob(lobby *Lobby, job presenceJob){
+	switch {
+	case job.flushed != nil:
+		close(job.flushed)
+	case job.client == nil:
+		announcePresence(lobby, job.change.UserID, job.change.Previous, job.change.Current)
+	default:
+		previous, current := trackPresence(lobby, job.client, job.status)
+		announcePresence(lobby, job.client.UserID, previous, current)
+
+		if job.join{
+			payload, err := chatListEvent(job.client, "")
+			if err != nil{
+				payload = SocketEvent{EventName: "error", EventPayload: err}
+			}
+			lobby.sendToConnection(job.client, payload)
+		}
+	}
+}
+
+// the "online" field of the user document predates presence, it stays "Y" while the user is away
+func onlineFlag(presence string) string{
+	if presence == PresenceOffline{
+		return "N"
+	}
+	return "Y"
+}
+
+// records the presence of the client's connection and returns the user's overall presence
+// before and after, both are empty when the tracker failed so nothing gets announced
+func trackPresence(lobby *Lobby, client *Client, presence string) (string, string){
+	previous, current, err := lobby.tracker.SetConnectionPresence(client.UserID, client.ID, presence)
+	if err != nil{
+		client.log.Error("Failed to track presence", "error", err)
+		return "", ""
+	}
+	return previous, current
+}
+
+// stores and announces the user's presence, but only when it differs from previous.
+// Runs on the presence worker.
+func announcePresence(lobby *Lobby, userID, previous, current string){
+	if current == previous{
+		return
+	}
+
+	if err := lobby.store.UpdateUserPresence(userID, current); err != nil{
+		slog.Error("Failed to store presence", "userId", userID, "error", err)
+	}
+
+	broadcast := func(payload SocketEvent){
+		lobby.publish(Delivery{Kind: deliverToEveryone, ExceptUserID: userID, Event: payload})
+	}
+
+	userDetails := lobby.store.GetUserByUserID(userID)
+	broadcast(SocketEvent{
+		EventName: "presence",
+		EventPayload: PresenceEvent{
+			UserID: userID,
+			Username: userDetails.Username,
+			Status: current,
+			LastSeen: time.Now(),
+		},
+	})
+
+	// the chatlist only cares about users coming and going
+	user := UserResponse{
+		Username: userDetails.Username,
+		UserID: userID,
+		Online: onlineFlag(current),
+		Presence: current,
+		LastSeen: userDetails.LastSeen,
+	}
+	if previous == PresenceOffline{
+		broadcast(SocketEvent{
+			EventName: "chatlist-response",
+			EventPayload: chatListResponse{Type: "new-user-joined", Chatlist: user},
+		})
+	}else if current == PresenceOffline{
+		broadcast(SocketEvent{
+			EventName: "chatlist-response",
+			EventPayload: chatListResponse{Type: "user-disconnected", Chatlist: user},
+		})
+	}
+}
+
+// a client marks itself away when it goes idle and online when it's used again
+func HandlePresenceEvent(lobby *Lobby, update presenceUpdate){
+	if !lobby.hasClient(update.client){
+		return
+	}
+
+	lobby.queuePresence(presenceJob{client: update.client, status: update.status})
+}
+
+func (request PresenceRequest) Validate() error{
+	if request.Status != PresenceOnline && request.Status != PresenceAway{
+		return errors.New(constants.PresenceStatusIsInvalid)
+	}
+	return nil
+}
+
+// the Lobby owns the connection's presence, the client only asks for the change
+func handlePresenceRequestEvent(client *Client, request SocketEnvelope) *SocketError{
+	var presence PresenceRequest
+	if err := decodePayload(request, &presence); err != nil{
+		return err
+	}
+
+	client.Lobby.presence <- presenceUpdate{client: client, status: presence.Status}
+	return nil
+}
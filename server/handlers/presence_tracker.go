@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// how often a Lobby looks for instances that stopped without shutting down
+var presenceSweepInterval = 10 * time.Second
+
+// PresenceChange is a change of a user's overall presence the tracker found on its own
+type PresenceChange struct {
+	UserID   string
+	Previous string
+	Current  string
+}
+
+// PresenceTracker keeps the presence of every connection across all server instances
+type PresenceTracker interface {
+	// SetConnectionPresence records the presence of one connection, PresenceOffline forgets it.
+	// It returns the user's overall presence before and after the change.
+	SetConnectionPresence(userID, connectionID, presence string) (previous, current string, err error)
+	// Sweep forgets the connections of instances that stopped without shutting down and
+	// returns the users whose presence changed because of it
+	Sweep() ([]PresenceChange, error)
+	Close() error
+}
+
+// MemoryPresenceTracker tracks the connections of the Lobbies in this process
+type MemoryPresenceTracker struct{
+	mu sync.Mutex
+	// presence of every connection by userID and connectionID
+	connections map[string]map[string]string
+}
+
+func NewMemoryPresenceTracker() *MemoryPresenceTracker{
+	return &MemoryPresenceTracker{connections: make(map[string]map[string]string)}
+}
+
+func (tracker *MemoryPresenceTracker) SetConnectionPresence(userID, connectionID, presence string) (string, string, error){
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	previous := overallPresence(tracker.connections[userID])
+
+	if presence == PresenceOffline{
+		delete(tracker.connections[userID], connectionID)
+		if len(tracker.connections[userID]) == 0{
+			delete(tracker.connections, userID)
+		}
+	}else{
+		if tracker.connections[userID] == nil{
+			tracker.connections[userID] = make(map[string]string)
+		}
+		tracker.connections[userID][connectionID] = presence
+	}
+
+	return previous, overallPresence(tracker.connections[userID]), nil
+}
+
+// the connections all belong to this process, they're never left behind
+func (tracker *MemoryPresenceTracker) Sweep() ([]PresenceChange, error){
+	return nil, nil
+}
+
+func (tracker *MemoryPresenceTracker) Close() error{
+	return nil
+}
+
+// the user is online if any connection is, away if all of them are away and offline without any
+func overallPresence(connections map[string]string) string{
+	presence := PresenceOffline
+	for _, connectionPresence := range connections{
+		if connectionPresence == PresenceOnline{
+			return PresenceOnline
+		}
+		presence = PresenceAway
+	}
+	return presence
+}
@@ -1,83 +1,24 @@
 package handlers
 
 import (
-	"context"
 	"errors"
-	"os"
-	"time"
 
-	"chat-app/config"
 	"chat-app/constants"
 	"chat-app/utils"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func UpdateUserOnlineStatusByUserID(userId, status string) error{
-	docID, err := primitive.ObjectIDFromHex(userId)
-	if err != nil{
-		return errors.New("unable to extract Id from Hex Id")
-	}
-
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_, err = collection.UpdateOne(ctx, 
-	bson.M{"_id": docID},
-	bson.M{"$set": bson.M{"online": status}},
-	)
-	
-	if err != nil{
-		return errors.New(constants.ServerFailedResponse)
-	}
-	return nil
-}
-
-func GetUserByUsername(username string) UserDetails{
-	var userDetails UserDetails
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_ = collection.FindOne(ctx, bson.M{"username": username,}).Decode(&userDetails)
-
-	return userDetails
-}
-
-func GetUserByUserID(userID string) UserDetails{
-	var userDetails UserDetails
-
-	docID, err := primitive.ObjectIDFromHex(userID)
-	if err != nil{
-		return UserDetails{}
-	}
-
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-	_ = collection.FindOne(ctx, bson.M{
-		"_id": docID,
-	}).Decode(&userDetails)
-	
-	cancel()
-	return	userDetails
-}
-
-func IsUsernameAvailableQueryHandler(username string) bool{
-	userDetails := GetUserByUsername(username)
+func IsUsernameAvailableQueryHandler(store UserStore, username string) bool{
+	userDetails := store.GetUserByUsername(username)
 	return userDetails == (UserDetails{})
 }
 
-func LoginQueryHandler(userDetailsRequest LoginRequest) (UserResponse, error){
+func LoginQueryHandler(store UserStore, userDetailsRequest LoginRequest) (UserResponse, error){
 	if userDetailsRequest.Username == "" {
 		return UserResponse{}, errors.New(constants.UsernameCantBeEmpty)
 	} else if userDetailsRequest.Password == "" {
 		return UserResponse{}, errors.New(constants.PasswordCantBeEmpty)
 	} else{
-		userDetails := GetUserByUsername(userDetailsRequest.Username)
+		userDetails := store.GetUserByUsername(userDetailsRequest.Username)
 		if userDetails == (UserDetails{}){
 			return UserResponse{}, errors.New(constants.UserIsNotRegisteredWithUs)
 		}
@@ -86,10 +27,6 @@ func LoginQueryHandler(userDetailsRequest LoginRequest) (UserResponse, error){
 			return UserResponse{}, errors.New(constants.LoginPasswordIsInCorrect)
 		}
 
-		if onlineStatusErr := UpdateUserOnlineStatusByUserID(userDetails.ID, "Y"); onlineStatusErr != nil{
-			return UserResponse{}, errors.New(constants.LoginPasswordIsInCorrect)
-		}
-
 		return	UserResponse{
 			Username: userDetails.Username,
 			UserID: userDetails.ID,
@@ -97,143 +34,79 @@ func LoginQueryHandler(userDetailsRequest LoginRequest) (UserResponse, error){
 	}
 }
 
-// check the username from the database
-func RegisterQueryHandler(userDetails RegistrationRequest) (string, error){
-	if userDetails.Username == ""{
-		return "", errors.New(constants.UsernameCantBeEmpty)
-	}else if userDetails.Password == ""{
-		return "", errors.New(constants.PasswordCantBeEmpty)
-	}else{
-		newPasswordHash, PassErr := utils.HashPassword(userDetails.Password)
-		if PassErr != nil{
-			return "", errors.New(constants.ServerFailedResponse)
-		}
-
-		collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("users")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		
-		id := primitive.NewObjectID()
-		uid := id.Hex()
-
-		_, registrationErr := collection.InsertOne(ctx, bson.M{
-			"_id": id,
-			"username": userDetails.Username,
-			"password": newPasswordHash,
-			"online": "N",
-			"createdAt": time.Now(),
-		})
-
-		if registrationErr != nil{
-			return "", errors.New(constants.ServerFailedResponse)
-		}
-
-		if onlineStatusError := UpdateUserOnlineStatusByUserID(uid, "Y"); onlineStatusError != nil {
-			return "", errors.New(constants.ServerFailedResponse)
-		}
-		return uid, nil
-	}
-}
-
-func GetAllOnlineUsers(userID string) []UserResponse{
-	var onlineUsers []UserResponse
-
-	docID, err := primitive.ObjectIDFromHex(userID)
+// starts a new session for the user and issues its access and refresh tokens
+func NewAuthResponse(store SessionStore, userID, username string) (AuthResponse, error){
+	refreshToken, err := utils.GenerateRefreshToken()
 	if err != nil{
-		return onlineUsers
+		return AuthResponse{}, errors.New(constants.ServerFailedResponse)
 	}
 
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	cursor, queryError:= collection.Find(ctx, bson.M{
-		"online": "Y",
-		"_id": bson.M{
-			"$ne": docID,	// excludes the user itself
-		},
-	})
-	defer cursor.Close(ctx)
-
-	if queryError != nil {
-		return onlineUsers
+	sessionID, err := store.CreateSession(userID, utils.HashRefreshToken(refreshToken))
+	if err != nil{
+		return AuthResponse{}, err
 	}
 
-	for cursor.Next(context.TODO()) {
-		var user UserDetails
-		err := cursor.Decode(&user)
-
-		if err == nil{
-			onlineUsers = append(onlineUsers, UserResponse{
-				UserID: user.ID,
-				Username: user.Username,
-				Online: user.Online,
-			})
-		}
+	accessToken, expiresAt, err := utils.GenerateAccessToken(userID, username, sessionID)
+	if err != nil{
+		return AuthResponse{}, errors.New(constants.ServerFailedResponse)
 	}
 
-	return onlineUsers
+	return AuthResponse{
+		Username: username,
+		UserID: userID,
+		AccessToken: accessToken,
+		ExpiresAt: expiresAt,
+		RefreshToken: refreshToken,
+	}, nil
 }
 
-func StoreNewMessages(message MessagePayload) bool{
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("messages")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_, registrationError := collection.InsertOne(ctx, bson.M{
-		"fromUserID": message.FromUserID,
-		"message":    message.Message,
-		"toUserID":   message.ToUserID,
-		"createdAt":  time.Now(),
-	})
-
-	return registrationError == nil
-}
+// exchanges a refresh token for a new access token, the refresh token is rotated on every use
+func RefreshQueryHandler(store Store, refreshToken string) (AuthResponse, error){
+	newRefreshToken, err := utils.GenerateRefreshToken()
+	if err != nil{
+		return AuthResponse{}, errors.New(constants.ServerFailedResponse)
+	}
 
-func GetConversationBetweenTwoUsers(toUser, fromUser string, page int64) []Message{
-	var conversation []Message
-	collection := config.Client.Database(os.Getenv("MONGODB_DATABASE")).Collection("messages")
-	var limit int64 = 20
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	queryHandler := bson.M{
-		"$or": []bson.M{
-			{
-				"toUserID": toUser,
-				"fromUserID": fromUser,
-			},
-			{
-				"fromUserID": toUser,
-				"toUserID": fromUser,
-			},
-		},
+	session, err := store.RotateRefreshToken(utils.HashRefreshToken(refreshToken), utils.HashRefreshToken(newRefreshToken))
+	if err != nil{
+		return AuthResponse{}, err
 	}
 
-	findOptions := options.Find()
-	findOptions.SetSort(bson.D{{"createdAt", -1}}) // -1 = descending, newest first
-	findOptions.SetLimit(limit)
-	findOptions.SetSkip((page-1)*limit)
+	userDetails := store.GetUserByUserID(session.UserID)
+	if userDetails == (UserDetails{}){
+		return AuthResponse{}, errors.New(constants.UserIsNotRegisteredWithUs)
+	}
 
-	cursor, err := collection.Find(ctx, queryHandler, findOptions)
+	accessToken, expiresAt, err := utils.GenerateAccessToken(userDetails.ID, userDetails.Username, session.ID)
 	if err != nil{
-		return conversation
+		return AuthResponse{}, errors.New(constants.ServerFailedResponse)
 	}
-	defer cursor.Close(ctx)
 
-	for cursor.Next(ctx){
-		var message Message
-		if err := cursor.Decode(&message); err == nil{
-			conversation = append(conversation, message)
+	return AuthResponse{
+		Username: userDetails.Username,
+		UserID: userDetails.ID,
+		AccessToken: accessToken,
+		ExpiresAt: expiresAt,
+		RefreshToken: newRefreshToken,
+	}, nil
+}
+
+// check the username from the database
+func RegisterQueryHandler(store UserStore, userDetails RegistrationRequest) (string, error){
+	if userDetails.Username == ""{
+		return "", errors.New(constants.UsernameCantBeEmpty)
+	}else if userDetails.Password == ""{
+		return "", errors.New(constants.PasswordCantBeEmpty)
+	}else{
+		newPasswordHash, PassErr := utils.HashPassword(userDetails.Password)
+		if PassErr != nil{
+			return "", errors.New(constants.ServerFailedResponse)
 		}
-	}
 
-	// Reverse to display oldest-to-newest in UI
-	for i, j := 0, len(conversation)-1; i < j; i, j = i+1, j-1 {
-		conversation[i], conversation[j] = conversation[j], conversation[i]
+		uid, registrationErr := store.CreateUser(userDetails.Username, newPasswordHash)
+		if registrationErr != nil{
+			return "", registrationErr
+		}
+		return uid, nil
 	}
-
-	return conversation
-}
\ No newline at end of file
+}
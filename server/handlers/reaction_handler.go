@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"errors"
+	"unicode"
+
+	"chat-app/constants"
+)
+
+const (
+	// different emoji one user can put on one message
+	maxReactionsPerUser = 20
+	// longest emoji in bytes, enough for sequences like family or flag emoji
+	maxEmojiLength = 64
+)
+
+// an emoji is made of symbols and the joiners, variation selectors and modifiers between
+// them, letters and whitespace mean it's text
+func validEmoji(emoji string) bool{
+	if emoji == "" || len(emoji) > maxEmojiLength{
+		return false
+	}
+
+	hasSymbol := false
+	for _, r := range emoji{
+		switch{
+		case unicode.IsLetter(r), unicode.IsSpace(r), unicode.IsControl(r):
+			return false
+		case unicode.Is(unicode.So, r):
+			hasSymbol = true
+		}
+	}
+	return hasSymbol
+}
+
+func (request ReactionRequest) Validate() error{
+	if request.MessageID == ""{
+		return errors.New(constants.MessageIDCantBeEmpty)
+	}
+	if !validEmoji(request.Emoji){
+		return errors.New(constants.EmojiIsInvalid)
+	}
+	return nil
+}
+
+// counts the reactions per emoji in the order the emoji were first used
+func countReactions(reactions []Reaction, viewerID string) []ReactionCount{
+	var counts []ReactionCount
+	position := make(map[string]int)
+
+	for _, reaction := range reactions{
+		i, seen := position[reaction.Emoji]
+		if !seen{
+			i = len(counts)
+			position[reaction.Emoji] = i
+			counts = append(counts, ReactionCount{Emoji: reaction.Emoji})
+		}
+		counts[i].Count++
+		if reaction.UserID == viewerID{
+			counts[i].ReactedByMe = true
+		}
+	}
+	return counts
+}
+
+// fills in the reaction counts of the messages as viewerID sees them
+func withReactionCounts(messages []Message, viewerID string) []Message{
+	for i := range messages{
+		messages[i] = withReactionCountsFor(messages[i], viewerID)
+	}
+	return messages
+}
+
+// every Message sent to a client goes through here, a client replacing its copy of the
+// message would lose the counts otherwise
+func withReactionCountsFor(message Message, viewerID string) Message{
+	message.ReactionCounts = countReactions(message.Reactions, viewerID)
+	return message
+}
+
+// ReactToMessage adds or removes the user's reaction, changed is false when there was nothing to do
+func ReactToMessage(store Store, userID string, request ReactionRequest, add bool) (ReactionEvent, Message, bool, *SocketError){
+	// a message the user can't see doesn't exist for them
+	message := store.GetMessageByID(request.MessageID)
+	if message.ID == "" || message.Deleted || !isParticipant(store, message, userID){
+		return ReactionEvent{}, Message{}, false, newSocketError(ErrCodeNotFound, constants.MessageDoesNotExist)
+	}
+
+	var changed bool
+	var err error
+	if add{
+		message, changed, err = store.AddReaction(request.MessageID, userID, request.Emoji)
+	}else{
+		message, changed, err = store.RemoveReaction(request.MessageID, userID, request.Emoji)
+	}
+	if err != nil{
+		switch err.Error(){
+		case constants.TooManyReactions:
+			return ReactionEvent{}, Message{}, false, newSocketError(ErrCodeForbidden, err.Error())
+		case constants.MessageDoesNotExist:
+			return ReactionEvent{}, Message{}, false, newSocketError(ErrCodeNotFound, err.Error())
+		}
+		return ReactionEvent{}, Message{}, false, newSocketError(ErrCodeInternal, constants.ServerFailedResponse)
+	}
+
+	event := ReactionEvent{MessageID: message.ID, UserID: userID, Emoji: request.Emoji}
+	for _, reaction := range message.Reactions{
+		if reaction.Emoji == request.Emoji{
+			event.Count++
+		}
+	}
+	return event, message, changed, nil
+}
+
+func handleReactionAddEvent(client *Client, request SocketEnvelope) *SocketError{
+	return handleReactionEvent(client, request, true)
+}
+
+func handleReactionRemoveEvent(client *Client, request SocketEnvelope) *SocketError{
+	return handleReactionEvent(client, request, false)
+}
+
+// answers the client and tells the other participants when something changed
+func handleReactionEvent(client *Client, request SocketEnvelope, add bool) *SocketError{
+	var reaction ReactionRequest
+	if err := decodePayload(request, &reaction); err != nil{
+		return err
+	}
+
+	event, message, changed, err := ReactToMessage(client.Lobby.store, client.UserID, reaction, add)
+	if err != nil{
+		return err
+	}
+
+	payload := SocketEvent{EventName: "reaction-removed", EventPayload: event}
+	if add{
+		payload.EventName = "reaction-added"
+	}
+
+	sendToClient(client.Lobby, client, SocketEvent{EventName: payload.EventName, EventPayload: event, RequestID: request.RequestID})
+	if changed{
+		announceToParticipants(client.Lobby, message, payload, client)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisFanOut publishes deliveries on a Redis pub/sub channel that every instance subscribes to
+type RedisFanOut struct{
+	client  *redis.Client
+	channel string
+	pubsub  *redis.PubSub
+}
+
+func NewRedisFanOut(client *redis.Client, channel string) *RedisFanOut{
+	return &RedisFanOut{client: client, channel: channel}
+}
+
+func (fanOut *RedisFanOut) Publish(delivery Delivery) error{
+	delivery.Trace = injectTrace(delivery.Event.ctx)
+	data, err := json.Marshal(delivery)
+	if err != nil{
+		return err
+	}
+	return fanOut.client.Publish(context.Background(), fanOut.channel, data).Err()
+}
+
+func (fanOut *RedisFanOut) Subscribe(handle func(Delivery)) error{
+	ctx := context.Background()
+
+	fanOut.pubsub = fanOut.client.Subscribe(ctx, fanOut.channel)
+	// wait for the subscription, deliveries published before it would be lost silently
+	if _, err := fanOut.pubsub.Receive(ctx); err != nil{
+		fanOut.pubsub.Close()
+		return err
+	}
+
+	go func(){
+		for message := range fanOut.pubsub.Channel(){
+			delivery, err := decodeDelivery([]byte(message.Payload))
+			if err != nil{
+				slog.Error("Failed to decode a delivery", "channel", fanOut.channel, "error", err)
+				continue
+			}
+			handle(delivery)
+		}
+	}()
+	return nil
+}
+
+func (fanOut *RedisFanOut) Close() error{
+	if fanOut.pubsub == nil{
+		return nil
+	}
+	return fanOut.pubsub.Close()
+}
+
+// the payload arrives as a generic map, messages get their type back since
+// the delivery receipts and the resume hold-back look for a DeliveredMessage
+func decodeDelivery(data []byte) (Delivery, error){
+	var delivery Delivery
+	if err := json.Unmarshal(data, &delivery); err != nil{
+		return Delivery{}, err
+	}
+
+	if delivery.Event.EventName == "message-response" || delivery.Event.EventName == "thread-reply"{
+		var envelope struct{
+			Event struct{
+				EventPayload DeliveredMessage `json:"eventpayload"`
+			} `json:"event"`
+		}
+		if err := json.Unmarshal(data, &envelope); err != nil{
+			return Delivery{}, err
+		}
+		delivery.Event.EventPayload = envelope.Event.EventPayload
+	}
+	delivery.Event.ctx = extractTrace(delivery.Trace)
+	return delivery, nil
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRedisFanOut(t *testing.T) (*RedisFanOut, *RedisFanOut){
+	t.Helper()
+	_, client := newTestRedis(t)
+
+	first := NewRedisFanOut(client, "test:deliveries")
+	second := NewRedisFanOut(client, "test:deliveries")
+	t.Cleanup(func(){
+		first.Close()
+		second.Close()
+	})
+	return first, second
+}
+
+func subscribe(t *testing.T, fanOut FanOut) chan Delivery{
+	t.Helper()
+	deliveries := make(chan Delivery, 10)
+	if err := fanOut.Subscribe(func(delivery Delivery){ deliveries <- delivery }); err != nil{
+		t.Fatalf("Subscribe: %v", err)
+	}
+	return deliveries
+}
+
+func receive(t *testing.T, deliveries chan Delivery) Delivery{
+	t.Helper()
+	select {
+	case delivery := <-deliveries:
+		return delivery
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no delivery arrived")
+		return Delivery{}
+	}
+}
+
+func TestRedisFanOutReachesEverySubscriber(t *testing.T){
+	first, second := newTestRedisFanOut(t)
+	atFirst := subscribe(t, first)
+	atSecond := subscribe(t, second)
+
+	sent := Delivery{
+		Origin: "instance",
+		Kind: deliverToUser,
+		UserID: "user",
+		ExceptClientID: "client",
+		Event: SocketEvent{EventName: "typing-start", RequestID: "request"},
+	}
+	if err := first.Publish(sent); err != nil{
+		t.Fatalf("Publish: %v", err)
+	}
+
+	// the publisher hears its own deliveries too, the Lobby skips them by Origin
+	for name, deliveries := range map[string]chan Delivery{"publisher": atFirst, "other": atSecond}{
+		got := receive(t, deliveries)
+		if got.Origin != sent.Origin || got.Kind != sent.Kind || got.UserID != sent.UserID ||
+			got.ExceptClientID != sent.ExceptClientID || got.Event.EventName != sent.Event.EventName ||
+			got.Event.RequestID != sent.Event.RequestID{
+			t.Errorf("%s: got %+v, want %+v", name, got, sent)
+		}
+	}
+}
+
+// delivery receipts and the resume hold-back only recognize a DeliveredMessage
+func TestRedisFanOutRestoresDeliveredMessages(t *testing.T){
+	first, second := newTestRedisFanOut(t)
+	deliveries := subscribe(t, second)
+
+	for _, eventName := range []string{"message-response", "thread-reply"}{
+		message := DeliveredMessage{
+			Message: Message{ID: "message", FromUserID: "sender", ToUserID: "user", Message: "hi", Status: MessageStatusSent},
+			Seq: 7,
+		}
+		if err := first.Publish(Delivery{Kind: deliverToUser, UserID: "user", Event: SocketEvent{EventName: eventName, EventPayload: message}}); err != nil{
+			t.Fatalf("Publish: %v", err)
+		}
+
+		got, ok := receive(t, deliveries).Event.EventPayload.(DeliveredMessage)
+		if !ok{
+			t.Fatalf("%s: the payload isn't a DeliveredMessage", eventName)
+		}
+		if got.ID != message.ID || got.Seq != message.Seq || got.Status != message.Status || got.ToUserID != message.ToUserID{
+			t.Errorf("%s: got %+v, want %+v", eventName, got, message)
+		}
+	}
+}
+
+func TestRedisFanOutCloseStopsDeliveries(t *testing.T){
+	first, second := newTestRedisFanOut(t)
+	deliveries := subscribe(t, second)
+
+	if err := second.Close(); err != nil{
+		t.Fatalf("Close: %v", err)
+	}
+	if err := first.Publish(Delivery{Kind: deliverToEveryone, Event: SocketEvent{EventName: "presence"}}); err != nil{
+		t.Fatalf("Publish: %v", err)
+	}
+
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("got %+v after Close", delivery)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
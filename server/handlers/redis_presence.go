@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// an instance that stops refreshing its key is considered gone with all its connections
+	instanceTTL       = 30 * time.Second
+	instanceHeartbeat = 10 * time.Second
+)
+
+// the overall presence of the user in the hash KEYS[1], shared by the scripts below
+const overallPresenceLua = `
+local function overall()
+	local result = 'offline'
+	for _, presence in ipairs(redis.call('HVALS', KEYS[1])) do
+		if presence == 'online' then
+			return 'online'
+		end
+		result = 'away'
+	end
+	return result
+end
+`
+
+// updates one connection and works out the overall presence before and after in one step,
+// so two instances changing the same user at once can't both miss the transition. The instance
+// remembers its users for the sweep until their last connection on it is gone.
+// KEYS[1] is the user's hash and KEYS[2] the instance's set of users,
+// ARGV is the instance ID, the field, the new presence and the userID
+var setConnectionPresenceScript = redis.NewScript(overallPresenceLua + `
+local previous = overall()
+if ARGV[3] == 'offline' then
+	redis.call('HDEL', KEYS[1], ARGV[2])
+
+	local prefix = ARGV[1] .. '/'
+	local remaining = false
+	for _, field in ipairs(redis.call('HKEYS', KEYS[1])) do
+		if string.sub(field, 1, #prefix) == prefix then
+			remaining = true
+			break
+		end
+	end
+	if not remaining then
+		redis.call('SREM', KEYS[2], ARGV[4])
+	end
+else
+	redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+	redis.call('SADD', KEYS[2], ARGV[4])
+end
+return {previous, overall()}
+`)
+
+// drops the connections a stopped instance had for one user, with the overall presence before and after.
+// KEYS[1] is the user's hash, ARGV[1] the ID of the stopped instance
+var sweepInstanceScript = redis.NewScript(overallPresenceLua + `
+local previous = overall()
+local prefix = ARGV[1] .. '/'
+for _, field in ipairs(redis.call('HKEYS', KEYS[1])) do
+	if string.sub(field, 1, #prefix) == prefix then
+		redis.call('HDEL', KEYS[1], field)
+	end
+end
+return {previous, overall()}
+`)
+
+// RedisPresenceTracker keeps a hash per user with the presence of every connection on every instance
+type RedisPresenceTracker struct{
+	client     *redis.Client
+	prefix     string
+	instanceID string
+
+	// false until the first heartbeat, a later one that finds the key gone was too late
+	registered bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// the keys share the {prefix} hash tag so the keys of a script live in one Redis Cluster slot
+func NewRedisPresenceTracker(client *redis.Client, prefix string) (*RedisPresenceTracker, error){
+	tracker := &RedisPresenceTracker{
+		client: client,
+		prefix: "{" + prefix + "}:",
+		instanceID: primitive.NewObjectID().Hex(),
+		stop: make(chan struct{}),
+	}
+
+	if err := tracker.heartbeat(); err != nil{
+		return nil, err
+	}
+	go tracker.keepAlive()
+	return tracker, nil
+}
+
+func (tracker *RedisPresenceTracker) instanceKey(instanceID string) string{
+	return tracker.prefix + "instance:" + instanceID
+}
+
+// the users with a connection on the instance
+func (tracker *RedisPresenceTracker) instanceUsersKey(instanceID string) string{
+	return tracker.prefix + "instance:" + instanceID + ":users"
+}
+
+// every instance that registered and wasn't swept yet
+func (tracker *RedisPresenceTracker) instancesKey() string{
+	return tracker.prefix + "instances"
+}
+
+func (tracker *RedisPresenceTracker) userKey(userID string) string{
+	return tracker.prefix + "user:" + userID
+}
+
+func (tracker *RedisPresenceTracker) heartbeat() error{
+	ctx := context.Background()
+
+	var refresh *redis.StatusCmd
+	_, err := tracker.client.Pipelined(ctx, func(pipe redis.Pipeliner) error{
+		refresh = pipe.SetArgs(ctx, tracker.instanceKey(tracker.instanceID), 1, redis.SetArgs{TTL: instanceTTL, Get: true})
+		pipe.SAdd(ctx, tracker.instancesKey(), tracker.instanceID)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil){
+		return err
+	}
+
+	if errors.Is(refresh.Err(), redis.Nil) && tracker.registered{
+		slog.Warn("The instance missed its heartbeat, the other instances may have dropped the presence of its connections", "instanceId", tracker.instanceID)
+	}
+	tracker.registered = true
+	return nil
+}
+
+func (tracker *RedisPresenceTracker) keepAlive(){
+	ticker := time.NewTicker(instanceHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := tracker.heartbeat(); err != nil{
+				slog.Error("Failed to refresh the presence of the instance", "instanceId", tracker.instanceID, "error", err)
+			}
+		case <-tracker.stop:
+			return
+		}
+	}
+}
+
+func (tracker *RedisPresenceTracker) SetConnectionPresence(userID, connectionID, presence string) (string, string, error){
+	result, err := setConnectionPresenceScript.Run(context.Background(), tracker.client,
+		[]string{tracker.userKey(userID), tracker.instanceUsersKey(tracker.instanceID)},
+		tracker.instanceID, tracker.instanceID + "/" + connectionID, presence, userID,
+	).StringSlice()
+	if err != nil{
+		return "", "", err
+	}
+	return result[0], result[1], nil
+}
+
+// Sweep forgets the connections of the instances whose key expired, like one that crashed.
+// Every instance sweeps, the script reports each change to only one of them.
+func (tracker *RedisPresenceTracker) Sweep() ([]PresenceChange, error){
+	ctx := context.Background()
+
+	instanceIDs, err := tracker.client.SMembers(ctx, tracker.instancesKey()).Result()
+	if err != nil{
+		return nil, err
+	}
+
+	var changes []PresenceChange
+	for _, instanceID := range instanceIDs{
+		if instanceID == tracker.instanceID{
+			continue
+		}
+		alive, err := tracker.client.Exists(ctx, tracker.instanceKey(instanceID)).Result()
+		if err != nil{
+			return changes, err
+		}
+		if alive == 1{
+			continue
+		}
+
+		userIDs, err := tracker.client.SMembers(ctx, tracker.instanceUsersKey(instanceID)).Result()
+		if err != nil{
+			return changes, err
+		}
+		for _, userID := range userIDs{
+			result, err := sweepInstanceScript.Run(ctx, tracker.client, []string{tracker.userKey(userID)}, instanceID).StringSlice()
+			if err != nil{
+				return changes, err
+			}
+			if result[0] != result[1]{
+				changes = append(changes, PresenceChange{UserID: userID, Previous: result[0], Current: result[1]})
+			}
+		}
+
+		// instance IDs are never reused, so nothing of it is needed anymore
+		if err := tracker.forget(ctx, instanceID); err != nil{
+			return changes, err
+		}
+		slog.Info("Swept the presence of a stopped instance", "instanceId", instanceID, "users", len(userIDs))
+	}
+	return changes, nil
+}
+
+func (tracker *RedisPresenceTracker) forget(ctx context.Context, instanceID string) error{
+	_, err := tracker.client.Pipelined(ctx, func(pipe redis.Pipeliner) error{
+		pipe.Del(ctx, tracker.instanceKey(instanceID), tracker.instanceUsersKey(instanceID))
+		pipe.SRem(ctx, tracker.instancesKey(), instanceID)
+		return nil
+	})
+	return err
+}
+
+// Close forgets the instance, its connections were set offline by the Lobby before
+func (tracker *RedisPresenceTracker) Close() error{
+	tracker.stopOnce.Do(func(){ close(tracker.stop) })
+	return tracker.forget(context.Background(), tracker.instanceID)
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client){
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func(){ client.Close() })
+	return server, client
+}
+
+func newTestTracker(t *testing.T, client *redis.Client) *RedisPresenceTracker{
+	t.Helper()
+	tracker, err := NewRedisPresenceTracker(client, "test:presence")
+	if err != nil{
+		t.Fatalf("NewRedisPresenceTracker: %v", err)
+	}
+	t.Cleanup(func(){ tracker.Close() })
+	return tracker
+}
+
+// stops the heartbeat without forgetting anything, like a crashed instance
+func (tracker *RedisPresenceTracker) crash(){
+	tracker.stopOnce.Do(func(){ close(tracker.stop) })
+}
+
+// lets the keys of crashed instances expire, the live ones refresh theirs
+func expireStoppedInstances(t *testing.T, server *miniredis.Miniredis, live ...*RedisPresenceTracker){
+	t.Helper()
+	server.FastForward(instanceTTL + time.Second)
+	for _, tracker := range live{
+		if err := tracker.heartbeat(); err != nil{
+			t.Fatalf("heartbeat: %v", err)
+		}
+	}
+}
+
+func setPresence(t *testing.T, tracker PresenceTracker, userID, connectionID, presence string) (string, string){
+	t.Helper()
+	previous, current, err := tracker.SetConnectionPresence(userID, connectionID, presence)
+	if err != nil{
+		t.Fatalf("SetConnectionPresence(%s, %s, %s): %v", userID, connectionID, presence, err)
+	}
+	return previous, current
+}
+
+func TestRedisPresenceTrackerOverallPresence(t *testing.T){
+	_, client := newTestRedis(t)
+	first := newTestTracker(t, client)
+	second := newTestTracker(t, client)
+
+	steps := []struct{
+		tracker      *RedisPresenceTracker
+		connectionID string
+		presence     string
+		previous     string
+		current      string
+	}{
+		{first, "a", PresenceOnline, PresenceOffline, PresenceOnline},
+		{second, "b", PresenceAway, PresenceOnline, PresenceOnline},
+		{first, "a", PresenceOffline, PresenceOnline, PresenceAway},
+		{second, "b", PresenceOnline, PresenceAway, PresenceOnline},
+		{second, "b", PresenceOffline, PresenceOnline, PresenceOffline},
+	}
+	for i, step := range steps{
+		previous, current := setPresence(t, step.tracker, "user", step.connectionID, step.presence)
+		if previous != step.previous || current != step.current{
+			t.Errorf("step %d: got %s -> %s, want %s -> %s", i, previous, current, step.previous, step.current)
+		}
+	}
+}
+
+func TestRedisPresenceTrackerForgetsUsersWithoutConnections(t *testing.T){
+	server, client := newTestRedis(t)
+	tracker := newTestTracker(t, client)
+	usersKey := tracker.instanceUsersKey(tracker.instanceID)
+
+	setPresence(t, tracker, "user", "a", PresenceOnline)
+	setPresence(t, tracker, "user", "b", PresenceAway)
+	setPresence(t, tracker, "user", "a", PresenceOffline)
+	if ok, _ := server.SIsMember(usersKey, "user"); !ok{
+		t.Fatalf("the user was forgotten while a connection was left")
+	}
+
+	setPresence(t, tracker, "user", "b", PresenceOffline)
+	if ok, _ := server.SIsMember(usersKey, "user"); ok{
+		t.Fatalf("the user is still remembered without connections")
+	}
+}
+
+// Redis Cluster runs a script only when all of its keys hash to one slot
+func TestRedisPresenceTrackerKeysShareAHashTag(t *testing.T){
+	_, client := newTestRedis(t)
+	tracker := newTestTracker(t, client)
+
+	keys := []string{
+		tracker.userKey("user"),
+		tracker.instanceKey(tracker.instanceID),
+		tracker.instanceUsersKey(tracker.instanceID),
+		tracker.instancesKey(),
+	}
+	for _, key := range keys{
+		if !strings.HasPrefix(key, "{test:presence}:"){
+			t.Errorf("key %q doesn't start with the {test:presence} hash tag", key)
+		}
+	}
+}
+
+func TestRedisPresenceTrackerSweepsStoppedInstances(t *testing.T){
+	server, client := newTestRedis(t)
+	live := newTestTracker(t, client)
+	crashed := newTestTracker(t, client)
+
+	// only on the crashed instance, on both, and away on the crashed one
+	setPresence(t, crashed, "gone", "a", PresenceOnline)
+	setPresence(t, live, "both", "b", PresenceOnline)
+	setPresence(t, crashed, "both", "c", PresenceAway)
+	setPresence(t, crashed, "idle", "d", PresenceAway)
+
+	crashed.crash()
+	expireStoppedInstances(t, server, live)
+
+	changes, err := live.Sweep()
+	if err != nil{
+		t.Fatalf("Sweep: %v", err)
+	}
+	got := make(map[string]PresenceChange)
+	for _, change := range changes{
+		got[change.UserID] = change
+	}
+	want := map[string]PresenceChange{
+		"gone": {UserID: "gone", Previous: PresenceOnline, Current: PresenceOffline},
+		"idle": {UserID: "idle", Previous: PresenceAway, Current: PresenceOffline},
+	}
+	if len(got) != len(want){
+		t.Fatalf("got changes %v, want %v", changes, want)
+	}
+	for userID, change := range want{
+		if got[userID] != change{
+			t.Errorf("change of %s: got %+v, want %+v", userID, got[userID], change)
+		}
+	}
+
+	// the live connection keeps the user online
+	if previous, current := setPresence(t, live, "both", "b", PresenceOnline); previous != PresenceOnline || current != PresenceOnline{
+		t.Errorf("both: got %s -> %s, want online -> online", previous, current)
+	}
+
+	// the stopped instance is gone, a second sweep has nothing to do
+	if server.Exists(crashed.instanceUsersKey(crashed.instanceID)){
+		t.Errorf("the users of the stopped instance were kept")
+	}
+	if ok, _ := server.SIsMember(live.instancesKey(), crashed.instanceID); ok{
+		t.Errorf("the stopped instance is still registered")
+	}
+	if changes, err := live.Sweep(); err != nil || len(changes) != 0{
+		t.Errorf("second Sweep: got %v, %v, want no changes", changes, err)
+	}
+}
+
+func TestRedisPresenceTrackerSweepKeepsLiveInstances(t *testing.T){
+	_, client := newTestRedis(t)
+	first := newTestTracker(t, client)
+	second := newTestTracker(t, client)
+
+	setPresence(t, second, "user", "a", PresenceOnline)
+
+	changes, err := first.Sweep()
+	if err != nil || len(changes) != 0{
+		t.Fatalf("Sweep: got %v, %v, want no changes", changes, err)
+	}
+	if _, current := setPresence(t, second, "other", "b", PresenceOnline); current != PresenceOnline{
+		t.Fatalf("other: got %s, want online", current)
+	}
+	if previous, _ := setPresence(t, first, "user", "c", PresenceAway); previous != PresenceOnline{
+		t.Errorf("user: got %s before, want online", previous)
+	}
+}
+
+func TestRedisPresenceTrackerCloseForgetsTheInstance(t *testing.T){
+	server, client := newTestRedis(t)
+	tracker := newTestTracker(t, client)
+
+	if err := tracker.Close(); err != nil{
+		t.Fatalf("Close: %v", err)
+	}
+	if server.Exists(tracker.instanceKey(tracker.instanceID)){
+		t.Errorf("the instance key was kept")
+	}
+	if ok, _ := server.SIsMember(tracker.instancesKey(), tracker.instanceID); ok{
+		t.Errorf("the instance is still registered")
+	}
+}
+
+// a user whose only connection was on a crashed instance ends up offline in the store too
+func TestLobbySweepsPresenceIntoTheStore(t *testing.T){
+	interval := presenceSweepInterval
+	presenceSweepInterval = 10 * time.Millisecond
+	t.Cleanup(func(){ presenceSweepInterval = interval })
+
+	server, client := newTestRedis(t)
+	store := NewMemoryStore()
+	userID, _ := store.CreateUser("gone", "hash")
+	viewerID, _ := store.CreateUser("viewer", "hash")
+
+	crashed := newTestTracker(t, client)
+	setPresence(t, crashed, userID, "a", PresenceOnline)
+	store.UpdateUserPresence(userID, PresenceOnline)
+	crashed.crash()
+
+	live := newTestTracker(t, client)
+	expireStoppedInstances(t, server, live)
+
+	lobby, err := NewLobby(store, NewInProcessFanOut(), live)
+	if err != nil{
+		t.Fatalf("NewLobby: %v", err)
+	}
+	go lobby.Run()
+	t.Cleanup(func(){ lobby.Shutdown(context.Background()) })
+
+	deadline := time.Now().Add(2 * time.Second)
+	for store.GetUserByUserID(userID).Presence != PresenceOffline{
+		if time.Now().After(deadline){
+			t.Fatalf("the user is still %s in the store", store.GetUserByUserID(userID).Presence)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, user := range store.GetAllOnlineUsers(viewerID){
+		if user.UserID == userID{
+			t.Errorf("the user is still listed online")
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"chat-app/constants"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (room Room) HasMember(userID string) bool{
+	for _, member := range room.Members{
+		if member == userID{
+			return true
+		}
+	}
+	return false
+}
+
+func (room Room) IsOwner(userID string) bool{
+	for _, owner := range room.Owners{
+		if owner == userID{
+			return true
+		}
+	}
+	return false
+}
+
+// copy returns the room with its own slices, so callers can't change a stored room
+func (room Room) copy() Room{
+	room.Owners = append([]string(nil), room.Owners...)
+	room.Members = append([]string(nil), room.Members...)
+	return room
+}
+
+// the owner first, then every other member once
+func uniqueMembers(ownerID string, memberIDs []string) []string{
+	members := []string{ownerID}
+	seen := map[string]bool{ownerID: true}
+
+	for _, memberID := range memberIDs{
+		if memberID != "" && !seen[memberID]{
+			seen[memberID] = true
+			members = append(members, memberID)
+		}
+	}
+	return members
+}
+
+func removeUserID(userIDs []string, userID string) []string{
+	var remaining []string
+	for _, id := range userIDs{
+		if id != userID{
+			remaining = append(remaining, id)
+		}
+	}
+	return remaining
+}
+
+// tells the room's members and the user who joined or left, eventName is room-member-added or room-member-removed
+func announceRoomMember(lobby *Lobby, room Room, eventName, userID string){
+	payload := SocketEvent{
+		EventName: eventName,
+		EventPayload: RoomMemberEvent{RoomID: room.ID, UserID: userID, Room: room},
+	}
+	emitToUsers(lobby, uniqueMembers(userID, room.Members), nil, func(string) SocketEvent{
+		return payload
+	})
+}
+
+func CreateRoom(store Store) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var requestPayload CreateRoomRequest
+
+		if err := c.ShouldBindJSON(&requestPayload); err != nil || strings.TrimSpace(requestPayload.Name) == ""{
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code:     http.StatusBadRequest,
+				Status:   http.StatusText(http.StatusBadRequest),
+				Message:  constants.RoomNameCantBeEmpty,
+				Response: nil,
+			})
+			return
+		}
+
+		// only registered users can be added
+		var memberIDs []string
+		for _, memberID := range requestPayload.Members{
+			if store.GetUserByUserID(memberID) != (UserDetails{}){
+				memberIDs = append(memberIDs, memberID)
+			}
+		}
+
+		room, err := store.CreateRoom(strings.TrimSpace(requestPayload.Name), AuthUserID(c), memberIDs)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code:     http.StatusInternalServerError,
+				Status:   http.StatusText(http.StatusInternalServerError),
+				Message:  constants.ServerFailedResponse,
+				Response: nil,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.RoomCreated,
+			Response: room,
+		})
+	}
+}
+
+func GetRooms(store RoomStore) gin.HandlerFunc{
+	return func(c *gin.Context){
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: store.GetRoomsByUserID(AuthUserID(c)),
+		})
+	}
+}
+
+// loads the room from the path and checks that the caller is a member, it aborts the request otherwise
+func roomForMember(c *gin.Context, store RoomStore) (Room, bool){
+	room := store.GetRoomByID(c.Param("roomID"))
+	if room.ID == ""{
+		c.AbortWithStatusJSON(http.StatusNotFound, APIResponse{
+			Code:     http.StatusNotFound,
+			Status:   http.StatusText(http.StatusNotFound),
+			Message:  constants.RoomDoesNotExist,
+			Response: nil,
+		})
+		return Room{}, false
+	}
+
+	if !room.HasMember(AuthUserID(c)){
+		c.AbortWithStatusJSON(http.StatusForbidden, APIResponse{
+			Code:     http.StatusForbidden,
+			Status:   http.StatusText(http.StatusForbidden),
+			Message:  constants.YouAreNotARoomMember,
+			Response: nil,
+		})
+		return Room{}, false
+	}
+	return room, true
+}
+
+func InviteRoomMember(store Store, lobby *Lobby) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var requestPayload InviteRoomMemberRequest
+
+		room, ok := roomForMember(c, store)
+		if !ok{
+			return
+		}
+
+		if !room.IsOwner(AuthUserID(c)){
+			c.JSON(http.StatusForbidden, APIResponse{
+				Code:     http.StatusForbidden,
+				Status:   http.StatusText(http.StatusForbidden),
+				Message:  constants.YouAreNotARoomOwner,
+				Response: nil,
+			})
+			return
+		}
+
+		if err := c.ShouldBindJSON(&requestPayload); err != nil || store.GetUserByUserID(requestPayload.UserID) == (UserDetails{}){
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code:     http.StatusBadRequest,
+				Status:   http.StatusText(http.StatusBadRequest),
+				Message:  constants.UserIsNotRegisteredWithUs,
+				Response: nil,
+			})
+			return
+		}
+
+		room, err := store.AddRoomMember(room.ID, requestPayload.UserID)
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code:     http.StatusInternalServerError,
+				Status:   http.StatusText(http.StatusInternalServerError),
+				Message:  err.Error(),
+				Response: nil,
+			})
+			return
+		}
+
+		announceRoomMember(lobby, room, "room-member-added", requestPayload.UserID)
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.RoomMemberInvited,
+			Response: room,
+		})
+	}
+}
+
+func LeaveRoom(store RoomStore, lobby *Lobby) gin.HandlerFunc{
+	return func(c *gin.Context){
+		room, ok := roomForMember(c, store)
+		if !ok{
+			return
+		}
+
+		room, err := store.RemoveRoomMember(room.ID, AuthUserID(c))
+		if err != nil{
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code:     http.StatusInternalServerError,
+				Status:   http.StatusText(http.StatusInternalServerError),
+				Message:  err.Error(),
+				Response: nil,
+			})
+			return
+		}
+
+		// the user's other devices drop the room too
+		announceRoomMember(lobby, room, "room-member-removed", AuthUserID(c))
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.RoomLeft,
+			Response: nil,
+		})
+	}
+}
+
+func GetRoomMessagesHandler(store Store) gin.HandlerFunc{
+	return func(c *gin.Context){
+		room, ok := roomForMember(c, store)
+		if !ok{
+			return
+		}
+
+		query, ok := conversationQueryFromRequest(c)
+		if !ok{
+			return
+		}
+
+		conversation := store.GetRoomConversation(room.ID, query)
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: withReactionCounts(conversation.Messages, AuthUserID(c)),
+			NextCursor: conversation.NextCursor,
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// the members and the invited user hear about the invite, and about leaving
+func TestRoomMembershipIsAnnounced(t *testing.T){
+	api := newTestAPI(t)
+	alice, bob, carol := api.register("alice"), api.register("bob"), api.register("carol")
+	room, err := api.store.CreateRoom("room", alice.UserID, []string{bob.UserID})
+	if err != nil{
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	server := serveTestSockets(t, api.lobby)
+
+	bobConn, carolConn := dialTestSocket(t, server, bob.UserID), dialTestSocket(t, server, carol.UserID)
+	readEvent(t, bobConn, "chatlist-response")
+	readEvent(t, carolConn, "chatlist-response")
+
+	readMemberEvent := func(eventType string) RoomMemberEvent{
+		var event RoomMemberEvent
+		for _, raw := range []json.RawMessage{readEvent(t, bobConn, eventType), readEvent(t, carolConn, eventType)}{
+			if err := json.Unmarshal(raw, &event); err != nil{
+				t.Fatalf("%s isn't JSON: %v", eventType, err)
+			}
+			if event.RoomID != room.ID || event.UserID != carol.UserID{
+				t.Errorf("%s: got %+v", eventType, event)
+			}
+		}
+		return event
+	}
+
+	status, response := call[Room](api, http.MethodPost, "/rooms/"+room.ID+"/invite", alice.AccessToken, InviteRoomMemberRequest{UserID: carol.UserID})
+	if status != http.StatusOK{
+		t.Fatalf("invite: got %d %s", status, response.Message)
+	}
+	if added := readMemberEvent("room-member-added"); !added.Room.HasMember(carol.UserID){
+		t.Errorf("the room of room-member-added misses carol: %+v", added.Room)
+	}
+
+	status, response = call[Room](api, http.MethodPost, "/rooms/"+room.ID+"/leave", carol.AccessToken, nil)
+	if status != http.StatusOK{
+		t.Fatalf("leave: got %d %s", status, response.Message)
+	}
+	if removed := readMemberEvent("room-member-removed"); removed.Room.HasMember(carol.UserID){
+		t.Errorf("the room of room-member-removed still has carol: %+v", removed.Room)
+	}
+}
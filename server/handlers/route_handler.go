@@ -1,10 +1,8 @@
 package handlers
 
 import (
-	"log"
 	"net/http"
 	"regexp"
-	"strconv"
 
 	"chat-app/constants"
 
@@ -22,7 +20,7 @@ func RenderHome() gin.HandlerFunc{
 	}
 }
 
-func IsUsernameAvailable() gin.HandlerFunc{
+func IsUsernameAvailable(store UserStore) gin.HandlerFunc{
 	return func(c *gin.Context){
 		type usernameAvailable struct{
 			IsUsernameAvailable bool `json:"isUsernameAvailable"`
@@ -41,7 +39,7 @@ func IsUsernameAvailable() gin.HandlerFunc{
 			return
 		}
 
-		isUsernameAvailable := IsUsernameAvailableQueryHandler(username)
+		isUsernameAvailable := IsUsernameAvailableQueryHandler(store, username)
 		if isUsernameAvailable{
 			c.JSON(http.StatusOK, APIResponse{
 				Code: http.StatusOK,
@@ -64,7 +62,7 @@ func IsUsernameAvailable() gin.HandlerFunc{
 	}
 }
 
-func Login() gin.HandlerFunc{
+func Login(store Store) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var userDetails LoginRequest
 
@@ -85,19 +83,20 @@ func Login() gin.HandlerFunc{
 				Message:  constants.UsernameCantBeEmpty,
 				Response: nil,
 			})
+			return
 		}
 
 		if userDetails.Password == "" {
-			c.JSON(http.StatusInternalServerError, APIResponse{
-				Code:     http.StatusInternalServerError,
-				Status:   http.StatusText(http.StatusInternalServerError),
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code:     http.StatusBadRequest,
+				Status:   http.StatusText(http.StatusBadRequest),
 				Message:  constants.PasswordCantBeEmpty,
 				Response: nil,
 			})
-	
+			return
 		}
 
-		userDetailsResponse, loginErrorMessage :=  LoginQueryHandler(userDetails)
+		userDetailsResponse, loginErrorMessage :=  LoginQueryHandler(store, userDetails)
 
 		if loginErrorMessage != nil {
 			c.JSON(http.StatusNotFound, APIResponse{
@@ -109,17 +108,28 @@ func Login() gin.HandlerFunc{
 			return
 		}
 
+		authResponse, tokenErr := NewAuthResponse(store, userDetailsResponse.UserID, userDetailsResponse.Username)
+		if tokenErr != nil{
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code:     http.StatusInternalServerError,
+				Status:   http.StatusText(http.StatusInternalServerError),
+				Message:  constants.ServerFailedResponse,
+				Response: nil,
+			})
+			return
+		}
+
 		// succesfil login
 		c.JSON(http.StatusOK, APIResponse{
 			Code: http.StatusOK,
 			Status: http.StatusText(http.StatusOK),
 			Message: constants.UserLoginCompleted,
-			Response: userDetailsResponse,
+			Response: authResponse,
 		})
 	}
 }
 
-func Registration() gin.HandlerFunc{
+func Registration(store Store) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var requestPayload RegistrationRequest
 
@@ -153,7 +163,7 @@ func Registration() gin.HandlerFunc{
 			return
 		}
 
-		userObjectID, registrationErr := RegisterQueryHandler(requestPayload)
+		userObjectID, registrationErr := RegisterQueryHandler(store, requestPayload)
 		if registrationErr != nil{
 			c.JSON(http.StatusInternalServerError, APIResponse{
 				Code:     http.StatusInternalServerError,
@@ -164,19 +174,27 @@ func Registration() gin.HandlerFunc{
 			return
 		}
 
+		authResponse, tokenErr := NewAuthResponse(store, userObjectID, requestPayload.Username)
+		if tokenErr != nil{
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code:     http.StatusInternalServerError,
+				Status:   http.StatusText(http.StatusInternalServerError),
+				Message:  constants.ServerFailedResponse,
+				Response: nil,
+			})
+			return
+		}
+
 		c.JSON(http.StatusOK, APIResponse{
 			Code:     http.StatusOK,
 			Status:   http.StatusText(http.StatusOK),
 			Message:  constants.UserRegistrationCompleted,
-			Response: UserResponse{
-				Username: requestPayload.Username,
-				UserID: userObjectID,
-			},
+			Response: authResponse,
 		})
 	}
 }
 
-func UserSessionCheck() gin.HandlerFunc{
+func UserSessionCheck(store UserStore) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var IsAlphaNumeric = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_-]*[A-Za-z0-9])?$`).MatchString
 		uid := c.Param("userID")
@@ -191,7 +209,13 @@ func UserSessionCheck() gin.HandlerFunc{
 			return
 		}
 
-		userDetails := GetUserByUserID(uid)
+		// a token only proves who its owner is, not anyone else's session
+		if uid != AuthUserID(c){
+			abortForbidden(c)
+			return
+		}
+
+		userDetails := store.GetUserByUserID(uid)
 		if userDetails == (UserDetails{}){
 			c.JSON(http.StatusOK, APIResponse{
 				Code:     http.StatusOK,
@@ -202,16 +226,106 @@ func UserSessionCheck() gin.HandlerFunc{
 			return
 		}
 
+		// AuthMiddleware already checked that the session is active
 		c.JSON(http.StatusOK, APIResponse{
 			Code: http.StatusOK,
 			Status: http.StatusText(http.StatusOK),
 			Message: constants.YouAreLoggedIN,
-			Response: userDetails.Online == "Y",
+			Response: true,
+		})
+	}
+}
+
+func RefreshToken(store Store) gin.HandlerFunc{
+	return func(c *gin.Context){
+		var requestPayload RefreshTokenRequest
+
+		if err := c.ShouldBindJSON(&requestPayload); err != nil{
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Code:     http.StatusBadRequest,
+				Status:   http.StatusText(http.StatusBadRequest),
+				Message:  constants.RefreshTokenIsInvalid,
+				Response: nil,
+			})
+			return
+		}
+
+		authResponse, refreshErr := RefreshQueryHandler(store, requestPayload.RefreshToken)
+		if refreshErr != nil{
+			c.JSON(http.StatusUnauthorized, APIResponse{
+				Code:     http.StatusUnauthorized,
+				Status:   http.StatusText(http.StatusUnauthorized),
+				Message:  refreshErr.Error(),
+				Response: nil,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SessionRefreshCompleted,
+			Response: authResponse,
+		})
+	}
+}
+
+// revokes the current session and closes the sockets opened with it
+func Logout(store Store, lobby *Lobby) gin.HandlerFunc{
+	return func(c *gin.Context){
+		userID := AuthUserID(c)
+		sessionID := AuthSessionID(c)
+
+		if err := store.RevokeSession(sessionID); err != nil{
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code:     http.StatusInternalServerError,
+				Status:   http.StatusText(http.StatusInternalServerError),
+				Message:  constants.ServerFailedResponse,
+				Response: nil,
+			})
+			return
+		}
+
+		// closing the sockets updates presence like any other disconnect
+		lobby.CloseSessions(userID, sessionID)
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.UserLogoutCompleted,
+			Response: nil,
 		})
 	}
 }
 
-func GetMessagesHandler() gin.HandlerFunc{
+// revokes every session of the user and closes all their sockets
+func LogoutAllDevices(store Store, lobby *Lobby) gin.HandlerFunc{
+	return func(c *gin.Context){
+		userID := AuthUserID(c)
+
+		if err := store.RevokeAllUserSessions(userID); err != nil{
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Code:     http.StatusInternalServerError,
+				Status:   http.StatusText(http.StatusInternalServerError),
+				Message:  constants.ServerFailedResponse,
+				Response: nil,
+			})
+			return
+		}
+
+		// closing the sockets updates presence like any other disconnect
+		lobby.CloseSessions(userID, "")
+
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.UserLogoutAllCompleted,
+			Response: nil,
+		})
+	}
+}
+
+func GetMessagesHandler(store MessageStore) gin.HandlerFunc{
 	return func(c *gin.Context){
 		var IsAlphaNumeric = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_-]*[A-Za-z0-9])?$`).MatchString
 		toUserID := c.Param("toUserID")
@@ -235,18 +349,25 @@ func GetMessagesHandler() gin.HandlerFunc{
 			return
 		}
 
-		page, err := strconv.Atoi(c.Query("page"))
-		if err != nil || page < 1{
-			log.Panic(err)
+		// only the participants may read a conversation
+		authUserID := AuthUserID(c)
+		if authUserID != toUserID && authUserID != fromUserID{
+			abortForbidden(c)
+			return
+		}
+
+		query, ok := conversationQueryFromRequest(c)
+		if !ok{
+			return
 		}
-		var pagee int64 = int64(page)
 
-		conversations := GetConversationBetweenTwoUsers(toUserID, fromUserID, pagee)
+		conversation := store.GetConversationBetweenTwoUsers(toUserID, fromUserID, query)
 		c.JSON(http.StatusOK, APIResponse{
 			Code:     http.StatusOK,
 			Status:   http.StatusText(http.StatusOK),
 			Message:  constants.SuccessfulResponse,
-			Response: conversations,
+			Response: withReactionCounts(conversation.Messages, authUserID),
+			NextCursor: conversation.NextCursor,
 		})
 	}
 }
\ No newline at end of file
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"chat-app/config"
+	"chat-app/constants"
+	"chat-app/utils"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the REST routes of the server on a MemoryStore, with a signing secret and the cheapest hashing
+type testAPI struct{
+	t      *testing.T
+	router *gin.Engine
+	store  *MemoryStore
+	lobby  *Lobby
+}
+
+func newTestAPI(t *testing.T) *testAPI{
+	t.Helper()
+	settings := config.Default()
+	settings.Auth.JWTSecret = "test secret"
+	settings.Auth.BcryptCost = bcrypt.MinCost
+	utils.Configure(settings)
+	t.Cleanup(func(){ utils.Configure(config.Default()) })
+
+	store := NewMemoryStore()
+	lobby, err := NewLobby(store, NewInProcessFanOut(), NewMemoryPresenceTracker())
+	if err != nil{
+		t.Fatalf("NewLobby: %v", err)
+	}
+	go lobby.Run()
+	t.Cleanup(func(){ lobby.Shutdown(context.Background()) })
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/login", Login(store))
+	router.POST("/registration", Registration(store))
+	router.POST("/refreshToken", RefreshToken(store))
+
+	authorized := router.Group("/")
+	authorized.Use(AuthMiddleware(store))
+	authorized.POST("/logout", Logout(store, lobby))
+	authorized.GET("/getConversation/:toUserID/:fromUserID", GetMessagesHandler(store))
+	authorized.GET("/conversations", GetConversations(store))
+	authorized.GET("/messages/search", SearchMessages(store))
+	authorized.PATCH("/messages/:messageID", EditMessage(store, lobby))
+	authorized.DELETE("/messages/:messageID", DeleteMessage(store, lobby))
+	authorized.POST("/rooms/:roomID/invite", InviteRoomMember(store, lobby))
+	authorized.POST("/rooms/:roomID/leave", LeaveRoom(store, lobby))
+
+	return &testAPI{t: t, router: router, store: store, lobby: lobby}
+}
+
+type testResponse[T any] struct{
+	Message    string `json:"message"`
+	Response   T      `json:"response"`
+	NextCursor string `json:"nextCursor"`
+}
+
+// sends body as JSON with the access token, when there is one, and decodes the response
+func call[T any](api *testAPI, method, path, token string, body any) (int, testResponse[T]){
+	api.t.Helper()
+	var encoded bytes.Buffer
+	if body != nil{
+		json.NewEncoder(&encoded).Encode(body)
+	}
+	request := httptest.NewRequest(method, path, &encoded)
+	request.Header.Set("Content-Type", "application/json")
+	if token != ""{
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	recorder := httptest.NewRecorder()
+	api.router.ServeHTTP(recorder, request)
+
+	var response testResponse[T]
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil{
+		api.t.Fatalf("%s %s: the response isn't JSON: %s", method, path, recorder.Body)
+	}
+	return recorder.Code, response
+}
+
+func (api *testAPI) register(username string) AuthResponse{
+	api.t.Helper()
+	status, response := call[AuthResponse](api, http.MethodPost, "/registration", "", RegistrationRequest{Username: username, Password: "password"})
+	if status != http.StatusOK{
+		api.t.Fatalf("registration of %s: got %d %s", username, status, response.Message)
+	}
+	return response.Response
+}
+
+func TestRegistrationLoginAndRefresh(t *testing.T){
+	api := newTestAPI(t)
+	alice := api.register("alice")
+
+	if status, _ := call[any](api, http.MethodPost, "/registration", "", RegistrationRequest{Username: "alice", Password: "other"}); status == http.StatusOK{
+		t.Errorf("a taken username was registered again")
+	}
+	if status, _ := call[any](api, http.MethodPost, "/login", "", LoginRequest{Username: "alice", Password: "wrong"}); status == http.StatusOK{
+		t.Errorf("a wrong password logged in")
+	}
+	if status, _ := call[any](api, http.MethodPost, "/login", "", LoginRequest{Username: "alice"}); status != http.StatusBadRequest{
+		t.Errorf("a login without a password: got %d, want 400", status)
+	}
+	status, login := call[AuthResponse](api, http.MethodPost, "/login", "", LoginRequest{Username: "alice", Password: "password"})
+	if status != http.StatusOK || login.Response.UserID != alice.UserID || login.Response.AccessToken == ""{
+		t.Fatalf("login: got %d %+v", status, login)
+	}
+
+	// the refresh token of the session is replaced, the old one stops working
+	status, refreshed := call[AuthResponse](api, http.MethodPost, "/refreshToken", "", RefreshTokenRequest{RefreshToken: login.Response.RefreshToken})
+	if status != http.StatusOK || refreshed.Response.RefreshToken == login.Response.RefreshToken{
+		t.Fatalf("refresh: got %d %+v", status, refreshed)
+	}
+	if status, _ := call[any](api, http.MethodPost, "/refreshToken", "", RefreshTokenRequest{RefreshToken: login.Response.RefreshToken}); status != http.StatusUnauthorized{
+		t.Errorf("a used refresh token: got %d, want 401", status)
+	}
+}
+
+func TestLogoutRevokesTheAccessToken(t *testing.T){
+	api := newTestAPI(t)
+	alice := api.register("alice")
+
+	if status, _ := call[any](api, http.MethodGet, "/conversations", "", nil); status != http.StatusUnauthorized{
+		t.Errorf("without a token: got %d, want 401", status)
+	}
+	if status, _ := call[any](api, http.MethodGet, "/conversations", "not a token", nil); status != http.StatusUnauthorized{
+		t.Errorf("with a broken token: got %d, want 401", status)
+	}
+
+	_, second := call[AuthResponse](api, http.MethodPost, "/login", "", LoginRequest{Username: "alice", Password: "password"})
+	if status, _ := call[any](api, http.MethodPost, "/logout", alice.AccessToken, nil); status != http.StatusOK{
+		t.Fatalf("logout: got %d", status)
+	}
+	if status, _ := call[any](api, http.MethodGet, "/conversations", alice.AccessToken, nil); status != http.StatusUnauthorized{
+		t.Errorf("the token of the revoked session: got %d, want 401", status)
+	}
+	if status, _ := call[any](api, http.MethodGet, "/conversations", second.Response.AccessToken, nil); status != http.StatusOK{
+		t.Errorf("the token of another session: got %d, want 200", status)
+	}
+}
+
+func TestGetConversationPages(t *testing.T){
+	api := newTestAPI(t)
+	alice, bob, carol := api.register("alice"), api.register("bob"), api.register("carol")
+
+	var sent []string
+	for i := 0; i < 5; i++{
+		message, _ := storeTestMessage(t, api.store, MessagePayload{FromUserID: alice.UserID, ToUserID: bob.UserID, Message: fmt.Sprint(i)}, bob.UserID, alice.UserID)
+		sent = append(sent, message.ID)
+	}
+	path := "/getConversation/" + bob.UserID + "/" + alice.UserID
+
+	var got []string
+	cursor := ""
+	for page := 0; page < 3; page++{
+		status, response := call[[]Message](api, http.MethodGet, path+"?limit=2"+cursor, bob.AccessToken, nil)
+		if status != http.StatusOK{
+			t.Fatalf("page %d: got %d %s", page, status, response.Message)
+		}
+		got = append(messageIDs(response.Response), got...)
+		if response.NextCursor == ""{
+			break
+		}
+		cursor = "&before=" + response.NextCursor
+	}
+	if fmt.Sprint(got) != fmt.Sprint(sent){
+		t.Errorf("paged through %v, want %v", got, sent)
+	}
+
+	for _, query := range []string{"?limit=0", "?before=x&after=y", "?before=%21%21"}{
+		if status, _ := call[any](api, http.MethodGet, path+query, bob.AccessToken, nil); status != http.StatusBadRequest{
+			t.Errorf("%s: got %d, want 400", query, status)
+		}
+	}
+	if status, response := call[any](api, http.MethodGet, path, carol.AccessToken, nil); status != http.StatusForbidden || response.Message != constants.YouAreNotAllowed{
+		t.Errorf("someone else's conversation: got %d %s", status, response.Message)
+	}
+}
@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bodies of unknown size go up in parts of this size, S3 wants at least 5 MiB in every part but the last
+const s3PartSize = 8 << 20
+
+// S3Config points at a bucket of S3 or of an S3 compatible server like MinIO
+type S3Config struct {
+	// Endpoint is the base URL, like https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3BlobStore keeps the blobs as objects of one bucket. It talks to the REST API with path style
+// URLs and signature version 4, which is what every S3 compatible server understands.
+type S3BlobStore struct{
+	config S3Config
+	client *http.Client
+}
+
+func NewS3BlobStore(config S3Config) (*S3BlobStore, error){
+	if config.Endpoint == "" || config.Bucket == "" || config.AccessKeyID == "" || config.SecretAccessKey == ""{
+		return nil, errors.New("the S3 endpoint, bucket and credentials must be set")
+	}
+	if config.Region == ""{
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+
+	// no overall timeout, the contexts bound each request and large files take a while
+	return &S3BlobStore{config: config, client: &http.Client{}}, nil
+}
+
+func (blobs *S3BlobStore) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error){
+	if !blobKeyPattern.MatchString(key){
+		return nil, errBlobKeyIsInvalid
+	}
+	target := blobs.config.Endpoint+"/"+blobs.config.Bucket+"/"+key
+	if len(query) > 0{
+		target += "?" + query.Encode()
+	}
+	return http.NewRequestWithContext(ctx, method, target, body)
+}
+
+// sends the signed request and turns an error status into an error, the caller closes the body
+func (blobs *S3BlobStore) do(request *http.Request) (*http.Response, error){
+	// the body is streamed, so it isn't part of the signature
+	signS3Request(request, blobs.config, "UNSIGNED-PAYLOAD", time.Now())
+
+	response, err := blobs.client.Do(request)
+	if err != nil{
+		return nil, err
+	}
+	if response.StatusCode >= 300{
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotFound{
+			return nil, ErrBlobNotFound
+		}
+		detail, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s %s", request.Method, request.URL.Path, response.Status, detail)
+	}
+	return response, nil
+}
+
+// sends the request and decodes the XML of the response into result, S3 reports some errors
+// in the body of a 200 response
+func (blobs *S3BlobStore) doXML(request *http.Request, result any) error{
+	response, err := blobs.do(request)
+	if err != nil{
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil{
+		return err
+	}
+	var failure struct{
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &failure) == nil && failure.XMLName.Local == "Error"{
+		return fmt.Errorf("%s %s: %s %s", request.Method, request.URL.Path, failure.Code, failure.Message)
+	}
+	return xml.Unmarshal(body, result)
+}
+
+// S3 needs the length of an object up front, a body of unknown size that fits in one part is
+// read first and stored as is, a larger one goes up in a multipart upload
+func (blobs *S3BlobStore) Put(ctx context.Context, key, contentType string, body io.Reader, size int64) error{
+	if size >= 0{
+		return blobs.putObject(ctx, key, contentType, io.LimitReader(body, size), size)
+	}
+
+	part := make([]byte, s3PartSize)
+	n, err := io.ReadFull(body, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF{
+		return blobs.putObject(ctx, key, contentType, bytes.NewReader(part[:n]), int64(n))
+	}
+	if err != nil{
+		return err
+	}
+	return blobs.putMultipart(ctx, key, contentType, part, body)
+}
+
+func (blobs *S3BlobStore) putObject(ctx context.Context, key, contentType string, body io.Reader, size int64) error{
+	// an empty body would otherwise be sent chunked, which S3 refuses without a length
+	if size == 0{
+		body = http.NoBody
+	}
+	request, err := blobs.newRequest(ctx, http.MethodPut, key, nil, body)
+	if err != nil{
+		return err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", contentType)
+
+	response, err := blobs.do(request)
+	if err != nil{
+		return err
+	}
+	return response.Body.Close()
+}
+
+type s3CompletedPart struct{
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct{
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// uploads the full buffer part and the rest of body in parts of its size. An upload that fails
+// is aborted, S3 would otherwise keep its parts around.
+func (blobs *S3BlobStore) putMultipart(ctx context.Context, key, contentType string, part []byte, rest io.Reader) (err error){
+	request, err := blobs.newRequest(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil{
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+
+	var initiated struct{
+		UploadID string `xml:"UploadId"`
+	}
+	if err := blobs.doXML(request, &initiated); err != nil{
+		return err
+	}
+	defer func(){
+		if err != nil{
+			blobs.abortMultipart(key, initiated.UploadID)
+		}
+	}()
+
+	buffer := part
+	completed := s3CompleteMultipartUpload{}
+	for number := 1; len(part) > 0; number++{
+		etag, err := blobs.putPart(ctx, key, initiated.UploadID, number, part)
+		if err != nil{
+			return err
+		}
+		completed.Parts = append(completed.Parts, s3CompletedPart{PartNumber: number, ETag: etag})
+
+		n, err := io.ReadFull(rest, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF{
+			return err
+		}
+		part = buffer[:n]
+	}
+
+	payload, err := xml.Marshal(completed)
+	if err != nil{
+		return err
+	}
+	request, err = blobs.newRequest(ctx, http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, bytes.NewReader(payload))
+	if err != nil{
+		return err
+	}
+	request.Header.Set("Content-Type", "application/xml")
+	return blobs.doXML(request, &struct{}{})
+}
+
+// returns the ETag the part must be listed with when the upload completes
+func (blobs *S3BlobStore) putPart(ctx context.Context, key, uploadID string, number int, part []byte) (string, error){
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	request, err := blobs.newRequest(ctx, http.MethodPut, key, query, bytes.NewReader(part))
+	if err != nil{
+		return "", err
+	}
+
+	response, err := blobs.do(request)
+	if err != nil{
+		return "", err
+	}
+	defer response.Body.Close()
+	return response.Header.Get("ETag"), nil
+}
+
+// runs even when the upload failed because its context was canceled
+func (blobs *S3BlobStore) abortMultipart(key, uploadID string){
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	request, err := blobs.newRequest(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil)
+	if err == nil{
+		var response *http.Response
+		if response, err = blobs.do(request); err == nil{
+			response.Body.Close()
+		}
+	}
+	if err != nil{
+		slog.Error("Failed to abort the multipart upload of blob", "key", key, "error", err)
+	}
+}
+
+func (blobs *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error){
+	request, err := blobs.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil{
+		return nil, err
+	}
+
+	response, err := blobs.do(request)
+	if err != nil{
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (blobs *S3BlobStore) Delete(ctx context.Context, key string) error{
+	request, err := blobs.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil{
+		return err
+	}
+
+	response, err := blobs.do(request)
+	if errors.Is(err, ErrBlobNotFound){
+		return nil
+	}
+	if err != nil{
+		return err
+	}
+	return response.Body.Close()
+}
+
+func hmacSHA256(key []byte, data string) []byte{
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// encodes every byte except the unreserved characters, like S3 expects in canonical requests
+func s3Escape(value string, keepSlash bool) string{
+	var escaped strings.Builder
+	for _, b := range []byte(value){
+		switch{
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '.', b == '_', b == '~', b == '/' && keepSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func canonicalS3Query(query url.Values) string{
+	var pairs []string
+	for key, values := range query{
+		for _, value := range values{
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// adds the signature version 4 headers, every header already set on the request is signed
+func signS3Request(request *http.Request, config S3Config, payloadHash string, now time.Time){
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header{
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers{
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names{
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3Escape(request.URL.Path, true),
+		canonicalS3Query(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+config.SecretAccessKey), date)
+	key = hmacSHA256(key, config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+config.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"chat-app/constants"
+
+	"github.com/gin-gonic/gin"
+)
+
+// longest search text, in characters
+const maxSearchLength = 200
+
+// the words of a search to highlight, negated words and quotes of phrases are left out
+func searchTerms(text string) []string{
+	var terms []string
+	for _, word := range strings.Fields(text){
+		if strings.HasPrefix(word, "-"){
+			continue
+		}
+		if word = strings.Trim(word, `"`); word != ""{
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+func lowerRunes(text string) []rune{
+	runes := []rune(text)
+	for i, r := range runes{
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+// true when the message contains text, ignoring case
+func containsText(message, text string) bool{
+	return strings.Contains(string(lowerRunes(message)), string(lowerRunes(text)))
+}
+
+// cuts the message into segments, marking every case-insensitive occurrence of the terms
+func highlight(message string, terms []string) []HighlightSegment{
+	text := []rune(message)
+	lowered := lowerRunes(message)
+	matched := make([]bool, len(text))
+
+	for _, term := range terms{
+		needle := lowerRunes(term)
+		for i := 0; i+len(needle) <= len(lowered); i++{
+			if string(lowered[i:i+len(needle)]) == string(needle){
+				for j := i; j < i+len(needle); j++{
+					matched[j] = true
+				}
+			}
+		}
+	}
+
+	segments := []HighlightSegment{}
+	for start := 0; start < len(text);{
+		end := start
+		for end < len(text) && matched[end] == matched[start]{
+			end++
+		}
+		segments = append(segments, HighlightSegment{Text: string(text[start:end]), Match: matched[start]})
+		start = end
+	}
+	return segments
+}
+
+// SearchQueryHandler searches the user's conversations and returns the results newest first,
+// with the cursor of the next page when there are more
+func SearchQueryHandler(store Store, query SearchQuery) ([]SearchResult, string){
+	// a search with another user only looks at the direct conversation with them
+	if query.WithUserID == ""{
+		for _, room := range store.GetRoomsByUserID(query.UserID){
+			query.RoomIDs = append(query.RoomIDs, room.ID)
+		}
+	}
+
+	messages := withReactionCounts(store.SearchMessages(query), query.UserID)
+
+	var nextCursor string
+	if int64(len(messages)) > query.Limit{
+		messages = messages[:query.Limit]
+		nextCursor = EncodeCursor(messages[len(messages)-1])
+	}
+
+	terms := searchTerms(query.Text)
+	results := make([]SearchResult, 0, len(messages))
+	for _, message := range messages{
+		conversationID, peerID := conversationOf(message, query.UserID)
+
+		path := "/rooms/" + message.RoomID + "/messages"
+		switch{
+		case message.ThreadID != "":
+			path = "/messages/" + message.ThreadID + "/thread"
+		case message.RoomID == "":
+			path = "/getConversation/" + peerID + "/" + query.UserID
+		}
+
+		results = append(results, SearchResult{
+			Message: message,
+			Highlights: highlight(message.Message, terms),
+			ConversationID: conversationID,
+			ConversationPath: path,
+			Cursor: EncodeInclusiveCursor(message),
+		})
+	}
+	return results, nextCursor
+}
+
+// reads the search from the query string, it aborts the request when it's invalid
+func searchQueryFromRequest(c *gin.Context) (SearchQuery, bool){
+	query := SearchQuery{
+		UserID: AuthUserID(c),
+		Text: strings.TrimSpace(c.Query("q")),
+		WithUserID: c.Query("with"),
+		FromUserID: c.Query("from"),
+		Limit: defaultConversationLimit,
+	}
+
+	badRequest := func(message string) (SearchQuery, bool){
+		c.AbortWithStatusJSON(http.StatusBadRequest, APIResponse{
+			Code:     http.StatusBadRequest,
+			Status:   http.StatusText(http.StatusBadRequest),
+			Message:  message,
+			Response: nil,
+		})
+		return SearchQuery{}, false
+	}
+
+	if query.Text == "" || utf8.RuneCountInString(query.Text) > maxSearchLength{
+		return badRequest(constants.SearchTextIsInvalid)
+	}
+
+	if limit := c.Query("limit"); limit != ""{
+		value, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || value < 1 || value > maxConversationLimit{
+			return badRequest(constants.LimitIsInvalid)
+		}
+		query.Limit = value
+	}
+
+	var err error
+	if before := c.Query("before"); before != ""{
+		if query.Before, err = DecodeCursor(before); err != nil{
+			return badRequest(err.Error())
+		}
+	}
+
+	if since := c.Query("since"); since != ""{
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil{
+			return badRequest(constants.SearchDateIsInvalid)
+		}
+	}
+	if until := c.Query("until"); until != ""{
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil{
+			return badRequest(constants.SearchDateIsInvalid)
+		}
+	}
+	return query, true
+}
+
+// SearchMessages searches the messages of every conversation the user belongs to
+func SearchMessages(store Store) gin.HandlerFunc{
+	return func(c *gin.Context){
+		query, ok := searchQueryFromRequest(c)
+		if !ok{
+			return
+		}
+
+		results, nextCursor := SearchQueryHandler(store, query)
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: results,
+			NextCursor: nextCursor,
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// the cursor of a result opens its conversation at the message that matched
+func TestSearchResultLinksToTheHit(t *testing.T){
+	api := newTestAPI(t)
+	alice, bob := api.register("alice"), api.register("bob")
+
+	var hit Message
+	for i := 0; i < 5; i++{
+		text := fmt.Sprint("message ", i)
+		if i == 2{
+			text = "the needle"
+		}
+		message, _ := storeTestMessage(t, api.store, MessagePayload{FromUserID: alice.UserID, ToUserID: bob.UserID, Message: text}, bob.UserID, alice.UserID)
+		if i == 2{
+			hit = message
+		}
+	}
+
+	status, found := call[[]SearchResult](api, http.MethodGet, "/messages/search?q=needle", bob.AccessToken, nil)
+	if status != http.StatusOK || len(found.Response) != 1 || found.Response[0].Message.ID != hit.ID{
+		t.Fatalf("search: got %d %+v", status, found)
+	}
+	result := found.Response[0]
+
+	status, before := call[[]Message](api, http.MethodGet, result.ConversationPath+"?limit=2&before="+result.Cursor, bob.AccessToken, nil)
+	if ids := messageIDs(before.Response); status != http.StatusOK || len(ids) != 2 || ids[1] != hit.ID{
+		t.Errorf("the page before the cursor: got %d %v, want it to end with %s", status, ids, hit.ID)
+	}
+	status, after := call[[]Message](api, http.MethodGet, result.ConversationPath+"?limit=2&after="+result.Cursor, bob.AccessToken, nil)
+	if ids := messageIDs(after.Response); status != http.StatusOK || len(ids) != 2 || ids[0] != hit.ID{
+		t.Errorf("the page after the cursor: got %d %v, want it to start with %s", status, ids, hit.ID)
+	}
+
+	// the pages go on from there without the hit
+	status, older := call[[]Message](api, http.MethodGet, result.ConversationPath+"?before="+before.NextCursor, bob.AccessToken, nil)
+	if ids := messageIDs(older.Response); status != http.StatusOK || len(ids) != 1{
+		t.Errorf("the page before that: got %d %v", status, ids)
+	}
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"time"
+
+	"chat-app/config"
+)
+
+// the defaults hold until main configures the package
+func init(){
+	Configure(config.Default())
+}
+
+// Configure applies the settings of the config, it must run before the Lobby is created
+func Configure(settings config.Config){
+	writeWait = time.Duration(settings.Socket.WriteWait)
+	pongWait = time.Duration(settings.Socket.PongWait)
+	pingPeriod = (pongWait * 9) / 10
+	maxMessageSize = settings.Socket.MaxMessageSize
+	sendBufferSize = settings.Socket.SendBufferSize
+	resumeBatchSize = settings.Socket.ResumeBatchSize
+	emitBufferSize = settings.Socket.EmitBufferSize
+	typingTimeout = time.Duration(settings.Socket.TypingTimeout)
+	Upgrader.ReadBufferSize = settings.Socket.ReadBufferSize
+	Upgrader.WriteBufferSize = settings.Socket.WriteBufferSize
+
+	defaultConversationLimit = settings.Messages.PageSize
+	maxConversationLimit = settings.Messages.MaxPageSize
+}
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"chat-app/constants"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// ProtocolVersion is the version of the socket envelope the server speaks
+const ProtocolVersion = 1
+
+// codes of the error event
+const (
+	ErrCodeMalformedEvent     = "malformed-event"
+	ErrCodeUnsupportedVersion = "unsupported-version"
+	ErrCodeUnknownEvent       = "unknown-event"
+	ErrCodeInvalidPayload     = "invalid-payload"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeNotFound           = "not-found"
+	ErrCodeInternal           = "internal-error"
+)
+
+// handles one event type, it decodes its own payload and returns an error for the client if it fails
+type socketEventHandler func(client *Client, request SocketEnvelope) *SocketError
+
+var socketEventHandlers = map[string]socketEventHandler{
+	"join":         handleJoinEvent,
+	"disconnect":   handleDisconnectEvent,
+	"presence":     handlePresenceRequestEvent,
+	"message":      handleMessageEvent,
+	"resume":       handleResumeEvent,
+	"typing-start": handleTypingStartEvent,
+	"typing-stop":  handleTypingStopEvent,
+	"read":         handleReadEvent,
+
+	"message-edit":   handleMessageEditEvent,
+	"message-delete": handleMessageDeleteEvent,
+
+	"reaction-add":    handleReactionAddEvent,
+	"reaction-remove": handleReactionRemoveEvent,
+}
+
+func (err *SocketError) Error() string{
+	return err.Code + ": " + err.Message
+}
+
+func newSocketError(code, message string) *SocketError{
+	return &SocketError{Code: code, Message: message}
+}
+
+// a request payload that checks its own fields after decoding
+type socketPayload interface {
+	Validate() error
+}
+
+// decodes the request's payload into the handler's struct and validates it
+func decodePayload(request SocketEnvelope, payload socketPayload) *SocketError{
+	if len(request.Payload) == 0 || string(request.Payload) == "null"{
+		return newSocketError(ErrCodeInvalidPayload, constants.PayloadIsMissing)
+	}
+	if err := json.Unmarshal(request.Payload, payload); err != nil{
+		return newSocketError(ErrCodeInvalidPayload, err.Error())
+	}
+	if err := payload.Validate(); err != nil{
+		return newSocketError(ErrCodeInvalidPayload, err.Error())
+	}
+	return nil
+}
+
+// HandleSocketPayloadEvents decodes one frame from the client and runs the handler of its type,
+// anything that goes wrong is answered with an error event instead of dropping the connection
+func HandleSocketPayloadEvents(ctx context.Context, client *Client, data []byte){
+	start := time.Now()
+
+	ctx, span := startChildSpan(ctx, "socket.event")
+	defer span.End()
+
+	request := SocketEnvelope{ctx: ctx}
+	err := runSocketEvent(client, data, &request)
+	observeSocketEvent(request.Type, err)
+
+	span.SetName(socketEventSpanName(request.Type))
+	span.SetAttributes(attribute.String("chat.event", request.Type), attribute.String("chat.event_request_id", request.RequestID))
+	if err != nil{
+		span.SetStatus(codes.Error, err.Code)
+	}
+
+	// the client's logger already carries the userID
+	attrs := []slog.Attr{
+		slog.String("event", request.Type),
+		slog.String("eventRequestId", request.RequestID),
+		slog.Duration("latency", time.Since(start)),
+	}
+	if err != nil{
+		client.log.LogAttrs(context.Background(), slog.LevelWarn, "Socket event failed", append(attrs, slog.String("code", err.Code))...)
+		sendSocketError(client, request.RequestID, err)
+		return
+	}
+	client.log.LogAttrs(context.Background(), slog.LevelInfo, "Socket event", attrs...)
+}
+
+// decodes the frame into request and runs the handler of its type
+func runSocketEvent(client *Client, data []byte, request *SocketEnvelope) *SocketError{
+	if err := json.Unmarshal(data, request); err != nil || request.Type == ""{
+		// nothing of a malformed frame is echoed back
+		*request = SocketEnvelope{ctx: request.ctx}
+		return newSocketError(ErrCodeMalformedEvent, constants.SocketEventIsMalformed)
+	}
+
+	if request.Version != ProtocolVersion{
+		return newSocketError(ErrCodeUnsupportedVersion, constants.ProtocolVersionIsNotSupported)
+	}
+
+	handler, ok := socketEventHandlers[request.Type]
+	if !ok{
+		return newSocketError(ErrCodeUnknownEvent, constants.SocketEventIsUnknown)
+	}
+	return handler(client, *request)
+}
+
+func sendSocketError(client *Client, requestID string, err *SocketError){
+	sendToClient(client.Lobby, client, SocketEvent{
+		EventName: "error",
+		EventPayload: err,
+		RequestID: requestID,
+	})
+}
+
+func (request SendMessageRequest) Validate() error{
+	if request.ClientMessageID == "" || len(request.ClientMessageID) > 64{
+		return errors.New(constants.ClientMessageIDIsInvalid)
+	}
+	if request.Message == "" && len(request.AttachmentIDs) == 0{
+		return errors.New(constants.MessageNeedsTextOrAttachments)
+	}
+	if len(request.AttachmentIDs) > maxAttachmentsPerMessage{
+		return errors.New(constants.TooManyAttachments)
+	}
+	seen := make(map[string]bool, len(request.AttachmentIDs))
+	for _, attachmentID := range request.AttachmentIDs{
+		if attachmentID == "" || seen[attachmentID]{
+			return errors.New(constants.AttachmentCantBeUsed)
+		}
+		seen[attachmentID] = true
+	}
+	if (request.ToUserID == "") == (request.RoomID == ""){
+		return errors.New(constants.TargetIsInvalid)
+	}
+	if request.Thread && request.ParentID == ""{
+		return errors.New(constants.ThreadNeedsParent)
+	}
+	return nil
+}
+
+func (request ResumeRequest) Validate() error{
+	if request.LastSeq < 0{
+		return errors.New(constants.LastSeqIsInvalid)
+	}
+	return nil
+}
+
+// a direct read names the sender and the newest message read, a room read only the room
+func (request ReadRequest) Validate() error{
+	direct := request.FromUserID != "" && request.UpToMessageID != ""
+	if direct == (request.RoomID != ""){
+		return errors.New(constants.ReadRequestIsInvalid)
+	}
+	return nil
+}
+
+// For the client to see everyone that's online, the others learn about
+// this user through the presence announcement of the Lobby
+func handleJoinEvent(client *Client, request SocketEnvelope) *SocketError{
+	payload, err := chatListEvent(client, request.RequestID)
+	if err != nil{
+		return err
+	}
+	sendToClient(client.Lobby, client, payload)
+	return nil
+}
+
+// the online users the client sees when it joins
+func chatListEvent(client *Client, requestID string) (SocketEvent, *SocketError){
+	// the userID always comes from the authenticated connection, never from the payload
+	userDetails := client.Lobby.store.GetUserByUserID(client.UserID)
+	if userDetails == (UserDetails{}){
+		client.log.Warn("An unregistered user tried to connect to the chat server")
+		return SocketEvent{}, newSocketError(ErrCodeNotFound, constants.UserIsNotRegisteredWithUs)
+	}
+
+	return SocketEvent{
+		EventName: "chatlist-response",
+		EventPayload: chatListResponse{
+			Type: "my-chatlist",
+			Chatlist: client.Lobby.store.GetAllOnlineUsers(userDetails.ID),
+		},
+		RequestID: requestID,
+	}, nil
+}
+
+// closing the connection makes readPump unregister the client, the Lobby
+// then works out whether the user is still online on another device
+func handleDisconnectEvent(client *Client, request SocketEnvelope) *SocketError{
+	client.Conn.Close()
+	return nil
+}
+
+// every message event is answered with an ack once the message is stored, or a nack
+func handleMessageEvent(client *Client, request SocketEnvelope) *SocketError{
+	var message SendMessageRequest
+
+	stored, err := sendMessage(client, request, &message)
+	if err != nil{
+		sendToClient(client.Lobby, client, SocketEvent{
+			EventName: "nack",
+			EventPayload: MessageNack{ClientMessageID: message.ClientMessageID, Code: err.Code, Reason: err.Message},
+			RequestID: request.RequestID,
+		})
+		return nil
+	}
+
+	sendToClient(client.Lobby, client, SocketEvent{
+		EventName: "ack",
+		EventPayload: MessageAck{ClientMessageID: message.ClientMessageID, MessageID: stored.ID, CreatedAt: stored.CreatedAt},
+		RequestID: request.RequestID,
+	})
+	return nil
+}
+
+// a room target fans out to every member, otherwise it's a direct message
+func sendMessage(client *Client, request SocketEnvelope, message *SendMessageRequest) (Message, *SocketError){
+	if err := decodePayload(request, message); err != nil{
+		return Message{}, err
+	}
+
+	fromUserID := client.UserID
+
+	// sending the message ends the typing indicator
+	HandleTypingStop(client, TypingEvent{UserID: fromUserID, ToUserID: message.ToUserID, RoomID: message.RoomID})
+
+	var recipientIDs []string
+	if message.RoomID != ""{
+		room := client.Lobby.store.GetRoomByID(message.RoomID)
+		if !room.HasMember(fromUserID){
+			client.log.Warn("Tried to message a room without being a member", "roomId", message.RoomID)
+			return Message{}, newSocketError(ErrCodeForbidden, constants.YouAreNotARoomMember)
+		}
+		recipientIDs = room.Members
+	}else{
+		recipientIDs = uniqueMembers(fromUserID, []string{message.ToUserID})
+	}
+
+	payload := MessagePayload{
+		ClientMessageID: message.ClientMessageID,
+		FromUserID: fromUserID,
+		ToUserID: message.ToUserID,
+		RoomID: message.RoomID,
+		Message: message.Message,
+	}
+	if err := resolveParent(client.Lobby.store, *message, &payload); err != nil{
+		return Message{}, err
+	}
+	if payload.ThreadID != ""{
+		recipientIDs = threadRecipients(client.Lobby.store, payload.ThreadID, fromUserID, recipientIDs)
+	}
+
+	var claimErr *SocketError
+	if payload.Attachments, claimErr = claimAttachments(client.Lobby.store, fromUserID, message); claimErr != nil{
+		return Message{}, claimErr
+	}
+
+	stored, err := deliverNewMessage(request.Context(), client, payload, recipientIDs)
+	if err != nil{
+		return Message{}, newSocketError(ErrCodeInternal, constants.ServerFailedResponse)
+	}
+	return stored, nil
+}
+
+func handleResumeEvent(client *Client, request SocketEnvelope) *SocketError{
+	var resume ResumeRequest
+	if err := decodePayload(request, &resume); err != nil{
+		return err
+	}
+
+	resumeClient(client, resume.LastSeq)
+	return nil
+}
+
+func handleReadEvent(client *Client, request SocketEnvelope) *SocketError{
+	var read ReadRequest
+	if err := decodePayload(request, &read); err != nil{
+		return err
+	}
+
+	// rooms have no per-message read state, reading one only clears its unread count
+	if read.RoomID != ""{
+		if !client.Lobby.store.GetRoomByID(read.RoomID).HasMember(client.UserID){
+			return newSocketError(ErrCodeForbidden, constants.YouAreNotARoomMember)
+		}
+		if err := client.Lobby.store.MarkConversationRead(client.UserID, roomConversationID(read.RoomID)); err != nil{
+			return newSocketError(ErrCodeNotFound, err.Error())
+		}
+		return nil
+	}
+
+	changed, err := client.Lobby.store.MarkMessagesRead(client.UserID, read.FromUserID, read.UpToMessageID)
+	if err != nil{
+		client.log.Warn("Failed to mark messages read", "error", err)
+		return newSocketError(ErrCodeNotFound, constants.MessageDoesNotExist)
+	}
+
+	if changed > 0{
+		EmitToClient(client.Lobby, SocketEvent{
+			EventName: "receipt",
+			EventPayload: Receipt{
+				MessageID: read.UpToMessageID,
+				Status: MessageStatusRead,
+				UserID: client.UserID,
+				At: time.Now(),
+			},
+		}, read.FromUserID)
+	}
+	return nil
+}
@@ -1,119 +1,184 @@
 package handlers
 
 import (
-	"net/http"
 	"bytes"
 	"encoding/json"
-	"log"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
 	"time"
 
+	"chat-app/utils"
+
 	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// pingPeriod < pongWait, 6-second buffer in case a pong is a bit delayed.
-const (
-	writeWait = 10 *time.Second		// prevents server hang, conn doesnt wait forever to send
-	pongWait = 60 *time.Second		// keeps the server waiting too long, if client disconnects
-	pingPeriod = (pongWait*9)/ 10   // sends regular pings to check if client is active
-	maxMessageSize = 512			// prevents memory abuse
+// pingPeriod < pongWait, a 10% buffer in case a pong is a bit delayed. Configure sets them
+// from the socket settings of the config.
+var (
+	writeWait time.Duration		// prevents server hang, conn doesnt wait forever to send
+	pongWait time.Duration		// keeps the server waiting too long, if client disconnects
+	pingPeriod time.Duration	// sends regular pings to check if client is active
+	maxMessageSize int64		// prevents memory abuse, files go through the upload endpoint
+	sendBufferSize int			// events queued per client before it counts as too slow and is dropped
+	resumeBatchSize int64		// missed messages loaded per query while resuming
+	emitBufferSize int			// deliveries queued for the Lobby before emitting blocks
 )
 
-// Upgrader specifies parameters for upgrading an HTTP connection to a WebSocket connection
+// Upgrader specifies parameters for upgrading an HTTP connection to a WebSocket connection,
+// Configure sets its buffer sizes
 var Upgrader = websocket.Upgrader{
-    ReadBufferSize:  1024,
-    WriteBufferSize: 1024,
-    // This CheckOrigin function allows connections from any origin
-    // In production, you might want to be more restrictive
-    CheckOrigin: func(r *http.Request) bool {
-        return true
-    },
+    // only the origins the CORS policy allows may open sockets
+    CheckOrigin: utils.CheckOrigin,
 }
 
-func HandleSocketPayloadEvents(client *Client, socketEventPayload SocketEvent){
-	type chatListResponse struct{
-		Type 	 string 	 `json:"type"`
-		Chatlist interface{} `json:"chatlist"`
+// a direct message written to its recipient's socket counts as delivered, the delivery worker
+// stores that and sends the sender a receipt. writePump never waits for it, when the worker is
+// behind the message stays sent until it's read.
+func markDelivered(c *Client, payload SocketEvent){
+	delivered, ok := payload.EventPayload.(DeliveredMessage)
+	if !ok || delivered.ToUserID != c.UserID || delivered.Status != MessageStatusSent{
+		return
 	}
 
-	switch socketEventPayload.EventName {
-	case "join":
-		userID := (socketEventPayload.EventPayload).(string)
-		userDetails := GetUserByUserID(userID)
-
-		if userDetails == (UserDetails{}){
-			log.Println("An invalid user with userID " + userID + " tried to connect to Chat Server.")
-		} else{
-			if userDetails.Online == "N"{
-				log.Println(userID + " tried to connect to Chat Server.")
-			}else{
-				// Announce in the chatlist arrival of new client
-				newUserOnlinePayload := SocketEvent{
-					EventName: "chatlist-response",
-					EventPayload: chatListResponse{
-						Type: "new-user-joined",
-						Chatlist: UserResponse{
-							Username: userDetails.Username,
-							UserID: userDetails.ID,
-							Online: userDetails.Online,
-						},
-					},
-				}
+	select {
+	case c.Lobby.delivered <- deliveryAck{messageID: delivered.ID, userID: c.UserID}:
+	default:
+		deliveryAckDrops.Inc()
+	}
+}
 
-				BroadcastToEveryoneExceptme(client.Lobby, newUserOnlinePayload, userID)
+// stores the deliveries writePump reported, one at a time
+func (lobby *Lobby) deliveryWorker(){
+	for ack := range lobby.delivered{
+		if ack.flushed != nil{
+			close(ack.flushed)
+			continue
+		}
 
-				// For the client to see everyone that's online
-				allOnlineUsersPayload := SocketEvent{
-					EventName: "chatlist-response",
-					EventPayload: chatListResponse{
-						Type: "my-chatlist",
-						Chatlist: GetAllOnlineUsers(userDetails.ID),
-					},
-				}
+		message, changed := lobby.store.MarkMessageDelivered(ack.messageID, ack.userID)
+		if !changed{
+			continue
+		}
 
-				EmitToClient(client.Lobby, allOnlineUsersPayload, userDetails.ID)
-			}
+		EmitToClient(lobby, SocketEvent{
+			EventName: "receipt",
+			EventPayload: Receipt{
+				MessageID: message.ID,
+				Status: MessageStatusDelivered,
+				UserID: ack.userID,
+				At: *message.DeliveredAt,
+			},
+		}, message.FromUserID)
+	}
+}
+
+// stores the message and sends it to every recipient with their own sequence number,
+// the sender's other devices get it too so they stay in sync. The store keeps a message
+// and its inbox entries in one transaction, so a retried message was stored completely and
+// sent the first time, it only comes back without being sent again. A recipient who missed
+// it gets it from their inbox when they resume.
+func deliverNewMessage(ctx context.Context, client *Client, messagePacket MessagePayload, recipientIDs []string) (Message, error){
+	storeCtx, span := startChildSpan(ctx, "StoreNewMessages", trace.WithAttributes(attribute.Int("chat.recipients", len(recipientIDs))))
+	stored, entries, err := client.Lobby.store.StoreNewMessages(storeCtx, messagePacket, recipientIDs)
+	if err != nil && !errors.Is(err, ErrDuplicateMessage){
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(attribute.String("chat.message_id", stored.ID))
+	span.End()
+
+	if errors.Is(err, ErrDuplicateMessage){
+		return stored, nil
+	}
+	if err != nil{
+		client.log.Error("Failed to store message", "error", err)
+		return Message{}, err
+	}
+	messagesStored.Inc()
+
+	if len(stored.Attachments) > 0{
+		attachmentIDs := make([]string, 0, len(stored.Attachments))
+		for _, attachment := range stored.Attachments{
+			attachmentIDs = append(attachmentIDs, attachment.ID)
 		}
-	case "disconnect":
-		if socketEventPayload.EventPayload != nil{
-			userID := (socketEventPayload.EventPayload).(string)
-			userDetails := GetUserByUserID(userID)
-			UpdateUserOnlineStatusByUserID(userID, "N")
-
-			BroadcastToEveryone(client.Lobby, SocketEvent{
-				EventName: "chatlist-response",
-				EventPayload: chatListResponse{
-					Type: "user-disconnected",
-					Chatlist: UserResponse{
-						Online: "N",
-						UserID: userDetails.ID,
-						Username: userDetails.Username,
-					},
-				},
-			})
+		if err := client.Lobby.store.LinkAttachments(attachmentIDs, stored.ID); err != nil{
+			client.log.Error("Failed to link the attachments of message", "messageId", stored.ID, "error", err)
 		}
-	case "message":
-		//decoding JSON into Go types using the encoding/json package without a struct, Go uses this:
-		//  map[string]interface{}
-
-		message	   := (socketEventPayload.EventPayload.(map[string]interface{})["message"]).(string)
-		toUserID   := (socketEventPayload.EventPayload.(map[string]interface{})["toUserID"]).(string)
-		fromUserID := (socketEventPayload.EventPayload.(map[string]interface{})["fromUserID"]).(string)
-
-		if message != "" && fromUserID != "" && toUserID != "" {
-			messagePacket := MessagePayload{
-				FromUserID: fromUserID,
-				Message: message,
-				ToUserID: toUserID,
-			}
-			StoreNewMessages(messagePacket)
-			payload := SocketEvent{
-				EventName: "message-response",
-				EventPayload: messagePacket,
+	}
+
+	for _, entry := range entries{
+		payload := SocketEvent{
+			EventName: deliveryEventName(stored),
+			EventPayload: DeliveredMessage{Message: withReactionCountsFor(stored, entry.UserID), Seq: entry.Seq},
+			ctx: ctx,
+		}
+
+		if entry.UserID == client.UserID{
+			EmitToOtherDevices(client.Lobby, payload, client)
+		}else{
+			EmitToClient(client.Lobby, payload, entry.UserID)
+		}
+	}
+
+	if stored.ThreadID != ""{
+		announceThreadUpdate(client.Lobby, stored.ThreadID)
+	}
+	return stored, nil
+}
+
+// replays everything the client missed after lastSeq, live messages are held back meanwhile
+// and the client switches to live delivery once the replay has caught up with the inbox
+func resumeClient(client *Client, lastSeq int64){
+	client.deliveryMu.Lock()
+	client.resuming = true
+	client.deliveryMu.Unlock()
+
+	for {
+		missed := client.Lobby.store.GetMissedMessages(client.UserID, lastSeq, resumeBatchSize)
+
+		if len(missed) == 0{
+			// check once more while holding the lock, so a message stored right now is
+			// either part of the replay or delivered live after the switch
+			client.deliveryMu.Lock()
+			missed = client.Lobby.store.GetMissedMessages(client.UserID, lastSeq, resumeBatchSize)
+			if len(missed) == 0{
+				client.resuming = false
+				client.deliveryMu.Unlock()
+				break
 			}
+			client.deliveryMu.Unlock()
+		}
 
-			EmitToClient(client.Lobby, payload, toUserID)
+		for _, message := range missed{
+			message.Message = withReactionCountsFor(message.Message, client.UserID)
+			if !sendBlocking(client, SocketEvent{EventName: deliveryEventName(message.Message), EventPayload: message}){
+				// the client can't keep up, it resumes again after reconnecting
+				client.Conn.Close()
+				return
+			}
+			lastSeq = message.Seq
 		}
 	}
+
+	sendBlocking(client, SocketEvent{
+		EventName: "resume-complete",
+		EventPayload: ResumeRequest{LastSeq: lastSeq},
+	})
+}
+
+// waits for room in the send buffer instead of dropping the client, used by the replay
+func sendBlocking(client *Client, payload SocketEvent) bool{
+	select {
+	case client.Send <- payload:
+		return true
+	case <-time.After(writeWait):
+		return false
+	}
 }
 
 func setSocketPayloadReadConfig(c *Client){
@@ -124,41 +189,48 @@ func setSocketPayloadReadConfig(c *Client){
 
 // client stays in the lobby, but client side Conn is closed
 func unRegisterAndCloseConn(c *Client){
+	// emitting typing-stop goes through the Lobby, so it can't happen while the Lobby unregisters
+	stopAllTyping(c)
 	c.Lobby.unregister <- c
 	c.Conn.Close()
+	socketConnectionsOpen.Dec()
 }
 
 func (c *Client) readPump(){
-	var socketEvenPayload SocketEvent
-
 	defer unRegisterAndCloseConn(c)
+	defer c.log.Info("Socket disconnected")
 
 	setSocketPayloadReadConfig(c)
 
 	for {
 		_, payload, err := c.Conn.ReadMessage()
-
-		decoder := json.NewDecoder(bytes.NewReader(payload))
-		decoderErr := decoder.Decode(&socketEvenPayload)
-
-		if decoderErr != nil{
-			log.Printf("error: %v", decoderErr)
-			break
-		}
-
 		if err != nil {
+			// the read deadline only passes when no pong came back in time
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout(){
+				pingTimeouts.Inc()
+			}
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error ===: %v", err)
+				c.log.Warn("Socket closed unexpectedly", "error", err)
 			}
 			break
 		}
 
-		HandleSocketPayloadEvents(c, socketEvenPayload)
+		// every frame starts a trace, a message's trace follows it to its recipients' sockets
+		ctx, span := tracer.Start(context.Background(), "websocket.read", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("chat.user_id", c.UserID),
+			attribute.String("chat.client_id", c.ID),
+			attribute.Int("websocket.frame_size", len(payload)),
+		))
+
+		// a bad frame gets an error event, the connection stays open
+		HandleSocketPayloadEvents(ctx, c, payload)
+		span.End()
 	}
 }
 
 // sends mssg, from: server to client
-// batches the messages
+// writes every event as its own frame, the client parses one JSON document per frame
 // sends periodic ping
 // cleans up gracefully on errors or disconnects
 func (c *Client) writePump(){
@@ -167,123 +239,228 @@ func (c *Client) writePump(){
 	defer func(){
 		ticker.Stop()
 		c.Conn.Close()
+		close(c.done)
 	}()
 
 	for {
 		select {
 		case payload, ok := <- c.Send:
-
-			// struct Buffer implements the interface io.Writer{Write(p []byte) (n int, err error)}
-			reqBodyBytes := new(bytes.Buffer)
-			json.NewEncoder(reqBodyBytes).Encode(payload)
-			finalPayload := reqBodyBytes.Bytes()	// returns the unread portion of Buffer
-
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok{
 				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil{
+			if err := c.writePayload(payload); err != nil{
 				return
 			}
 
-			w.Write(finalPayload)
-
-			n := len(c.Send)
-			for i:= 0; i < n; i++{
-				json.NewEncoder(reqBodyBytes).Encode(<-c.Send)
-				w.Write(reqBodyBytes.Bytes())
-			}
-
-			if err := w.Close(); err != nil{
-				return
+		// the Lobby no longer queues anything for the client, what's queued still goes out
+		// and then the close frame tells the client to reconnect
+		case <-c.Lobby.stopping:
+			for {
+				select {
+				case payload, ok := <- c.Send:
+					if !ok{
+						return
+					}
+					c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+					if err := c.writePayload(payload); err != nil{
+						return
+					}
+				default:
+					c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+					c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"))
+					return
+				}
 			}
 
 		// This sends a ping message every pingPeriod to check if the client is still connected.
 		case <-ticker.C:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil{
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout(){
+					pingTimeouts.Inc()
+				}
 				return
 			}
 		}
 	}
 }
 
-func CreateClient(lobby *Lobby, connection *websocket.Conn, userID string){
+func (c *Client) writePayload(payload SocketEvent) error{
+	_, span := startChildSpan(payload.ctx, "websocket.write", trace.WithAttributes(
+		attribute.String("chat.event", payload.EventName),
+		attribute.String("chat.client_id", c.ID),
+	))
+	defer span.End()
+
+	if err := writeEvent(c.Conn, payload); err != nil{
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	markDelivered(c, payload)
+	return nil
+}
+
+// wraps the event in the versioned envelope, one envelope per frame
+func writeEvent(conn *websocket.Conn, payload SocketEvent) error{
+	eventPayload, err := json.Marshal(payload.EventPayload)
+	if err != nil{
+		return err
+	}
+
+	// struct Buffer implements the interface io.Writer{Write(p []byte) (n int, err error)}
+	reqBodyBytes := new(bytes.Buffer)
+	err = json.NewEncoder(reqBodyBytes).Encode(SocketEnvelope{
+		Version: ProtocolVersion,
+		Type: payload.EventName,
+		RequestID: payload.RequestID,
+		Payload: eventPayload,
+	})
+	if err != nil{
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, reqBodyBytes.Bytes())
+}
+
+func CreateClient(lobby *Lobby, connection *websocket.Conn, userID, sessionID string, logger *slog.Logger){
 	client := &Client{
+		ID: primitive.NewObjectID().Hex(),
 		Lobby: lobby,
 		Conn: connection,
-		Send: make(chan SocketEvent),
+		Send: make(chan SocketEvent, sendBufferSize),
 		UserID: userID,
+		SessionID: sessionID,
+		done: make(chan struct{}),
 	}
+	client.log = logger.With("clientId", client.ID, "sessionId", sessionID)
+	client.log.Info("Socket connected")
+	socketConnections.Inc()
+	socketConnectionsOpen.Inc()
+
+	// Run takes the client before anything can unregister it, a socket that's closed right away
+	// is then unregistered after it was registered and doesn't stay online
+	client.Lobby.register <- client
 
 	go client.writePump() // uses ping, mssg: server 
 	go client.readPump() // uses pong
-
-	client.Lobby.register <- client
 }
 
 // Join for new Socket Users
 func HandleUserRegisterEvent(lobby *Lobby, client *Client){
-	lobby.clients[client] = true
-	HandleSocketPayloadEvents(client, SocketEvent{
-		EventName: "join",
-		EventPayload: client.UserID,
-	})
+	lobby.addClient(client)
+
+	// users are online while they have a socket open, not when they log in,
+	// the chatlist follows once that's announced
+	lobby.queuePresence(presenceJob{client: client, status: PresenceOnline, join: true})
 }
 
 // Disconnect for Socket Users
 func HandleUserDisconnectEvent(lobby *Lobby, client *Client){
-	_, ok := lobby.clients[client]
-	if ok{
-		// remove client from lobby and close the communication channel
-		delete(lobby.clients, client)
+	if lobby.removeClient(client){
+		// close the communication channel
 		close(client.Send)
 
-		// close the websocket connection
-		HandleSocketPayloadEvents(client, SocketEvent{
-			EventName: "disconnect",
-			EventPayload: client.UserID,
-		})
+		// the user only goes offline with their last connection on any instance
+		lobby.queuePresence(presenceJob{client: client, status: PresenceOffline})
 	}
 }
 
-func EmitToClient(lobby *Lobby, payload SocketEvent, userID string){
+// Closes every socket of this instance on shutdown, once the Lobby stopped each writePump
+// writes out what's queued for its client and then the close frame
+func HandleShutdownEvent(lobby *Lobby) []*Client{
+	var clients []*Client
+	for _, devices := range lobby.clients{
+		for client := range devices{
+			clients = append(clients, client)
+		}
+	}
 
-	for client := range lobby.clients{
-		if client.UserID == userID{
-			select {
-			case client.Send <- payload:
-			default:
-				close(client.Send)
-				delete(lobby.clients, client)
-			}
+	// everyone leaves before any presence is announced, nobody here has to hear about the others
+	for _, client := range clients{
+		lobby.removeClient(client)
+	}
+	close(lobby.stopping)
+	for _, client := range clients{
+		lobby.queuePresence(presenceJob{client: client, status: PresenceOffline})
+	}
+	return clients
+}
+
+// Closes the sockets of a revoked session, readPump then unregisters them as usual
+func HandleSessionRevokeEvent(lobby *Lobby, userID, sessionID string){
+	for client := range lobby.clients[userID]{
+		if sessionID == "" || client.SessionID == sessionID{
+			client.Conn.Close()
 		}
 	}
 }
 
-func BroadcastToEveryone(lobby *Lobby, payload SocketEvent){
-	for client := range lobby.clients{
-		select{
+// queues the payload for the client, a client whose buffer is full is dropped
+func sendToClient(lobby *Lobby, client *Client, payload SocketEvent){
+	client.deliveryMu.Lock()
+	defer client.deliveryMu.Unlock()
+
+	if client.resuming{
+		// stored messages reach the client through the replay, anything else is only
+		// queued if there's room since the replay is filling the buffer
+		if _, isMessage := payload.EventPayload.(DeliveredMessage); isMessage{
+			return
+		}
+		select {
 		case client.Send <- payload:
 		default:
-			close(client.Send)
-			delete(lobby.clients, client)
+			sendBufferDrops.Inc()
 		}
+		return
+	}
+
+	select {
+	case client.Send <- payload:
+	default:
+		sendBufferDrops.Inc()
+		// too slow to keep up, closing the connection makes readPump unregister it
+		// so the Lobby cleans up and updates presence like for any other disconnect
+		client.Conn.Close()
 	}
 }
 
-func BroadcastToEveryoneExceptme(lobby *Lobby, payload SocketEvent, myUserID string){
-	for client := range lobby.clients{
-		if client.UserID != myUserID{
-			select {
-			case client.Send <- payload:
-			default:
-				close(client.Send)
-				delete(lobby.clients, client)
-			}
+// sends the payload to every connection of the user, on every instance
+func EmitToClient(lobby *Lobby, payload SocketEvent, userID string){
+	ctx, span := startChildSpan(payload.ctx, "EmitToClient", trace.WithAttributes(
+		attribute.String("chat.event", payload.EventName),
+		attribute.String("chat.recipient_id", userID),
+	))
+	defer span.End()
+
+	payload.ctx = ctx
+	lobby.publish(Delivery{Kind: deliverToUser, UserID: userID, Event: payload})
+}
+
+// sends the payload to every connection of the client's user except the client itself
+func EmitToOtherDevices(lobby *Lobby, payload SocketEvent, me *Client){
+	ctx, span := startChildSpan(payload.ctx, "EmitToOtherDevices", trace.WithAttributes(attribute.String("chat.event", payload.EventName)))
+	defer span.End()
+
+	payload.ctx = ctx
+	lobby.publish(Delivery{Kind: deliverToUser, UserID: me.UserID, ExceptClientID: me.ID, Event: payload})
+}
+
+// sends the payload to every online member of the room except exceptUserID
+func EmitToRoom(lobby *Lobby, payload SocketEvent, room Room, exceptUserID string){
+	for _, memberID := range room.Members{
+		if memberID != exceptUserID{
+			EmitToClient(lobby, payload, memberID)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func BroadcastToEveryone(lobby *Lobby, payload SocketEvent){
+	lobby.publish(Delivery{Kind: deliverToEveryone, Event: payload})
+}
+
+func BroadcastToEveryoneExceptme(lobby *Lobby, payload SocketEvent, myUserID string){
+	lobby.publish(Delivery{Kind: deliverToEveryone, ExceptUserID: myUserID, Event: payload})
+}
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-app/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spansOnce     sync.Once
+	spansExporter *tracetest.InMemoryExporter
+)
+
+// the tracer of this package only follows the first provider that's set, so every test shares one
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter{
+	t.Helper()
+	spansOnce.Do(func(){
+		spansExporter = tracetest.NewInMemoryExporter()
+		if err := config.UseSpanProcessor(sdktrace.NewSimpleSpanProcessor(spansExporter)); err != nil{
+			t.Fatalf("UseSpanProcessor: %v", err)
+		}
+	})
+	spansExporter.Reset()
+	return spansExporter
+}
+
+// serves sockets for the user in the userID query parameter, without any authentication
+func newTestSocketServer(t *testing.T, store Store) *httptest.Server{
+	t.Helper()
+	lobby, err := NewLobby(store, NewInProcessFanOut(), NewMemoryPresenceTracker())
+	if err != nil{
+		t.Fatalf("NewLobby: %v", err)
+	}
+	go lobby.Run()
+
+	server := serveTestSockets(t, lobby)
+	t.Cleanup(func(){ lobby.Shutdown(context.Background()) })
+	return server
+}
+
+// serves the sockets of the Lobby, which may start running later
+func serveTestSockets(t *testing.T, lobby *Lobby) *httptest.Server{
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+		conn, err := Upgrader.Upgrade(w, r, nil)
+		if err != nil{
+			return
+		}
+		CreateClient(lobby, conn, r.URL.Query().Get("userID"), "session", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dialTestSocket(t *testing.T, server *httptest.Server, userID string) *websocket.Conn{
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?userID="+userID, nil)
+	if err != nil{
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func(){ conn.Close() })
+	return conn
+}
+
+// reads frames until one of the event type arrives
+func readEvent(t *testing.T, conn *websocket.Conn, eventType string) json.RawMessage{
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var envelope struct{
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := conn.ReadJSON(&envelope); err != nil{
+			t.Fatalf("no %s event arrived: %v", eventType, err)
+		}
+		if envelope.Type == eventType{
+			return envelope.Payload
+		}
+	}
+}
+
+// a message is traced from the frame it came in with to the frame that took it to the recipient
+func TestMessageTraceFollowsItToTheRecipient(t *testing.T){
+	exporter := recordSpans(t)
+	store := NewMemoryStore()
+	aliceID, _ := store.CreateUser("alice", "hash")
+	bobID, _ := store.CreateUser("bob", "hash")
+	server := newTestSocketServer(t, store)
+
+	bob := dialTestSocket(t, server, bobID)
+	readEvent(t, bob, "chatlist-response")
+	alice := dialTestSocket(t, server, aliceID)
+	readEvent(t, alice, "chatlist-response")
+
+	err := alice.WriteJSON(map[string]any{
+		"version": ProtocolVersion,
+		"type": "message",
+		"requestId": "request",
+		"payload": map[string]any{"clientMessageId": "message", "toUserID": bobID, "message": "hi"},
+	})
+	if err != nil{
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	readEvent(t, bob, "message-response")
+
+	// the span of the write ends right after the frame went out
+	var spans tracetest.SpanStubs
+	find := func(name string, matches func(tracetest.SpanStub) bool) (tracetest.SpanStub, bool){
+		for _, span := range spans{
+			if span.Name == name && matches(span){
+				return span, true
+			}
+		}
+		return tracetest.SpanStub{}, false
+	}
+	anySpan := func(tracetest.SpanStub) bool{ return true }
+	childOf := func(parent tracetest.SpanStub) func(tracetest.SpanStub) bool{
+		return func(span tracetest.SpanStub) bool{ return span.Parent.SpanID() == parent.SpanContext.SpanID() }
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var write tracetest.SpanStub
+	for {
+		spans = exporter.GetSpans()
+		event, _ := find("socket.event message", anySpan)
+		if emit, ok := find("EmitToClient", childOf(event)); ok{
+			if write, ok = find("websocket.write", childOf(emit)); ok{
+				break
+			}
+		}
+		if time.Now().After(deadline){
+			t.Fatalf("no websocket.write under the message's EmitToClient, got %d spans", len(spans))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	event, _ := find("socket.event message", anySpan)
+	read, ok := find("websocket.read", func(span tracetest.SpanStub) bool{ return span.SpanContext.SpanID() == event.Parent.SpanID() })
+	if !ok{
+		t.Fatalf("socket.event message doesn't start under websocket.read")
+	}
+	stored, ok := find("StoreNewMessages", childOf(event))
+	if !ok{
+		t.Fatalf("no StoreNewMessages under socket.event message")
+	}
+	emit, _ := find("EmitToClient", childOf(event))
+
+	for _, span := range []tracetest.SpanStub{event, stored, emit, write}{
+		if span.SpanContext.TraceID() != read.SpanContext.TraceID(){
+			t.Errorf("%s is in another trace", span.Name)
+		}
+	}
+	if stored.EndTime.After(emit.StartTime){
+		t.Errorf("the message was sent before it was stored")
+	}
+	for _, attribute := range emit.Attributes{
+		if attribute.Key == "chat.recipient_id" && attribute.Value.AsString() != bobID{
+			t.Errorf("EmitToClient went to %s, want %s", attribute.Value.AsString(), bobID)
+		}
+	}
+	for _, attribute := range write.Attributes{
+		if attribute.Key == "chat.event" && attribute.Value.AsString() != "message-response"{
+			t.Errorf("websocket.write wrote %s", attribute.Value.AsString())
+		}
+	}
+}
+
+// a socket that's gone before its client registered still leaves its user offline
+func TestImmediatelyClosedSocketLeavesTheUserOffline(t *testing.T){
+	store := NewMemoryStore()
+	tracker := NewMemoryPresenceTracker()
+	var users []string
+	for i := 0; i < 20; i++{
+		users = append(users, createTestUser(t, store, fmt.Sprint("user", i)))
+	}
+	lobby, err := NewLobby(store, NewInProcessFanOut(), tracker)
+	if err != nil{
+		t.Fatalf("NewLobby: %v", err)
+	}
+	server := serveTestSockets(t, lobby)
+
+	// the Lobby isn't running yet, like a busy one, while every socket opens and closes again
+	for _, userID := range users{
+		dialTestSocket(t, server, userID).Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+	go lobby.Run()
+	t.Cleanup(func(){ lobby.Shutdown(context.Background()) })
+
+	// each user was stored online and then offline again, lastSeen is only set by that
+	deadline := time.Now().Add(5 * time.Second)
+	for _, userID := range users{
+		for {
+			user := store.GetUserByUserID(userID)
+			if !user.LastSeen.IsZero() && user.Online == "N"{
+				break
+			}
+			if time.Now().After(deadline){
+				t.Fatalf("user %s is %q after the socket closed", userID, user.Presence)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if len(tracker.connections) != 0{
+		t.Errorf("the tracker still has connections: %v", tracker.connections)
+	}
+}
+
+// a store whose delivery marks wait until release is closed
+type stuckDeliveryStore struct{
+	*MemoryStore
+	release chan struct{}
+}
+
+func (store stuckDeliveryStore) MarkMessageDelivered(messageID, recipientID string) (Message, bool){
+	<-store.release
+	return store.MemoryStore.MarkMessageDelivered(messageID, recipientID)
+}
+
+// storing a delivery never holds up the socket it was written to
+func TestDeliveryReceiptsDontHoldUpTheSocket(t *testing.T){
+	store := stuckDeliveryStore{MemoryStore: NewMemoryStore(), release: make(chan struct{})}
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+	server := newTestSocketServer(t, store)
+	released := false
+	t.Cleanup(func(){
+		if !released{
+			close(store.release)
+		}
+	})
+
+	alice, bob := dialTestSocket(t, server, aliceID), dialTestSocket(t, server, bobID)
+	readEvent(t, alice, "chatlist-response")
+	readEvent(t, bob, "chatlist-response")
+
+	for _, clientMessageID := range []string{"first", "second"}{
+		sendTestMessage(t, alice, SendMessageRequest{ClientMessageID: clientMessageID, ToUserID: bobID, Message: clientMessageID})
+		readEvent(t, bob, "message-response")
+	}
+
+	close(store.release)
+	released = true
+	for i := 0; i < 2; i++{
+		var receipt Receipt
+		json.Unmarshal(readEvent(t, alice, "receipt"), &receipt)
+		if receipt.Status != MessageStatusDelivered || receipt.UserID != bobID{
+			t.Errorf("receipt: got %+v", receipt)
+		}
+	}
+}
+
+// a drained Lobby fails readiness but keeps its sockets until Shutdown closes them
+func TestDrainKeepsTheSocketsOpen(t *testing.T){
+	store := NewMemoryStore()
+	bobID := createTestUser(t, store, "bob")
+	lobby, err := NewLobby(store, NewInProcessFanOut(), NewMemoryPresenceTracker())
+	if err != nil{
+		t.Fatalf("NewLobby: %v", err)
+	}
+	go lobby.Run()
+	server := serveTestSockets(t, lobby)
+	t.Cleanup(func(){ lobby.Shutdown(context.Background()) })
+
+	bob := dialTestSocket(t, server, bobID)
+	readEvent(t, bob, "chatlist-response")
+	lobby.Drain()
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	Readyz(store, lobby)(c)
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "shutting down"){
+		t.Errorf("readiness while draining: got %d %s", recorder.Code, recorder.Body)
+	}
+
+	EmitToClient(lobby, SocketEvent{EventName: "presence", EventPayload: PresenceEvent{UserID: "someone"}}, bobID)
+	readEvent(t, bob, "presence")
+
+	if err := lobby.Shutdown(context.Background()); err != nil{
+		t.Fatalf("Shutdown: %v", err)
+	}
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := bob.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseGoingAway){
+			break
+		}
+		if err != nil{
+			t.Fatalf("the socket closed without the close frame of a shutdown: %v", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"chat-app/constants"
+)
+
+// ErrDuplicateMessage is returned by StoreNewMessages together with the message stored earlier
+// under the same sender and clientMessageId
+var ErrDuplicateMessage = errors.New(constants.MessageIsDuplicate)
+
+// UserStore keeps the registered users and their online status
+type UserStore interface {
+	GetUserByUserID(userID string) UserDetails
+	// GetUsersByIDs returns the users that exist by their userID, in one query
+	GetUsersByIDs(userIDs []string) map[string]UserDetails
+	GetUserByUsername(username string) UserDetails
+	// CreateUser stores a new user and returns its userID, the password must already be hashed
+	CreateUser(username, passwordHash string) (string, error)
+	// UpdateUserPresence stores the user's overall presence and sets lastSeen to now
+	UpdateUserPresence(userID, presence string) error
+	// GetAllOnlineUsers returns every online or away user except userID
+	GetAllOnlineUsers(userID string) []UserResponse
+}
+
+// MessageStore keeps the one-to-one and room messages
+type MessageStore interface {
+	// StoreNewMessages stores the message and appends it to the inbox of every recipient,
+	// a thread reply also counts towards the replies of the message that started the thread
+	// but leaves the conversations as they are.
+	// A message whose sender and clientMessageId were stored before isn't stored again,
+	// the earlier message comes back with ErrDuplicateMessage.
+	StoreNewMessages(ctx context.Context, message MessagePayload, recipientIDs []string) (Message, []InboxEntry, error)
+	// MarkMessageDelivered moves a direct message to recipientID from sent to delivered,
+	// changed is false when it was already delivered or isn't addressed to recipientID
+	MarkMessageDelivered(messageID, recipientID string) (message Message, changed bool)
+	// MarkMessagesRead marks every message from fromUserID to readerID up to upToMessageID as read
+	// and returns how many changed
+	MarkMessagesRead(readerID, fromUserID, upToMessageID string) (int64, error)
+	// GetMissedMessages returns up to limit messages from the user's inbox after afterSeq, in sequence order
+	GetMissedMessages(userID string, afterSeq, limit int64) []DeliveredMessage
+	// GetMessageByID returns an empty Message when it doesn't exist
+	GetMessageByID(messageID string) Message
+	// EditMessage replaces the text of a message from fromUserID sent after changeableAfter
+	// and keeps the old text in its history
+	EditMessage(messageID, fromUserID, text string, changeableAfter time.Time) (Message, error)
+	// DeleteMessage turns a message from fromUserID sent after changeableAfter into a tombstone,
+	// its text, history, attachments and reactions are removed. A deleted thread reply no longer
+	// counts towards the replies of its thread.
+	DeleteMessage(messageID, fromUserID string, changeableAfter time.Time) (Message, error)
+	// GetRoomConversation returns a page of the room's messages, oldest message first. Like
+	// GetConversationBetweenTwoUsers it leaves out thread replies.
+	GetRoomConversation(roomID string, query ConversationQuery) ConversationPage
+	// GetConversationBetweenTwoUsers returns a page of the conversation, oldest message first
+	GetConversationBetweenTwoUsers(toUser, fromUser string, query ConversationQuery) ConversationPage
+	// GetThread returns a page of the replies in the thread of threadID, oldest reply first
+	GetThread(threadID string, query ConversationQuery) ConversationPage
+	// GetThreadParticipants returns the sender of the message that started the thread and
+	// everyone who replied in it
+	GetThreadParticipants(threadID string) []string
+	// SearchMessages returns up to Limit+1 matching messages before the cursor, newest first
+	SearchMessages(query SearchQuery) []Message
+	// AddReaction adds the user's reaction to a message that isn't deleted, changed is false when
+	// it was there already. It fails once the user has maxReactionsPerUser reactions on the message.
+	AddReaction(messageID, userID, emoji string) (message Message, changed bool, err error)
+	// RemoveReaction removes the user's reaction, changed is false when there was none
+	RemoveReaction(messageID, userID, emoji string) (message Message, changed bool, err error)
+}
+
+// SessionStore keeps the login sessions and their refresh token hashes
+type SessionStore interface {
+	CreateSession(userID, refreshTokenHash string) (string, error)
+	// GetActiveSessionByID returns the session if it exists, isn't revoked and hasn't expired
+	GetActiveSessionByID(sessionID string) (Session, error)
+	// RotateRefreshToken swaps the refresh token hash of an active session, a token can only be used once
+	RotateRefreshToken(oldHash, newHash string) (Session, error)
+	RevokeSession(sessionID string) error
+	RevokeAllUserSessions(userID string) error
+}
+
+// RoomStore keeps the rooms and their members
+type RoomStore interface {
+	// CreateRoom stores a new room owned by ownerID, the owner is always a member
+	CreateRoom(name, ownerID string, memberIDs []string) (Room, error)
+	// GetRoomByID returns an empty Room when it doesn't exist
+	GetRoomByID(roomID string) Room
+	// GetRoomsByIDs returns the rooms that exist by their roomID, in one query
+	GetRoomsByIDs(roomIDs []string) map[string]Room
+	GetRoomsByUserID(userID string) []Room
+	AddRoomMember(roomID, userID string) (Room, error)
+	// RemoveRoomMember takes the user out of the room, when the last owner leaves the oldest member takes over.
+	// The room is deleted once its last member leaves.
+	RemoveRoomMember(roomID, userID string) (Room, error)
+}
+
+// ConversationStore keeps every user's conversation list. The MessageStore and RoomStore
+// methods update it as messages are stored, read, edited and deleted and as members come and go.
+type ConversationStore interface {
+	// GetConversations returns the user's conversations, the most recently active first
+	GetConversations(userID string) []Conversation
+	// MarkConversationRead clears the unread count of one of the user's conversations
+	MarkConversationRead(userID, conversationID string) error
+}
+
+// AttachmentStore keeps the metadata of the uploaded files, the files themselves are in a BlobStore
+type AttachmentStore interface {
+	CreateAttachment(attachment Attachment) error
+	// GetAttachment returns an empty Attachment when it doesn't exist
+	GetAttachment(attachmentID string) Attachment
+	// ClaimAttachments reserves the owner's attachments for the message with clientMessageID and
+	// returns them in the given order. It fails if any of them is missing or claimed by another message.
+	ClaimAttachments(attachmentIDs []string, ownerID, clientMessageID string) ([]Attachment, error)
+	// LinkAttachments records the message the claimed attachments were sent with
+	LinkAttachments(attachmentIDs []string, messageID string) error
+}
+
+// Store is everything the handlers need from the database
+type Store interface {
+	UserStore
+	MessageStore
+	SessionStore
+	RoomStore
+	ConversationStore
+	AttachmentStore
+
+	// Ping checks that the store can be reached, the readiness check calls it
+	Ping(ctx context.Context) error
+}
@@ -0,0 +1,557 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"chat-app/constants"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMemoryStoreContract(t *testing.T){
+	testStoreContract(t, func(t *testing.T) Store{ return NewMemoryStore() })
+}
+
+// runs against a fresh database per test when TEST_DB_URL points at a MongoDB replica set,
+// the writes of StoreNewMessages run in transactions
+func TestMongoStoreContract(t *testing.T){
+	url := os.Getenv("TEST_DB_URL")
+	if url == ""{
+		t.Skip("TEST_DB_URL isn't set")
+	}
+
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(url))
+	if err != nil{
+		t.Fatalf("Connect: %v", err)
+	}
+	t.Cleanup(func(){ client.Disconnect(context.Background()) })
+	if err := NewMongoStore(client, "admin").RequireTransactions(); err != nil{
+		t.Fatalf("RequireTransactions: %v", err)
+	}
+
+	testStoreContract(t, func(t *testing.T) Store{
+		store := NewMongoStore(client, "chat_test_"+primitive.NewObjectID().Hex())
+		t.Cleanup(func(){ store.database.Drop(context.Background()) })
+		if err := store.CreateIndexes(); err != nil{
+			t.Fatalf("CreateIndexes: %v", err)
+		}
+		return store
+	})
+}
+
+// the behaviour the handlers rely on, every Store must pass it
+func testStoreContract(t *testing.T, newStore func(t *testing.T) Store){
+	tests := map[string]func(t *testing.T, store Store){
+		"users": testStoreUsers,
+		"duplicate messages": testStoreDuplicateMessages,
+		"inbox sequences": testStoreInboxSequences,
+		"conversation cursors": testStoreConversationCursors,
+		"threads": testStoreThreads,
+		"conditional edits": testStoreConditionalEdits,
+		"delivery and read receipts": testStoreReceipts,
+		"reactions": testStoreReactions,
+		"sessions": testStoreSessions,
+		"attachments": testStoreAttachments,
+	}
+	for name, test := range tests{
+		t.Run(name, func(t *testing.T){ test(t, newStore(t)) })
+	}
+}
+
+func createTestUser(t *testing.T, store Store, username string) string{
+	t.Helper()
+	userID, err := store.CreateUser(username, "hash")
+	if err != nil{
+		t.Fatalf("CreateUser(%s): %v", username, err)
+	}
+	return userID
+}
+
+func storeTestMessage(t *testing.T, store Store, message MessagePayload, recipientIDs ...string) (Message, []InboxEntry){
+	t.Helper()
+	stored, entries, err := store.StoreNewMessages(context.Background(), message, recipientIDs)
+	if err != nil{
+		t.Fatalf("StoreNewMessages(%+v): %v", message, err)
+	}
+	return stored, entries
+}
+
+func messageIDs(messages []Message) []string{
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages{
+		ids = append(ids, message.ID)
+	}
+	return ids
+}
+
+func testStoreUsers(t *testing.T, store Store){
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+	createTestUser(t, store, "carol")
+
+	if _, err := store.CreateUser("alice", "hash"); err == nil || err.Error() != constants.UsernameIsNotAvailable{
+		t.Errorf("CreateUser of a taken name: got %v", err)
+	}
+	if user := store.GetUserByUsername("alice"); user.ID != aliceID || user.Password != "hash"{
+		t.Errorf("GetUserByUsername: got %+v", user)
+	}
+	if user := store.GetUserByUserID(primitive.NewObjectID().Hex()); user.ID != ""{
+		t.Errorf("GetUserByUserID of a missing user: got %+v", user)
+	}
+	users := store.GetUsersByIDs([]string{aliceID, primitive.NewObjectID().Hex(), bobID, "not an id"})
+	if len(users) != 2 || users[aliceID].Username != "alice" || users[bobID].Username != "bob"{
+		t.Errorf("GetUsersByIDs: got %+v", users)
+	}
+
+	room, err := store.CreateRoom("room", aliceID, []string{bobID})
+	if err != nil{
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	rooms := store.GetRoomsByIDs([]string{room.ID, primitive.NewObjectID().Hex()})
+	if len(rooms) != 1 || rooms[room.ID].Name != "room"{
+		t.Errorf("GetRoomsByIDs: got %+v", rooms)
+	}
+
+	// the room goes away with its last member
+	store.RemoveRoomMember(room.ID, aliceID)
+	if _, err := store.RemoveRoomMember(room.ID, bobID); err != nil{
+		t.Fatalf("RemoveRoomMember: %v", err)
+	}
+	if room := store.GetRoomByID(room.ID); room.ID != ""{
+		t.Errorf("the empty room is still stored: %+v", room)
+	}
+
+	if err := store.UpdateUserPresence(bobID, PresenceAway); err != nil{
+		t.Fatalf("UpdateUserPresence: %v", err)
+	}
+	if user := store.GetUserByUserID(bobID); user.Presence != PresenceAway || user.Online != "Y" || user.LastSeen.IsZero(){
+		t.Errorf("after UpdateUserPresence: got %+v", user)
+	}
+
+	// carol is offline and bob doesn't see himself
+	online := store.GetAllOnlineUsers(bobID)
+	if len(online) != 0{
+		t.Errorf("GetAllOnlineUsers for bob: got %+v", online)
+	}
+	online = store.GetAllOnlineUsers(aliceID)
+	if len(online) != 1 || online[0].UserID != bobID{
+		t.Errorf("GetAllOnlineUsers for alice: got %+v", online)
+	}
+}
+
+func testStoreDuplicateMessages(t *testing.T, store Store){
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+	ctx := context.Background()
+	message := MessagePayload{ClientMessageID: "retry", FromUserID: aliceID, ToUserID: bobID, Message: "hi"}
+
+	first, entries := storeTestMessage(t, store, message, bobID, aliceID)
+	if len(entries) != 2{
+		t.Fatalf("got %d inbox entries, want one for each recipient", len(entries))
+	}
+
+	again, entries, err := store.StoreNewMessages(ctx, message, []string{bobID, aliceID})
+	if !errors.Is(err, ErrDuplicateMessage){
+		t.Fatalf("a retry: got %v, want ErrDuplicateMessage", err)
+	}
+	if again.ID != first.ID || len(entries) != 0{
+		t.Errorf("a retry: got %s with %d entries, want %s without any", again.ID, len(entries), first.ID)
+	}
+
+	// the clientMessageId is only unique per sender
+	message.FromUserID, message.ToUserID = bobID, aliceID
+	if other, _ := storeTestMessage(t, store, message, aliceID, bobID); other.ID == first.ID{
+		t.Errorf("another sender's message with the same clientMessageId was taken for a duplicate")
+	}
+
+	if missed := store.GetMissedMessages(bobID, 0, 10); len(missed) != 2{
+		t.Errorf("bob's inbox has %d messages, want 2", len(missed))
+	}
+	if page := store.GetConversationBetweenTwoUsers(aliceID, bobID, ConversationQuery{Limit: 10}); len(page.Messages) != 2{
+		t.Errorf("the conversation has %d messages, want 2", len(page.Messages))
+	}
+}
+
+func testStoreInboxSequences(t *testing.T, store Store){
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+	room, err := store.CreateRoom("room", aliceID, []string{bobID})
+	if err != nil{
+		t.Fatalf("CreateRoom: %v", err)
+	}
+
+	var sent []string
+	for i := 0; i < 5; i++{
+		message := MessagePayload{ClientMessageID: fmt.Sprint(i), FromUserID: aliceID, ToUserID: bobID, Message: fmt.Sprint(i)}
+		if i%2 == 1{
+			message.ToUserID, message.RoomID = "", room.ID
+		}
+		stored, entries := storeTestMessage(t, store, message, bobID, aliceID)
+		for _, entry := range entries{
+			if entry.MessageID != stored.ID{
+				t.Errorf("an entry of message %d points at %s", i, entry.MessageID)
+			}
+		}
+		sent = append(sent, stored.ID)
+	}
+
+	// every inbox counts from 1 without gaps
+	for _, userID := range []string{aliceID, bobID}{
+		missed := store.GetMissedMessages(userID, 0, 10)
+		if len(missed) != len(sent){
+			t.Fatalf("got %d missed messages, want %d", len(missed), len(sent))
+		}
+		for i, message := range missed{
+			if message.Seq != int64(i+1) || message.ID != sent[i]{
+				t.Errorf("missed message %d: got seq %d of %s, want seq %d of %s", i, message.Seq, message.ID, i+1, sent[i])
+			}
+		}
+	}
+
+	missed := store.GetMissedMessages(bobID, 2, 2)
+	if len(missed) != 2 || missed[0].Seq != 3 || missed[1].Seq != 4{
+		t.Errorf("after seq 2 with a limit of 2: got %+v", missed)
+	}
+	if missed := store.GetMissedMessages(bobID, 5, 10); len(missed) != 0{
+		t.Errorf("after the last seq: got %+v", missed)
+	}
+}
+
+func testStoreConversationCursors(t *testing.T, store Store){
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+	carolID := createTestUser(t, store, "carol")
+
+	var sent []string
+	for i := 0; i < 5; i++{
+		from, to := aliceID, bobID
+		if i%2 == 1{
+			from, to = bobID, aliceID
+		}
+		stored, _ := storeTestMessage(t, store, MessagePayload{FromUserID: from, ToUserID: to, Message: fmt.Sprint(i)}, to, from)
+		sent = append(sent, stored.ID)
+	}
+	// not part of the conversation
+	storeTestMessage(t, store, MessagePayload{FromUserID: aliceID, ToUserID: carolID, Message: "other"}, carolID, aliceID)
+
+	equal := func(got []Message, want []string) bool{
+		return fmt.Sprint(messageIDs(got)) == fmt.Sprint(want)
+	}
+	conversation := func(query ConversationQuery) ConversationPage{
+		return store.GetConversationBetweenTwoUsers(aliceID, bobID, query)
+	}
+
+	// backwards from the newest messages, each page oldest first
+	page := conversation(ConversationQuery{Limit: 2})
+	if !equal(page.Messages, sent[3:5]) || page.NextCursor == ""{
+		t.Fatalf("the newest page: got %v, cursor %q", messageIDs(page.Messages), page.NextCursor)
+	}
+	before, err := DecodeCursor(page.NextCursor)
+	if err != nil{
+		t.Fatalf("DecodeCursor: %v", err)
+	}
+	page = conversation(ConversationQuery{Before: before, Limit: 2})
+	if !equal(page.Messages, sent[1:3]) || page.NextCursor == ""{
+		t.Fatalf("the second page: got %v, cursor %q", messageIDs(page.Messages), page.NextCursor)
+	}
+	before, _ = DecodeCursor(page.NextCursor)
+	page = conversation(ConversationQuery{Before: before, Limit: 2})
+	if !equal(page.Messages, sent[:1]) || page.NextCursor != ""{
+		t.Fatalf("the last page: got %v, cursor %q", messageIDs(page.Messages), page.NextCursor)
+	}
+
+	// forwards from the oldest message, the cursor continues to newer ones
+	after, _ := DecodeCursor(EncodeCursor(store.GetMessageByID(sent[0])))
+	page = conversation(ConversationQuery{After: after, Limit: 3})
+	if !equal(page.Messages, sent[1:4]) || page.NextCursor == ""{
+		t.Fatalf("the page after the oldest: got %v, cursor %q", messageIDs(page.Messages), page.NextCursor)
+	}
+	after, _ = DecodeCursor(page.NextCursor)
+	page = conversation(ConversationQuery{After: after, Limit: 3})
+	if !equal(page.Messages, sent[4:]) || page.NextCursor != ""{
+		t.Fatalf("the page after that: got %v, cursor %q", messageIDs(page.Messages), page.NextCursor)
+	}
+
+	// an inclusive cursor keeps the message it points at on both sides
+	at, _ := DecodeCursor(EncodeInclusiveCursor(store.GetMessageByID(sent[2])))
+	if page := conversation(ConversationQuery{Before: at, Limit: 2}); !equal(page.Messages, sent[1:3]){
+		t.Errorf("the page up to the message: got %v, want %v", messageIDs(page.Messages), sent[1:3])
+	}
+	if page := conversation(ConversationQuery{After: at, Limit: 2}); !equal(page.Messages, sent[2:4]){
+		t.Errorf("the page from the message: got %v, want %v", messageIDs(page.Messages), sent[2:4])
+	}
+
+	// the same conversation seen from the other side
+	if page := store.GetConversationBetweenTwoUsers(bobID, aliceID, ConversationQuery{Limit: 10}); !equal(page.Messages, sent){
+		t.Errorf("bob's side: got %v", messageIDs(page.Messages))
+	}
+}
+
+func testStoreThreads(t *testing.T, store Store){
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+
+	parent, _ := storeTestMessage(t, store, MessagePayload{FromUserID: aliceID, ToUserID: bobID, Message: "parent"}, bobID, aliceID)
+	var replies []string
+	for i := 0; i < 2; i++{
+		reply, _ := storeTestMessage(t, store, MessagePayload{FromUserID: bobID, ToUserID: aliceID, Message: "reply", ThreadID: parent.ID}, aliceID, bobID)
+		replies = append(replies, reply.ID)
+	}
+
+	if page := store.GetConversationBetweenTwoUsers(aliceID, bobID, ConversationQuery{Limit: 10}); fmt.Sprint(messageIDs(page.Messages)) != fmt.Sprint([]string{parent.ID}){
+		t.Errorf("the conversation shows the replies: got %v", messageIDs(page.Messages))
+	}
+	if page := store.GetThread(parent.ID, ConversationQuery{Limit: 10}); fmt.Sprint(messageIDs(page.Messages)) != fmt.Sprint(replies){
+		t.Errorf("the thread: got %v, want %v", messageIDs(page.Messages), replies)
+	}
+	if parent := store.GetMessageByID(parent.ID); parent.ReplyCount != 2 || parent.LastReplyAt == nil{
+		t.Errorf("the parent counts %d replies, last at %v", parent.ReplyCount, parent.LastReplyAt)
+	}
+	if participants := store.GetThreadParticipants(parent.ID); fmt.Sprint(participants) != fmt.Sprint([]string{aliceID, bobID}){
+		t.Errorf("the thread's participants: got %v, want alice and bob", participants)
+	}
+
+	// the replies stay out of alice's conversation with bob
+	conversations := store.GetConversations(aliceID)
+	if len(conversations) != 1 || conversations[0].LastMessage == nil || conversations[0].LastMessage.ID != parent.ID || conversations[0].UnreadCount != 0{
+		t.Errorf("alice's conversations after the replies: got %+v", conversations)
+	}
+
+	if _, err := store.DeleteMessage(replies[1], bobID, time.Now().Add(-time.Minute)); err != nil{
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	if parent := store.GetMessageByID(parent.ID); parent.ReplyCount != 1{
+		t.Errorf("the parent counts %d replies after one was deleted, want 1", parent.ReplyCount)
+	}
+}
+
+func testStoreConditionalEdits(t *testing.T, store Store){
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+	message, _ := storeTestMessage(t, store, MessagePayload{FromUserID: aliceID, ToUserID: bobID, Message: "first"}, bobID, aliceID)
+	window := time.Now().Add(-time.Minute)
+
+	cantChange := func(name string, err error){
+		t.Helper()
+		if err == nil || err.Error() != constants.MessageCantBeChanged{
+			t.Errorf("%s: got %v, want %q", name, err, constants.MessageCantBeChanged)
+		}
+	}
+
+	_, err := store.EditMessage(primitive.NewObjectID().Hex(), aliceID, "text", window)
+	if err == nil || err.Error() != constants.MessageDoesNotExist{
+		t.Errorf("edit of a missing message: got %v", err)
+	}
+	_, err = store.EditMessage(message.ID, bobID, "text", window)
+	cantChange("edit by someone else", err)
+	_, err = store.EditMessage(message.ID, aliceID, "text", time.Now().Add(time.Minute))
+	cantChange("edit after the window", err)
+	_, err = store.DeleteMessage(message.ID, bobID, window)
+	cantChange("delete by someone else", err)
+
+	edited, err := store.EditMessage(message.ID, aliceID, "second", window)
+	if err != nil{
+		t.Fatalf("EditMessage: %v", err)
+	}
+	if edited.Message != "second" || !edited.Edited || edited.EditedAt == nil ||
+		len(edited.History) != 1 || edited.History[0].Message != "first"{
+		t.Errorf("after the edit: got %+v", edited)
+	}
+	if conversations := store.GetConversations(bobID); len(conversations) != 1 ||
+		conversations[0].LastMessage.Message != "second" || !conversations[0].LastMessage.Edited{
+		t.Errorf("the preview doesn't follow the edit: %+v", conversations)
+	}
+
+	deleted, err := store.DeleteMessage(message.ID, aliceID, window)
+	if err != nil{
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	if deleted.Message != "" || !deleted.Deleted || len(deleted.History) != 0{
+		t.Errorf("after the delete: got %+v", deleted)
+	}
+
+	// a tombstone stays as it is
+	_, err = store.EditMessage(message.ID, aliceID, "third", window)
+	cantChange("edit of a deleted message", err)
+	_, err = store.DeleteMessage(message.ID, aliceID, window)
+	cantChange("second delete", err)
+	if _, _, err := store.AddReaction(message.ID, bobID, "👍"); err == nil{
+		t.Errorf("a deleted message got a reaction")
+	}
+}
+
+func testStoreReceipts(t *testing.T, store Store){
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+
+	var sent []Message
+	for i := 0; i < 3; i++{
+		message, _ := storeTestMessage(t, store, MessagePayload{FromUserID: aliceID, ToUserID: bobID, Message: fmt.Sprint(i)}, bobID, aliceID)
+		sent = append(sent, message)
+	}
+	if conversations := store.GetConversations(bobID); len(conversations) != 1 || conversations[0].UnreadCount != 3{
+		t.Fatalf("bob's conversations: %+v", conversations)
+	}
+
+	if _, changed := store.MarkMessageDelivered(sent[0].ID, aliceID); changed{
+		t.Errorf("the sender marked the message delivered")
+	}
+	delivered, changed := store.MarkMessageDelivered(sent[0].ID, bobID)
+	if !changed || delivered.Status != MessageStatusDelivered || delivered.DeliveredAt == nil{
+		t.Errorf("MarkMessageDelivered: got %+v, %v", delivered, changed)
+	}
+	if _, changed := store.MarkMessageDelivered(sent[0].ID, bobID); changed{
+		t.Errorf("the message was delivered twice")
+	}
+
+	if _, err := store.MarkMessagesRead(aliceID, bobID, sent[1].ID); err == nil{
+		t.Errorf("the sender read its own messages")
+	}
+	read, err := store.MarkMessagesRead(bobID, aliceID, sent[1].ID)
+	if err != nil || read != 2{
+		t.Fatalf("MarkMessagesRead: got %d, %v, want 2", read, err)
+	}
+	if read, _ := store.MarkMessagesRead(bobID, aliceID, sent[1].ID); read != 0{
+		t.Errorf("the messages were read twice")
+	}
+	for i, want := range []string{MessageStatusRead, MessageStatusRead, MessageStatusSent}{
+		if message := store.GetMessageByID(sent[i].ID); message.Status != want{
+			t.Errorf("message %d is %s, want %s", i, message.Status, want)
+		}
+	}
+	if conversations := store.GetConversations(bobID); conversations[0].UnreadCount != 1{
+		t.Errorf("bob has %d unread messages, want 1", conversations[0].UnreadCount)
+	}
+
+	if err := store.MarkConversationRead(bobID, directConversationID(aliceID)); err != nil{
+		t.Fatalf("MarkConversationRead: %v", err)
+	}
+	if conversations := store.GetConversations(bobID); conversations[0].UnreadCount != 0{
+		t.Errorf("bob has %d unread messages after reading the conversation", conversations[0].UnreadCount)
+	}
+}
+
+func testStoreReactions(t *testing.T, store Store){
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+	message, _ := storeTestMessage(t, store, MessagePayload{FromUserID: aliceID, ToUserID: bobID, Message: "hi"}, bobID, aliceID)
+
+	if _, changed, err := store.AddReaction(message.ID, bobID, "👍"); err != nil || !changed{
+		t.Fatalf("AddReaction: got %v, %v", changed, err)
+	}
+	reacted, changed, err := store.AddReaction(message.ID, bobID, "👍")
+	if err != nil || changed || len(reacted.Reactions) != 1{
+		t.Errorf("the same reaction again: got %+v, %v, %v", reacted.Reactions, changed, err)
+	}
+
+	for i := 1; i < maxReactionsPerUser; i++{
+		if _, _, err := store.AddReaction(message.ID, bobID, fmt.Sprint(i)); err != nil{
+			t.Fatalf("reaction %d: %v", i, err)
+		}
+	}
+	if _, _, err := store.AddReaction(message.ID, bobID, "one too many"); err == nil || err.Error() != constants.TooManyReactions{
+		t.Errorf("a reaction past the limit: got %v", err)
+	}
+	if _, changed, err := store.AddReaction(message.ID, aliceID, "👍"); err != nil || !changed{
+		t.Errorf("the limit is per user: got %v, %v", changed, err)
+	}
+
+	if _, changed, err := store.RemoveReaction(message.ID, bobID, "👍"); err != nil || !changed{
+		t.Errorf("RemoveReaction: got %v, %v", changed, err)
+	}
+	removed, changed, err := store.RemoveReaction(message.ID, bobID, "👍")
+	if err != nil || changed{
+		t.Errorf("a reaction that's gone: got %v, %v", changed, err)
+	}
+	if count := len(removed.Reactions); count != maxReactionsPerUser{
+		t.Errorf("got %d reactions, want %d", count, maxReactionsPerUser)
+	}
+}
+
+func testStoreSessions(t *testing.T, store Store){
+	aliceID := createTestUser(t, store, "alice")
+
+	sessionID, err := store.CreateSession(aliceID, "first")
+	if err != nil{
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if session, err := store.GetActiveSessionByID(sessionID); err != nil || session.UserID != aliceID{
+		t.Fatalf("GetActiveSessionByID: got %+v, %v", session, err)
+	}
+
+	// a refresh token can be used once
+	if session, err := store.RotateRefreshToken("first", "second"); err != nil || session.ID != sessionID{
+		t.Fatalf("RotateRefreshToken: got %+v, %v", session, err)
+	}
+	if _, err := store.RotateRefreshToken("first", "third"); err == nil{
+		t.Errorf("the old refresh token was accepted again")
+	}
+
+	otherID, _ := store.CreateSession(aliceID, "other")
+	if err := store.RevokeSession(sessionID); err != nil{
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if _, err := store.GetActiveSessionByID(sessionID); err == nil{
+		t.Errorf("a revoked session is active")
+	}
+	if _, err := store.RotateRefreshToken("second", "third"); err == nil{
+		t.Errorf("the token of a revoked session was rotated")
+	}
+	if _, err := store.GetActiveSessionByID(otherID); err != nil{
+		t.Errorf("revoking one session revoked another: %v", err)
+	}
+
+	if err := store.RevokeAllUserSessions(aliceID); err != nil{
+		t.Fatalf("RevokeAllUserSessions: %v", err)
+	}
+	if _, err := store.GetActiveSessionByID(otherID); err == nil{
+		t.Errorf("a session is active after revoking all of them")
+	}
+}
+
+func testStoreAttachments(t *testing.T, store Store){
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+
+	var attachmentIDs []string
+	for i := 0; i < 2; i++{
+		attachment := Attachment{ID: primitive.NewObjectID().Hex(), OwnerID: aliceID, Name: fmt.Sprint(i), Size: 1, CreatedAt: time.Now()}
+		if err := store.CreateAttachment(attachment); err != nil{
+			t.Fatalf("CreateAttachment: %v", err)
+		}
+		attachmentIDs = append(attachmentIDs, attachment.ID)
+	}
+
+	if _, err := store.ClaimAttachments(attachmentIDs, bobID, "message"); err == nil{
+		t.Errorf("someone else claimed the attachments")
+	}
+	claimed, err := store.ClaimAttachments([]string{attachmentIDs[1], attachmentIDs[0]}, aliceID, "message")
+	if err != nil || fmt.Sprint(claimed[0].ID, claimed[1].ID) != fmt.Sprint(attachmentIDs[1], attachmentIDs[0]){
+		t.Fatalf("ClaimAttachments: got %+v, %v", claimed, err)
+	}
+
+	// a retry of the same message claims them again, another message can't
+	if _, err := store.ClaimAttachments(attachmentIDs, aliceID, "message"); err != nil{
+		t.Errorf("a retry: %v", err)
+	}
+	if _, err := store.ClaimAttachments(attachmentIDs[:1], aliceID, "other"); err == nil{
+		t.Errorf("another message claimed an attachment")
+	}
+	if _, err := store.ClaimAttachments([]string{primitive.NewObjectID().Hex()}, aliceID, "other"); err == nil{
+		t.Errorf("a missing attachment was claimed")
+	}
+
+	if err := store.LinkAttachments(attachmentIDs, "messageID"); err != nil{
+		t.Fatalf("LinkAttachments: %v", err)
+	}
+	if attachment := store.GetAttachment(attachmentIDs[0]); attachment.MessageID != "messageID" || attachment.ClaimedBy != "message"{
+		t.Errorf("after LinkAttachments: got %+v", attachment)
+	}
+}
@@ -1,25 +1,309 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/gorilla/websocket"
+	"log/slog"
+	"sync"
 	"time"
 )
 
+// overall presence of a user across all their connections
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
 type UserDetails struct {
 	ID       string `bson:"_id,omitempty"`
 	Username string `json:"username" binding:"required" bson:"username"`
 	Password string `json:"-" bson:"password"`
+	// Online is "Y" while the user is online or away, Presence tells them apart
 	Online   string `json:"online" bson:"online"`
+	Presence string `json:"presence,omitempty" bson:"presence,omitempty"`
+	LastSeen time.Time `json:"lastSeen,omitempty" bson:"lastSeen,omitempty"`
 	SocketID  string    `json:"socketId,omitempty" bson:"socketId,omitempty"`
 	CreatedAt time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
 }
 
+// delivery states of a direct message, they only move forward
+const (
+	MessageStatusSent      = "sent"
+	MessageStatusDelivered = "delivered"
+	MessageStatusRead      = "read"
+)
+
+// a message goes either to one user (ToUserID) or to every member of a room (RoomID).
+// Status, DeliveredAt and ReadAt are only tracked for direct messages.
 type Message struct {
-	ID         string    `json:"id" bson:"_id,omitempty"`
-	Message    string    `json:"message" binding:"required" bson:"message"`
-	ToUserID   string    `json:"toUserID" binding:"required" bson:"toUserID"`
-	FromUserID string    `json:"fromUserID" binding:"required" bson:"fromUserID"`
-	CreatedAt  time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+	ID          string     `json:"id" bson:"_id,omitempty"`
+	// chosen by the sending client, a retry with the same one returns the stored message
+	ClientMessageID string `json:"clientMessageId,omitempty" bson:"clientMessageId,omitempty"`
+	Message     string     `json:"message" binding:"required" bson:"message"`
+	ToUserID    string     `json:"toUserID,omitempty" bson:"toUserID,omitempty"`
+	RoomID      string     `json:"roomId,omitempty" bson:"roomId,omitempty"`
+	FromUserID  string     `json:"fromUserID" binding:"required" bson:"fromUserID"`
+	CreatedAt   time.Time  `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+	Status      string     `json:"status,omitempty" bson:"status,omitempty"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"`
+	ReadAt      *time.Time `json:"readAt,omitempty" bson:"readAt,omitempty"`
+	// an edit keeps the replaced text in History, a delete leaves a tombstone without any text
+	Edited    bool              `json:"edited" bson:"edited,omitempty"`
+	EditedAt  *time.Time        `json:"editedAt,omitempty" bson:"editedAt,omitempty"`
+	Deleted   bool              `json:"deleted" bson:"deleted,omitempty"`
+	DeletedAt *time.Time        `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	History   []MessageRevision `json:"history,omitempty" bson:"history,omitempty"`
+	Attachments []Attachment    `json:"attachments,omitempty" bson:"attachments,omitempty"`
+	// every (user, emoji) pair, clients get them counted for the viewer in ReactionCounts
+	Reactions      []Reaction      `json:"-" bson:"reactions,omitempty"`
+	ReactionCounts []ReactionCount `json:"reactions,omitempty" bson:"-"`
+	// a quoted message is shown as it is now, it follows the quoted message's edits
+	ReplyTo *MessagePreview `json:"replyTo,omitempty" bson:"replyTo,omitempty"`
+	// a reply in the thread of the message ThreadID, it isn't part of the main conversation
+	ThreadID string `json:"threadId,omitempty" bson:"threadId,omitempty"`
+	// kept on the message that started a thread
+	ReplyCount  int        `json:"replyCount,omitempty" bson:"replyCount,omitempty"`
+	LastReplyAt *time.Time `json:"lastReplyAt,omitempty" bson:"lastReplyAt,omitempty"`
+}
+
+// thread-updated tells the whole conversation that a thread got a reply
+type ThreadUpdate struct {
+	ThreadID    string    `json:"threadId"`
+	ReplyCount  int       `json:"replyCount"`
+	LastReplyAt time.Time `json:"lastReplyAt"`
+}
+
+type Reaction struct {
+	UserID string `json:"userID" bson:"userID"`
+	Emoji  string `json:"emoji" bson:"emoji"`
+}
+
+// how many users reacted to a message with Emoji, and whether the viewer is one of them
+type ReactionCount struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reactedByMe"`
+}
+
+// sent by a client to add or remove one of its reactions
+type ReactionRequest struct {
+	MessageID string `json:"messageId"`
+	Emoji     string `json:"emoji"`
+}
+
+// reaction-added and reaction-removed tell the participants how many reactions with Emoji are left
+type ReactionEvent struct {
+	MessageID string `json:"messageId"`
+	UserID    string `json:"userID"`
+	Emoji     string `json:"emoji"`
+	Count     int    `json:"count"`
+}
+
+// a file uploaded by OwnerID, only the owner can see it until it's sent with the message MessageID.
+// Messages keep a copy of it, clients fetch the file through a signed download URL.
+type Attachment struct {
+	ID           string    `json:"id" bson:"_id"`
+	OwnerID      string    `json:"-" bson:"ownerID,omitempty"`
+	// clientMessageId of the message that claimed it, a retry of that message can claim it again
+	ClaimedBy    string    `json:"-" bson:"claimedBy,omitempty"`
+	MessageID    string    `json:"-" bson:"messageId,omitempty"`
+	Name         string    `json:"name" bson:"name"`
+	// sniffed from the content, the uploader's content type isn't trusted
+	ContentType  string    `json:"contentType" bson:"contentType"`
+	Size         int64     `json:"size" bson:"size"`
+	Width        int       `json:"width,omitempty" bson:"width,omitempty"`
+	Height       int       `json:"height,omitempty" bson:"height,omitempty"`
+	HasThumbnail bool      `json:"hasThumbnail" bson:"hasThumbnail"`
+	CreatedAt    time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// signed URLs to download an attachment, they stop working at ExpiresAt
+type AttachmentURLs struct {
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnailUrl,omitempty"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// an earlier text of an edited message and when it was replaced
+type MessageRevision struct {
+	Message    string    `json:"message" bson:"message"`
+	ReplacedAt time.Time `json:"replacedAt" bson:"replacedAt"`
+}
+
+// changes the text of a message, MessageID comes from the path in the REST call
+type EditMessageRequest struct {
+	MessageID string `json:"messageId"`
+	Message   string `json:"message"`
+}
+
+type DeleteMessageRequest struct {
+	MessageID string `json:"messageId"`
+}
+
+// tells the sender that a message reached or was read by its recipient,
+// a read receipt covers every message up to MessageID
+type Receipt struct {
+	MessageID string    `json:"messageId"`
+	Status    string    `json:"status"`
+	UserID    string    `json:"userID"`
+	At        time.Time `json:"at"`
+}
+
+// a message sent by a client, FromUserID always comes from the connection
+type SendMessageRequest struct {
+	ClientMessageID string `json:"clientMessageId"`
+	ToUserID string `json:"toUserID,omitempty"`
+	RoomID   string `json:"roomId,omitempty"`
+	// the message can be empty when it carries attachments
+	Message  string `json:"message"`
+	AttachmentIDs []string `json:"attachmentIds,omitempty"`
+	// the message quoted by this one, or with Thread the message whose thread this reply goes to
+	ParentID string `json:"parentId,omitempty"`
+	Thread   bool   `json:"thread,omitempty"`
+}
+
+// answers a message event once the message is stored
+type MessageAck struct {
+	ClientMessageID string    `json:"clientMessageId"`
+	MessageID       string    `json:"messageId"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// answers a message event that wasn't stored, the client may retry with the same clientMessageId
+type MessageNack struct {
+	ClientMessageID string `json:"clientMessageId"`
+	Code            string `json:"code"`
+	Reason          string `json:"reason"`
+}
+
+// sent by a client after showing the messages from FromUserID up to UpToMessageID,
+// or after showing a room's messages, which clears the room's unread count
+type ReadRequest struct {
+	FromUserID    string `json:"fromUserID,omitempty"`
+	UpToMessageID string `json:"upToMessageId,omitempty"`
+	RoomID        string `json:"roomId,omitempty"`
+}
+
+// records that a message reached a user, Seq counts up per user without gaps
+type InboxEntry struct {
+	UserID    string    `json:"userID" bson:"userID"`
+	Seq       int64     `json:"seq" bson:"seq"`
+	MessageID string    `json:"messageId" bson:"messageId"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// a stored message as it is delivered to one recipient, with that recipient's sequence number
+type DeliveredMessage struct {
+	Message
+	Seq int64 `json:"seq"`
+}
+
+// sent by a reconnecting client with the last sequence number it has seen
+type ResumeRequest struct {
+	LastSeq int64 `json:"lastSeq"`
+}
+
+// sent by a client when it goes idle or is used again
+type PresenceRequest struct {
+	Status string `json:"status"`
+}
+
+// sent by a client that starts or stops typing to a user or in a room
+type TypingRequest struct {
+	ToUserID string `json:"toUserID,omitempty"`
+	RoomID   string `json:"roomId,omitempty"`
+}
+
+// typing-start and typing-stop go to one user (ToUserID) or to the members of a room (RoomID)
+type TypingEvent struct {
+	UserID   string `json:"userID"`
+	ToUserID string `json:"toUserID,omitempty"`
+	RoomID   string `json:"roomId,omitempty"`
+}
+
+// a group conversation, owners can invite new members
+type Room struct {
+	ID        string    `json:"id" bson:"_id,omitempty"`
+	Name      string    `json:"name" bson:"name"`
+	Owners    []string  `json:"owners" bson:"owners"`
+	Members   []string  `json:"members" bson:"members"`
+	CreatedAt time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+}
+
+// sent to the room's members, and to the user who joined or left
+type RoomMemberEvent struct {
+	RoomID string `json:"roomId"`
+	UserID string `json:"userID"`
+	Room   Room   `json:"room"`
+}
+
+type CreateRoomRequest struct {
+	Name    string   `json:"name" binding:"required"`
+	Members []string `json:"members"`
+}
+
+type InviteRoomMemberRequest struct {
+	UserID string `json:"userID" binding:"required"`
+}
+
+// one entry of a user's conversation list, kept up to date as messages are stored.
+// ID is "user:<peerID>" for a direct conversation and "room:<roomID>" for a room.
+type Conversation struct {
+	ID          string          `json:"id" bson:"key"`
+	UserID      string          `json:"-" bson:"userID"`
+	PeerID      string          `json:"peerId,omitempty" bson:"peerId,omitempty"`
+	RoomID      string          `json:"roomId,omitempty" bson:"roomId,omitempty"`
+	LastMessage *MessagePreview `json:"lastMessage,omitempty" bson:"lastMessage,omitempty"`
+	UnreadCount int64           `json:"unreadCount" bson:"unreadCount"`
+	UpdatedAt   time.Time       `json:"updatedAt" bson:"updatedAt"`
+
+	// filled in when the list is returned
+	Peer     *UserResponse `json:"peer,omitempty" bson:"-"`
+	RoomName string        `json:"roomName,omitempty" bson:"-"`
+}
+
+// the start of the latest message of a conversation
+type MessagePreview struct {
+	ID         string    `json:"id" bson:"id"`
+	FromUserID string    `json:"fromUserID" bson:"fromUserID"`
+	Message    string    `json:"message" bson:"message"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+	Edited     bool      `json:"edited" bson:"edited"`
+	Deleted    bool      `json:"deleted" bson:"deleted"`
+	AttachmentCount int  `json:"attachmentCount,omitempty" bson:"attachmentCount,omitempty"`
+}
+
+// SearchQuery selects the messages matching Text in the conversations of UserID, the other fields
+// narrow it down and are ignored when empty. Since is inclusive and Until exclusive.
+type SearchQuery struct {
+	UserID     string
+	Text       string
+	// the rooms UserID is a member of, their messages are searched too
+	RoomIDs    []string
+	WithUserID string
+	FromUserID string
+	Since      time.Time
+	Until      time.Time
+	Before     *MessageCursor
+	Limit      int64
+}
+
+// a message found by search, ConversationPath with before or after set to Cursor opens the
+// page of the conversation that ends or starts with the message
+type SearchResult struct {
+	Message          Message            `json:"message"`
+	Highlights       []HighlightSegment `json:"highlights"`
+	ConversationID   string             `json:"conversationId"`
+	ConversationPath string             `json:"conversationPath"`
+	Cursor           string             `json:"cursor"`
+}
+
+// the message text cut into the parts that matched the search and the parts between them
+type HighlightSegment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match"`
 }
 
 // Registration data and login credentials
@@ -34,27 +318,119 @@ type RegistrationRequest struct {
 
 // user data returned to clients
 type UserResponse struct {
-	Username string `json:"username"`
-	UserID   string `json:"userID"`
-	Online   string `json:"online"`
+	Username string    `json:"username"`
+	UserID   string    `json:"userID"`
+	Online   string    `json:"online"`
+	Presence string    `json:"presence,omitempty"`
+	LastSeen time.Time `json:"lastSeen,omitempty"`
+}
+
+// broadcast whenever a user's overall presence changes
+type PresenceEvent struct {
+	UserID   string    `json:"userID"`
+	Username string    `json:"username"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// a login on one device, the refresh token is only kept as a hash
+type Session struct {
+	ID               string    `json:"id" bson:"_id,omitempty"`
+	UserID           string    `json:"userID" bson:"userID"`
+	RefreshTokenHash string    `json:"-" bson:"refreshTokenHash"`
+	Revoked          bool      `json:"revoked" bson:"revoked"`
+	CreatedAt        time.Time `json:"createdAt" bson:"createdAt"`
+	ExpiresAt        time.Time `json:"expiresAt" bson:"expiresAt"`
+	RevokedAt        time.Time `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+// returned by login, registration and refresh, carries the tokens for later requests
+type AuthResponse struct {
+	Username     string    `json:"username"`
+	UserID       string    `json:"userID"`
+	AccessToken  string    `json:"accessToken"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RefreshToken string    `json:"refreshToken"`
+}
+
+// payload of the chatlist-response events
+type chatListResponse struct{
+	Type 	 string 	 `json:"type"`
+	Chatlist interface{} `json:"chatlist"`
+}
+
+// every socket event travels in a versioned envelope, in both directions.
+// RequestID is chosen by the client and repeated on the events that answer it.
+type SocketEnvelope struct {
+	Version   int             `json:"version"`
+	Type      string          `json:"type"`
+	RequestID string          `json:"requestId,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+
+	// set by HandleSocketPayloadEvents, see Context
+	ctx context.Context
 }
 
+// payload of the error event, the envelope's requestId names the request that failed
+type SocketError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// an event on its way to a client, it's written out as a SocketEnvelope
 type SocketEvent struct {
 	EventName	 string		 `json:"eventname"`
 	EventPayload interface{} `json:"eventpayload"`
+	RequestID    string      `json:"requestId,omitempty"`
+
+	// the trace the event belongs to, if any, its delivery and write are traced under it
+	ctx context.Context
+}
+
+// a direct message written to its recipient's socket, or with flushed a marker that's closed
+// once the acks queued before it are stored
+type deliveryAck struct{
+	messageID string
+	userID    string
+	flushed   chan struct{}
 }
 
 type Client struct {
-	Lobby   *Lobby
-	Conn    *websocket.Conn
-	Send    chan SocketEvent
-	UserID  string
+	// tells the connections of one user apart across all server instances
+	ID        string
+	Lobby     *Lobby
+	Conn      *websocket.Conn
+	Send      chan SocketEvent
+	UserID    string
+	SessionID string
+
+	// tagged with the ID of the request that opened the socket, the user and the connection
+	log *slog.Logger
+	// closed once writePump returned, on a shutdown that's after the close frame
+	done chan struct{}
+
+	// while resuming, live messages are held back until the replay of missed ones caught up
+	deliveryMu sync.Mutex
+	resuming   bool
+
+	// conversations the client is typing in, each timer sends typing-stop if the client goes quiet
+	typingMu sync.Mutex
+	typing   map[string]*typingState
 }
 
 type MessagePayload struct {
+	ClientMessageID string `json:"clientMessageId,omitempty"`
 	FromUserID string `json:"fromUserID" binding:"required"`
-	ToUserID   string `json:"toUserID" binding:"required"`
+	ToUserID   string `json:"toUserID,omitempty"`
+	RoomID     string `json:"roomId,omitempty"`
 	Message    string `json:"message" binding:"required"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	ReplyTo    *MessagePreview `json:"replyTo,omitempty"`
+	ThreadID   string `json:"threadId,omitempty"`
 }
 
 type APIResponse struct{
@@ -62,4 +438,12 @@ type APIResponse struct{
 	Status   string       `json:"status"`
 	Message  string       `json:"message"`
 	Response interface{}  `json:"response"`
-}
\ No newline at end of file
+	// continues a paginated response, empty on the last page
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// the result of each readiness check, "ok" when it passed
+type ReadinessReport struct {
+	Store string `json:"store"`
+	Lobby string `json:"lobby"`
+}
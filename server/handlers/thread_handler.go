@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"net/http"
+
+	"chat-app/constants"
+
+	"github.com/gin-gonic/gin"
+)
+
+// true when the message is sent to the conversation the parent is in
+func sameConversation(parent Message, fromUserID string, message SendMessageRequest) bool{
+	if parent.RoomID != "" || message.RoomID != ""{
+		return parent.RoomID == message.RoomID
+	}
+	return (parent.FromUserID == fromUserID && parent.ToUserID == message.ToUserID) ||
+		(parent.FromUserID == message.ToUserID && parent.ToUserID == fromUserID)
+}
+
+// checks the parent of a reply and fills in what the stored message keeps of it. Replying in
+// a thread to one of its replies quotes that reply, threads never nest.
+func resolveParent(store Store, message SendMessageRequest, payload *MessagePayload) *SocketError{
+	if message.ParentID == ""{
+		return nil
+	}
+
+	parent := store.GetMessageByID(message.ParentID)
+	if parent.ID == "" || parent.Deleted || !isParticipant(store, parent, payload.FromUserID){
+		return newSocketError(ErrCodeNotFound, constants.MessageDoesNotExist)
+	}
+	if !sameConversation(parent, payload.FromUserID, message){
+		return newSocketError(ErrCodeInvalidPayload, constants.ParentIsInAnotherConversation)
+	}
+
+	if !message.Thread{
+		payload.ReplyTo = newMessagePreview(parent)
+		return nil
+	}
+
+	payload.ThreadID = parent.ID
+	if parent.ThreadID != ""{
+		payload.ThreadID = parent.ThreadID
+		payload.ReplyTo = newMessagePreview(parent)
+	}
+	return nil
+}
+
+// a thread reply only reaches the thread's participants, as a thread-reply with a sequence
+// number so it's replayed like any message
+func deliveryEventName(message Message) string{
+	if message.ThreadID != ""{
+		return "thread-reply"
+	}
+	return "message-response"
+}
+
+// the members of the conversation that started or replied in the thread, and fromUserID.
+// The others only hear about the reply count.
+func threadRecipients(store MessageStore, threadID, fromUserID string, members []string) []string{
+	inThread := map[string]bool{fromUserID: true}
+	for _, userID := range store.GetThreadParticipants(threadID){
+		inThread[userID] = true
+	}
+
+	var recipients []string
+	for _, userID := range members{
+		if inThread[userID]{
+			recipients = append(recipients, userID)
+		}
+	}
+	return recipients
+}
+
+// tells the whole conversation the reply count of the thread, once a reply was added or deleted
+func announceThreadUpdate(lobby *Lobby, threadID string){
+	parent := lobby.store.GetMessageByID(threadID)
+	if parent.ID == ""{
+		return
+	}
+
+	update := ThreadUpdate{ThreadID: parent.ID, ReplyCount: parent.ReplyCount}
+	if parent.LastReplyAt != nil{
+		update.LastReplyAt = *parent.LastReplyAt
+	}
+	announceToParticipants(lobby, parent, SocketEvent{EventName: "thread-updated", EventPayload: update}, nil)
+}
+
+// GetThreadMessagesHandler pages through the replies in the thread of a message, oldest reply first
+func GetThreadMessagesHandler(store Store) gin.HandlerFunc{
+	return func(c *gin.Context){
+		authUserID := AuthUserID(c)
+
+		parent := store.GetMessageByID(c.Param("messageID"))
+		if parent.ID == "" || !isParticipant(store, parent, authUserID){
+			c.JSON(http.StatusNotFound, APIResponse{
+				Code:     http.StatusNotFound,
+				Status:   http.StatusText(http.StatusNotFound),
+				Message:  constants.MessageDoesNotExist,
+				Response: nil,
+			})
+			return
+		}
+
+		query, ok := conversationQueryFromRequest(c)
+		if !ok{
+			return
+		}
+
+		thread := store.GetThread(parent.ID, query)
+		c.JSON(http.StatusOK, APIResponse{
+			Code:     http.StatusOK,
+			Status:   http.StatusText(http.StatusOK),
+			Message:  constants.SuccessfulResponse,
+			Response: withReactionCounts(thread.Messages, authUserID),
+			NextCursor: thread.NextCursor,
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sends a message event over the socket and returns the ack
+func sendTestMessage(t *testing.T, conn *websocket.Conn, message SendMessageRequest) MessageAck{
+	t.Helper()
+	err := conn.WriteJSON(map[string]any{"version": ProtocolVersion, "type": "message", "payload": message})
+	if err != nil{
+		t.Fatalf("WriteJSON: %v", err)
+	}
+
+	var ack MessageAck
+	if err := json.Unmarshal(readEvent(t, conn, "ack"), &ack); err != nil{
+		t.Fatalf("the ack isn't JSON: %v", err)
+	}
+	return ack
+}
+
+// a reply goes to the ones in the thread, the rest of the room only gets the new reply count
+func TestThreadReplyOnlyReachesTheThread(t *testing.T){
+	store := NewMemoryStore()
+	aliceID := createTestUser(t, store, "alice")
+	bobID := createTestUser(t, store, "bob")
+	carolID := createTestUser(t, store, "carol")
+	room, err := store.CreateRoom("room", aliceID, []string{bobID, carolID})
+	if err != nil{
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	server := newTestSocketServer(t, store)
+
+	alice, bob, carol := dialTestSocket(t, server, aliceID), dialTestSocket(t, server, bobID), dialTestSocket(t, server, carolID)
+	for _, conn := range []*websocket.Conn{alice, bob, carol}{
+		readEvent(t, conn, "chatlist-response")
+	}
+
+	parent := sendTestMessage(t, alice, SendMessageRequest{ClientMessageID: "parent", RoomID: room.ID, Message: "parent"})
+	sendTestMessage(t, bob, SendMessageRequest{ClientMessageID: "reply", RoomID: room.ID, Message: "reply", ParentID: parent.MessageID, Thread: true})
+
+	readEvent(t, alice, "thread-reply")
+
+	// carol's events arrive in the order they were sent, the reply would come before the count
+	carol.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var envelope SocketEnvelope
+		if err := carol.ReadJSON(&envelope); err != nil{
+			t.Fatalf("no thread-updated event arrived: %v", err)
+		}
+		if envelope.Type == "thread-reply"{
+			t.Fatalf("carol got the reply without being in the thread")
+		}
+		if envelope.Type == "thread-updated"{
+			var update ThreadUpdate
+			json.Unmarshal(envelope.Payload, &update)
+			if update.ThreadID != parent.MessageID || update.ReplyCount != 1{
+				t.Errorf("thread-updated: got %+v", update)
+			}
+			break
+		}
+	}
+
+	if missed := store.GetMissedMessages(carolID, 0, 10); len(missed) != 1{
+		t.Errorf("carol's inbox has %d messages, want only the parent", len(missed))
+	}
+	if missed := store.GetMissedMessages(aliceID, 0, 10); len(missed) != 2{
+		t.Errorf("alice's inbox has %d messages, want the parent and the reply", len(missed))
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+const (
+	// thumbnails fit in a square of this size
+	thumbnailSize = 320
+	// larger images aren't decoded, they'd take too much memory. A 4096x4096 image takes
+	// 24 MiB decoded as a JPEG and 64 MiB as a PNG with alpha
+	maxThumbnailSourcePixels = 4096 * 4096
+)
+
+// the content types a thumbnail can be made of
+var thumbnailContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// decodes the image and returns a JPEG that fits in thumbnailSize, along with the size of the original.
+// The size is read from the header first, so an image that's too large is never decoded.
+func makeThumbnail(source io.Reader) ([]byte, int, int, error){
+	// the bytes the header took are read again by the decoder
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(source, &header))
+	if err != nil{
+		return nil, 0, 0, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailSourcePixels{
+		return nil, config.Width, config.Height, errors.New("image is too large for a thumbnail")
+	}
+
+	original, _, err := image.Decode(io.MultiReader(&header, source))
+	if err != nil{
+		return nil, 0, 0, err
+	}
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, scaleDown(original, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil{
+		return nil, 0, 0, err
+	}
+	return encoded.Bytes(), config.Width, config.Height, nil
+}
+
+// shrinks the image to fit in a size x size square by averaging the pixels each target pixel
+// covers, transparent parts end up white since JPEG has no alpha. The source is converted one
+// row at a time, so only a row of it is ever held as RGBA.
+func scaleDown(source image.Image, size int) image.Image{
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	targetWidth, targetHeight := width, height
+	if width > size || height > size{
+		if width >= height{
+			targetWidth, targetHeight = size, max(1, height*size/width)
+		}else{
+			targetWidth, targetHeight = max(1, width*size/height), size
+		}
+	}
+
+	row := image.NewRGBA(image.Rect(0, 0, width, 1))
+	white := bytes.Repeat([]byte{255}, len(row.Pix))
+	// the sums of the columns of the target row being filled
+	sums := make([]uint64, 3*targetWidth)
+
+	scaled := image.NewRGBA(image.Rect(0, 0, targetWidth, targetHeight))
+	for y := 0; y < targetHeight; y++{
+		top, bottom := y*height/targetHeight, max((y+1)*height/targetHeight, y*height/targetHeight+1)
+		clear(sums)
+
+		for sy := top; sy < bottom; sy++{
+			copy(row.Pix, white)
+			draw.Draw(row, row.Bounds(), source, image.Pt(bounds.Min.X, bounds.Min.Y+sy), draw.Over)
+
+			for x := 0; x < targetWidth; x++{
+				left, right := x*width/targetWidth, max((x+1)*width/targetWidth, x*width/targetWidth+1)
+				for offset := 4*left; offset < 4*right; offset += 4{
+					sums[3*x] += uint64(row.Pix[offset])
+					sums[3*x+1] += uint64(row.Pix[offset+1])
+					sums[3*x+2] += uint64(row.Pix[offset+2])
+				}
+			}
+		}
+
+		for x := 0; x < targetWidth; x++{
+			left, right := x*width/targetWidth, max((x+1)*width/targetWidth, x*width/targetWidth+1)
+			count := uint64((right-left)*(bottom-top))
+			scaled.SetRGBA(x, y, color.RGBA{R: uint8(sums[3*x]/count), G: uint8(sums[3*x+1]/count), B: uint8(sums[3*x+2]/count), A: 255})
+		}
+	}
+	return scaled
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte{
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil{
+		t.Fatalf("png.Encode: %v", err)
+	}
+	return encoded.Bytes()
+}
+
+// near enough for JPEG, which shifts colors a little
+func closeTo(got color.Color, want color.RGBA) bool{
+	r, g, b, _ := got.RGBA()
+	near := func(got uint32, want uint8) bool{
+		diff := int(got>>8) - int(want)
+		return -12 < diff && diff < 12
+	}
+	return near(r, want.R) && near(g, want.G) && near(b, want.B)
+}
+
+func TestMakeThumbnailScalesDown(t *testing.T){
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+
+	// red on the left half, blue on the right, transparent at the bottom
+	source := image.NewNRGBA(image.Rect(0, 0, 640, 480))
+	for y := 0; y < 400; y++{
+		for x := 0; x < 640; x++{
+			if x < 320{
+				source.Set(x, y, red)
+			}else{
+				source.Set(x, y, blue)
+			}
+		}
+	}
+
+	thumbnail, width, height, err := makeThumbnail(bytes.NewReader(encodePNG(t, source)))
+	if err != nil{
+		t.Fatalf("makeThumbnail: %v", err)
+	}
+	if width != 640 || height != 480{
+		t.Errorf("got the original size %dx%d, want 640x480", width, height)
+	}
+
+	scaled, err := jpeg.Decode(bytes.NewReader(thumbnail))
+	if err != nil{
+		t.Fatalf("the thumbnail isn't a JPEG: %v", err)
+	}
+	if bounds := scaled.Bounds(); bounds.Dx() != thumbnailSize || bounds.Dy() != 240{
+		t.Fatalf("got a %dx%d thumbnail, want %dx240", bounds.Dx(), bounds.Dy(), thumbnailSize)
+	}
+	for _, check := range []struct{
+		x, y int
+		want color.RGBA
+	}{
+		{40, 100, red},
+		{280, 100, blue},
+		{160, 230, color.RGBA{R: 255, G: 255, B: 255, A: 255}},
+	}{
+		if got := scaled.At(check.x, check.y); !closeTo(got, check.want){
+			t.Errorf("pixel %d,%d: got %v, want %v", check.x, check.y, got, check.want)
+		}
+	}
+}
+
+// a PNG header claiming a size the decoder would need gigabytes for, without any pixels
+func hugePNGHeader(width, height uint32) []byte{
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8], ihdr[9] = 8, 6 // 8 bits per channel, RGBA
+
+	chunk := append([]byte("IHDR"), ihdr...)
+	header := []byte("\x89PNG\r\n\x1a\n")
+	header = binary.BigEndian.AppendUint32(header, uint32(len(ihdr)))
+	header = append(header, chunk...)
+	return binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(chunk))
+}
+
+func TestMakeThumbnailRejectsLargeImages(t *testing.T){
+	_, width, height, err := makeThumbnail(bytes.NewReader(hugePNGHeader(50_000, 40_000)))
+	if err == nil{
+		t.Fatalf("got a thumbnail of a 2 gigapixel image")
+	}
+	if width != 50_000 || height != 40_000{
+		t.Errorf("got the original size %dx%d, want 50000x40000", width, height)
+	}
+}
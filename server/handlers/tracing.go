@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the global provider is only looked up when a span starts, so config.SetupTracing can run after this
+var tracer = otel.Tracer("chat-app/handlers")
+
+// starts a span only under an existing one, so events that aren't part of a traced message,
+// like presence or typing, don't make traces of their own
+func startChildSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span){
+	if !trace.SpanContextFromContext(ctx).IsValid(){
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, options...)
+}
+
+// the trace of the event as W3C trace context headers, it travels with the delivery to the other instances
+func injectTrace(ctx context.Context) map[string]string{
+	if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid(){
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+func extractTrace(carrier map[string]string) context.Context{
+	if len(carrier) == 0{
+		return nil
+	}
+	return otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(carrier))
+}
+
+// the context the handler of the event runs in, it carries the span of the frame
+func (request SocketEnvelope) Context() context.Context{
+	if request.ctx == nil{
+		return context.Background()
+	}
+	return request.ctx
+}
+
+func socketEventSpanName(eventType string) string{
+	if _, ok := socketEventHandlers[eventType]; !ok{
+		return "socket.event unknown"
+	}
+	return "socket.event " + eventType
+}
+
+// TracingMiddleware starts a span for every request, continuing the trace of a caller that sent a traceparent
+func TracingMiddleware() gin.HandlerFunc{
+	return func(c *gin.Context){
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		// the route pattern keeps IDs out of the span name
+		route := c.FullPath()
+		if route == ""{
+			route = "unmatched"
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method + " " + route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route),
+				attribute.String("chat.request_id", c.GetString(requestIDKey)),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if userID := AuthUserID(c); userID != ""{
+			span.SetAttributes(attribute.String("chat.user_id", userID))
+		}
+		if status >= 500{
+			span.SetStatus(codes.Error, "")
+		}
+	}
+}
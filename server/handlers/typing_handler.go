@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"chat-app/constants"
+)
+
+// a client that started typing and didn't send anything for this long is considered to have stopped,
+// Configure sets it
+var typingTimeout time.Duration
+
+type typingState struct{
+	event TypingEvent
+	timer *time.Timer
+}
+
+func typingKey(event TypingEvent) string{
+	if event.RoomID != ""{
+		return "room:" + event.RoomID
+	}
+	return "user:" + event.ToUserID
+}
+
+func (request TypingRequest) Validate() error{
+	if (request.ToUserID == "") == (request.RoomID == ""){
+		return errors.New(constants.TargetIsInvalid)
+	}
+	return nil
+}
+
+// reads the target of a typing event from the request, the typist is always the client itself
+func typingEventFromRequest(client *Client, request SocketEnvelope) (TypingEvent, *SocketError){
+	var typing TypingRequest
+	if err := decodePayload(request, &typing); err != nil{
+		return TypingEvent{}, err
+	}
+
+	event := TypingEvent{UserID: client.UserID, ToUserID: typing.ToUserID, RoomID: typing.RoomID}
+	if event.RoomID != ""{
+		if !client.Lobby.store.GetRoomByID(event.RoomID).HasMember(client.UserID){
+			client.log.Warn("Tried to type in a room without being a member", "roomId", event.RoomID)
+			return TypingEvent{}, newSocketError(ErrCodeForbidden, constants.YouAreNotARoomMember)
+		}
+		return event, nil
+	}
+	if event.ToUserID == client.UserID{
+		return TypingEvent{}, newSocketError(ErrCodeInvalidPayload, constants.TargetIsInvalid)
+	}
+	return event, nil
+}
+
+func handleTypingStartEvent(client *Client, request SocketEnvelope) *SocketError{
+	event, err := typingEventFromRequest(client, request)
+	if err != nil{
+		return err
+	}
+	HandleTypingStart(client, event)
+	return nil
+}
+
+func handleTypingStopEvent(client *Client, request SocketEnvelope) *SocketError{
+	event, err := typingEventFromRequest(client, request)
+	if err != nil{
+		return err
+	}
+	HandleTypingStop(client, event)
+	return nil
+}
+
+// sends typing-start and keeps refreshing the timeout while the client keeps typing
+func HandleTypingStart(client *Client, event TypingEvent){
+	key := typingKey(event)
+
+	client.typingMu.Lock()
+	if client.typing == nil{
+		client.typing = make(map[string]*typingState)
+	}
+	state, alreadyTyping := client.typing[key]
+	if alreadyTyping{
+		state.timer.Reset(typingTimeout)
+	}else{
+		client.typing[key] = &typingState{
+			event: event,
+			timer: time.AfterFunc(typingTimeout, func(){
+				HandleTypingStop(client, event)
+			}),
+		}
+	}
+	client.typingMu.Unlock()
+
+	// the partner already knows, a refresh only moves the timeout
+	if !alreadyTyping{
+		emitTypingEvent(client, "typing-start", event)
+	}
+}
+
+func HandleTypingStop(client *Client, event TypingEvent){
+	key := typingKey(event)
+
+	client.typingMu.Lock()
+	state, typing := client.typing[key]
+	if typing{
+		state.timer.Stop()
+		delete(client.typing, key)
+	}
+	client.typingMu.Unlock()
+
+	if typing{
+		emitTypingEvent(client, "typing-stop", event)
+	}
+}
+
+// sends typing-stop for every conversation the client was typing in, used when it disconnects
+func stopAllTyping(client *Client){
+	client.typingMu.Lock()
+	events := make([]TypingEvent, 0, len(client.typing))
+	for _, state := range client.typing{
+		events = append(events, state.event)
+	}
+	client.typingMu.Unlock()
+
+	for _, event := range events{
+		HandleTypingStop(client, event)
+	}
+}
+
+// typing events are never stored, they only go to whoever is online right now
+func emitTypingEvent(client *Client, eventName string, event TypingEvent){
+	payload := SocketEvent{
+		EventName: eventName,
+		EventPayload: event,
+	}
+
+	if event.RoomID == ""{
+		EmitToClient(client.Lobby, payload, event.ToUserID)
+		return
+	}
+
+	EmitToRoom(client.Lobby, payload, client.Lobby.store.GetRoomByID(event.RoomID), client.UserID)
+}
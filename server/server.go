@@ -1,62 +1,248 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"chat-app/config"
+	"chat-app/constants"
 	"chat-app/handlers"
 	"chat-app/utils"
 
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 )
 
 func main(){
-	err := godotenv.Load()
+	settings, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp){
+		return
+	}
+	if err != nil{
+		fatal("Error loading the configuration", err)
+	}
+	config.SetupLogging(settings.Logging.Level)
+	slog.Info("Configuration loaded", "config", settings)
+
+	utils.Configure(settings)
+	handlers.Configure(settings)
+
+	shutdownTracing, err := config.SetupTracing(settings.Tracing.Endpoint)
 	if err != nil{
-		log.Fatal("Error loading the environment")
+		fatal("Error setting up tracing", err)
 	}
 
-	fmt.Printf("%s%s%s%s\n", "Server will start at http://", os.Getenv("HOST"), ":", os.Getenv("PORT"))
+	// gin's own debug output goes through slog as well
+	gin.DebugPrintRouteFunc = func(method, path, handler string, _ int){
+		slog.Debug("Route", "method", method, "path", path, "handler", handler)
+	}
+	gin.DebugPrintFunc = func(format string, values ...interface{}){
+		slog.Debug(strings.TrimSpace(fmt.Sprintf(format, values...)))
+	}
 
-	config.ConnectDatabase()
+	slog.Info(fmt.Sprintf("Server will start at http://%s:%d", settings.Server.Host, settings.Server.Port))
 
 	router := gin.New()
-	router.Use(gin.Logger())
+	router.Use(handlers.RequestIDMiddleware())
+	router.Use(handlers.TracingMiddleware())
+	router.Use(handlers.AccessLogMiddleware())
+	router.Use(handlers.MetricsMiddleware())
 
 	router.Use(utils.CORSMiddleware())
 
-	routes(router)
+	store := newStore(settings.Database)
+	lobby := newLobby(store, settings.Redis)
+	routes(router, store, lobby, settings.Attachments)
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", settings.Server.Port), Handler: router}
+	go func(){
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed){
+			fatal("Error running the server", err)
+		}
+	}()
+
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-signals.Done()
+	stop()
+
+	// /readyz fails from now on, the load balancer stops sending traffic here before the listener closes
+	slog.Info("Draining", "drainPeriod", settings.Server.DrainPeriod)
+	lobby.Drain()
+	time.Sleep(time.Duration(settings.Server.DrainPeriod))
+
+	slog.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(settings.Server.ShutdownTimeout))
+	defer cancel()
 
-	router.Run(":" + os.Getenv("PORT"))
+	// no new requests or sockets from here on, the open sockets are closed by the Lobby
+	if err := server.Shutdown(ctx); err != nil{
+		slog.Error("Error stopping the HTTP server", "error", err)
+	}
+	if err := lobby.Shutdown(ctx); err != nil{
+		slog.Error("Error closing the sockets", "error", err)
+	}
+	config.DisConnectDB()
+	if err := shutdownTracing(ctx); err != nil{
+		slog.Error("Error flushing the traces", "error", err)
+	}
+	slog.Info("Server stopped")
 }
 
-func routes(router *gin.Engine) {
-	lobby := handlers.NewLobby()
-	go lobby.Run()
+// logs why the server can't run and exits
+func fatal(message string, err error){
+	slog.Error(message, "error", err)
+	os.Exit(1)
+}
 
-	router.GET("/", handlers.RenderHome())
+// the memory storage runs the server without a MongoDB, nothing survives a restart
+func newStore(database config.DatabaseConfig) handlers.Store{
+	if database.Storage == "memory"{
+		slog.Info("Using the in-memory store")
+		return handlers.NewMemoryStore()
+	}
+
+	config.ConnectDatabase(database.URL)
+	store := handlers.NewMongoStore(config.Client, database.Name)
+	if err := store.RequireTransactions(); err != nil{
+		fatal("Messages are stored in transactions, MongoDB must run as a replica set", err)
+	}
+	if err := store.CreateIndexes(); err != nil{
+		fatal("Error creating database indexes", err)
+	}
+	return store
+}
+
+// a Redis URL lets several instances share their sockets and presence, without it
+// the server runs on its own
+func newCluster(settings config.RedisConfig) (handlers.FanOut, handlers.PresenceTracker){
+	if settings.URL == ""{
+		return handlers.NewInProcessFanOut(), handlers.NewMemoryPresenceTracker()
+	}
+
+	options, err := redis.ParseURL(settings.URL)
+	if err != nil{
+		fatal("Error parsing the Redis URL", err)
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil{
+		fatal("Error connecting to Redis", err)
+	}
+
+	tracker, err := handlers.NewRedisPresenceTracker(client, "chat:presence")
+	if err != nil{
+		fatal("Error registering the instance with Redis", err)
+	}
+	slog.Info("Sharing sockets and presence through Redis")
+	return handlers.NewRedisFanOut(client, "chat:deliveries"), tracker
+}
+
+// the s3 store keeps the attachments in an S3 compatible bucket, otherwise they're files in the attachment dir
+func newBlobStore(attachments config.AttachmentsConfig) handlers.BlobStore{
+	if attachments.Store == "s3"{
+		blobs, err := handlers.NewS3BlobStore(handlers.S3Config{
+			Endpoint: attachments.S3.Endpoint,
+			Region: attachments.S3.Region,
+			Bucket: attachments.S3.Bucket,
+			AccessKeyID: attachments.S3.AccessKeyID,
+			SecretAccessKey: attachments.S3.SecretAccessKey,
+		})
+		if err != nil{
+			fatal("Error configuring the S3 blob store", err)
+		}
+		slog.Info("Keeping attachments in S3", "bucket", attachments.S3.Bucket)
+		return blobs
+	}
 
-	router.GET("/isUsernameAvailable/:username", handlers.IsUsernameAvailable())
+	blobs, err := handlers.NewLocalBlobStore(attachments.Dir)
+	if err != nil{
+		fatal("Error creating the attachment directory", err)
+	}
+	return blobs
+}
 
-	router.POST("/login", handlers.Login())
-	router.POST("/registration", handlers.Registration())
+func newLobby(store handlers.Store, settings config.RedisConfig) *handlers.Lobby{
+	fanOut, tracker := newCluster(settings)
+	lobby, err := handlers.NewLobby(store, fanOut, tracker)
+	if err != nil{
+		fatal("Error subscribing to the other instances", err)
+	}
+	go lobby.Run()
+	return lobby
+}
 
-	router.GET("/UserSessionCheck/:userID", handlers.UserSessionCheck())
-	router.GET("/getConversation/:toUserID/:fromUserID", handlers.GetMessagesHandler())
+func routes(router *gin.Engine, store handlers.Store, lobby *handlers.Lobby, attachments config.AttachmentsConfig) {
+	blobs := newBlobStore(attachments)
 
-	router.GET("/ws/:userID", func(c *gin.Context){
-		userID := c.Param("userID")
+	router.GET("/", handlers.RenderHome())
+	router.GET("/healthz", handlers.Healthz())
+	router.GET("/readyz", handlers.Readyz(store, lobby))
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	router.GET("/isUsernameAvailable/:username", handlers.IsUsernameAvailable(store))
+
+	router.POST("/login", handlers.Login(store))
+	router.POST("/registration", handlers.Registration(store))
+	router.POST("/refreshToken", handlers.RefreshToken(store))
+
+	// signed download URLs carry their own authorization
+	router.GET("/attachments/:attachmentID/download", handlers.DownloadAttachment(store, blobs))
+
+	// everything below requires a valid access token
+	authorized := router.Group("/")
+	authorized.Use(handlers.AuthMiddleware(store))
+
+	authorized.POST("/logout", handlers.Logout(store, lobby))
+	authorized.POST("/logoutAllDevices", handlers.LogoutAllDevices(store, lobby))
+
+	authorized.GET("/UserSessionCheck/:userID", handlers.UserSessionCheck(store))
+	authorized.GET("/getConversation/:toUserID/:fromUserID", handlers.GetMessagesHandler(store))
+	authorized.GET("/conversations", handlers.GetConversations(store))
+	authorized.GET("/messages/search", handlers.SearchMessages(store))
+	authorized.GET("/messages/:messageID/thread", handlers.GetThreadMessagesHandler(store))
+	authorized.PATCH("/messages/:messageID", handlers.EditMessage(store, lobby))
+	authorized.DELETE("/messages/:messageID", handlers.DeleteMessage(store, lobby))
+	authorized.POST("/attachments", handlers.UploadAttachment(store, blobs))
+	authorized.GET("/attachments/:attachmentID", handlers.GetAttachmentURLs(store))
+
+	authorized.POST("/rooms", handlers.CreateRoom(store))
+	authorized.GET("/rooms", handlers.GetRooms(store))
+	authorized.POST("/rooms/:roomID/invite", handlers.InviteRoomMember(store, lobby))
+	authorized.POST("/rooms/:roomID/leave", handlers.LeaveRoom(store, lobby))
+	authorized.GET("/rooms/:roomID/messages", handlers.GetRoomMessagesHandler(store))
+
+	// the user comes from the access token passed in the token query parameter
+	authorized.GET("/ws", func(c *gin.Context){
+		userID := handlers.AuthUserID(c)
+		logger := handlers.RequestLogger(c)
+
+		// a socket opened now would be closed again right away
+		if lobby.ShuttingDown(){
+			c.JSON(http.StatusServiceUnavailable, handlers.APIResponse{
+				Code:     http.StatusServiceUnavailable,
+				Status:   http.StatusText(http.StatusServiceUnavailable),
+				Message:  constants.ServerIsShuttingDown,
+				Response: nil,
+			})
+			return
+		}
 
 		// upgrade the HTTP connection to WebSocket connection
 		conn, err := handlers.Upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil{
-			log.Println("Failed to upgrade connection: ", err)
+			logger.Warn("Failed to upgrade connection", "error", err)
 			return
 		}
 
-		handlers.CreateClient(lobby, conn, userID)
+		handlers.CreateClient(lobby, conn, userID, handlers.AuthSessionID(c), logger)
 	})
-}
\ No newline at end of file
+}
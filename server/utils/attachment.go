@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// DownloadURLTTL returns how long a download URL works, attachments.downloadURLTTL in the config
+func DownloadURLTTL() time.Duration{
+	return downloadURLTTL
+}
+
+// MaxAttachmentSize returns the largest upload in bytes, attachments.maxSize in the config
+func MaxAttachmentSize() int64{
+	return maxAttachmentSize
+}
+
+func downloadSignature(secret []byte, attachmentID, variant string, expires int64) string{
+	mac := hmac.New(sha256.New, secret)
+	// the prefix keeps these signatures apart from anything else signed with the same secret
+	mac.Write([]byte("download\n" + attachmentID + "\n" + variant + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignDownload returns the signature of a download URL of the attachment that expires at expires
+func SignDownload(attachmentID, variant string, expires time.Time) (string, error){
+	secret, err := tokenSecret()
+	if err != nil{
+		return "", err
+	}
+	return downloadSignature(secret, attachmentID, variant, expires.Unix()), nil
+}
+
+// VerifyDownload checks the signature of a download URL and that it hasn't expired
+func VerifyDownload(attachmentID, variant string, expires int64, signature string) bool{
+	secret, err := tokenSecret()
+	if err != nil || time.Now().Unix() > expires{
+		return false
+	}
+	expected := downloadSignature(secret, attachmentID, variant, expires)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
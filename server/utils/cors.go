@@ -1,24 +1,76 @@
 package utils
 
 import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
 	"github.com/gin-gonic/gin"
 )
 
-// returns a gin middleware handler for CORS
+// origins already logged by dev mode, each one is logged once
+var devModeOrigins sync.Map
+
+// AllowedOrigin reports whether a browser page on origin may call the API and open sockets.
+// Dev mode allows every origin and logs the ones the allowlist wouldn't have.
+func AllowedOrigin(origin string) bool{
+	for _, pattern := range allowedOrigins{
+		if pattern.Matches(origin){
+			return true
+		}
+	}
+	if corsDevMode{
+		if _, logged := devModeOrigins.LoadOrStore(origin, true); !logged{
+			slog.Warn("Dev mode allowed an origin outside the allowlist", "origin", origin)
+		}
+		return true
+	}
+	return false
+}
+
+// CheckOrigin is the CheckOrigin of the WebSocket upgrader, it stops other sites from opening
+// sockets in the name of a user. Clients that aren't browsers send no Origin and pages served by
+// the server itself are on its own origin, both are allowed.
+func CheckOrigin(r *http.Request) bool{
+	origin := r.Header.Get("Origin")
+	if origin == ""{
+		return true
+	}
+	if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, r.Host){
+		return true
+	}
+	return AllowedOrigin(origin)
+}
+
+// returns a gin middleware handler for CORS, only allowed origins get the headers that let the browser read the response
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Origin, Accept")
-		c.Writer.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
+		// the response depends on the origin, caches must not hand it to another one
+		c.Writer.Header().Add("Vary", "Origin")
+
+		origin := c.Request.Header.Get("Origin")
+		allowed := origin != "" && AllowedOrigin(origin)
+		if allowed{
+			// the origin is echoed, browsers reject "*" together with credentials
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Origin, Accept")
+			c.Writer.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
+		}
 
 		// Handle preflight requests
-		if c.Request.Method == "OPTIONS" {
+		if c.Request.Method == "OPTIONS" && origin != "" {
+			if !allowed{
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
 			c.AbortWithStatus(204) // Changed from 206 to 204
 			return
 		}
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
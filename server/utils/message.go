@@ -0,0 +1,10 @@
+package utils
+
+import (
+	"time"
+)
+
+// MessageEditWindow returns how long senders can edit or delete a message, messages.editWindow in the config
+func MessageEditWindow() time.Duration{
+	return messageEditWindow
+}
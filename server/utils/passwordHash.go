@@ -6,7 +6,7 @@ import(
 )
 
 func HashPassword(password string)(string, error){
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
 	if err != nil{
 		return "", errors.New("error occurred while creating a Hash")
 	}
@@ -17,7 +17,7 @@ func HashPassword(password string)(string, error){
 func VerifyPassword(hashPass, password string) error{
 	err := bcrypt.CompareHashAndPassword([]byte(hashPass), []byte(password))
 	if err != nil{
-		return errors.New("The " + password + " and " + hashPass + " doesn't match")
+		return errors.New("the password doesn't match")
 	}
 	return nil
 }
\ No newline at end of file
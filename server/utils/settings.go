@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"time"
+
+	"chat-app/config"
+)
+
+// the settings of this package, Configure sets them from the config
+var (
+	jwtSecret         string
+	bcryptCost        int
+	maxAttachmentSize int64
+	messageEditWindow time.Duration
+	accessTokenTTL    time.Duration
+	refreshTokenTTL   time.Duration
+	downloadURLTTL    time.Duration
+	allowedOrigins    []config.OriginPattern
+	corsDevMode       bool
+)
+
+// the defaults hold until main configures the package
+func init(){
+	Configure(config.Default())
+}
+
+func Configure(settings config.Config){
+	jwtSecret = settings.Auth.JWTSecret
+	bcryptCost = settings.Auth.BcryptCost
+	maxAttachmentSize = settings.Attachments.MaxSize
+	messageEditWindow = time.Duration(settings.Messages.EditWindow)
+	accessTokenTTL = time.Duration(settings.Auth.AccessTokenTTL)
+	refreshTokenTTL = time.Duration(settings.Auth.RefreshTokenTTL)
+	downloadURLTTL = time.Duration(settings.Attachments.DownloadURLTTL)
+	allowedOrigins = settings.CORS.AllowedOrigins
+	corsDevMode = settings.CORS.DevMode
+}
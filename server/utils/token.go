@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RefreshTokenTTL returns how long a session lives without being refreshed, auth.refreshTokenTTL in the config
+func RefreshTokenTTL() time.Duration{
+	return refreshTokenTTL
+}
+
+// AccessClaims are the claims carried by every access token
+type AccessClaims struct {
+	Username string `json:"username"`
+	jwt.RegisteredClaims
+}
+
+func tokenSecret() ([]byte, error){
+	if jwtSecret == ""{
+		return nil, errors.New("the JWT secret is not set")
+	}
+	return []byte(jwtSecret), nil
+}
+
+// GenerateAccessToken returns a HMAC signed JWT for the user's session and the time it expires
+func GenerateAccessToken(userID, username, sessionID string) (string, time.Time, error){
+	secret, err := tokenSecret()
+	if err != nil{
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTTL)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, AccessClaims{
+		Username: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID: sessionID,
+			Subject: userID,
+			IssuedAt: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+
+	signed, err := token.SignedString(secret)
+	if err != nil{
+		return "", time.Time{}, errors.New("error occurred while signing the token")
+	}
+	return signed, expiresAt, nil
+}
+
+// ParseAccessToken verifies the signature and expiry of the token and returns its claims
+func ParseAccessToken(tokenString string) (*AccessClaims, error){
+	secret, err := tokenSecret()
+	if err != nil{
+		return nil, err
+	}
+
+	claims := &AccessClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error){
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+
+	if err != nil{
+		return nil, err
+	}
+
+	if claims.Subject == "" || claims.ID == ""{
+		return nil, errors.New("token has no subject or session")
+	}
+	return claims, nil
+}
+
+// GenerateRefreshToken returns a random opaque token, only its hash is ever stored
+func GenerateRefreshToken() (string, error){
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil{
+		return "", errors.New("error occurred while creating a refresh token")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HashRefreshToken returns the hex encoded SHA-256 of a refresh token.
+// Refresh tokens are random and long, so a fast hash is enough here unlike passwords.
+func HashRefreshToken(token string) string{
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}